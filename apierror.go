@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	uberProvider  = "Uber"
+	mondoProvider = "Mondo"
+)
+
+// APIError is a non-200 response from the Uber or Mondo API.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	// Code is the provider's error code, e.g. "unauthorized.bad_access_token"
+	// or "invalid_grant"
+	Code    string
+	Message string
+	// RequestId identifies the request to the provider's support, if they
+	// sent one
+	RequestId string
+	// RetryAfter is how long the provider asked us to wait, or 0
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	message := fmt.Sprintf("%s API %d", e.Provider, e.StatusCode)
+	if e.Code != "" {
+		message += " " + e.Code
+	}
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	if e.RequestId != "" {
+		message += fmt.Sprintf(" (request %s)", e.RequestId)
+	}
+	return message
+}
+
+// apiErrorBody covers the error formats both providers use: Mondo's
+// {code, message}, Uber's {code, message} and {errors: [...]}, and OAuth's
+// {error, error_description}.
+type apiErrorBody struct {
+	Code             string `json:"code"`
+	Message          string `json:"message"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	Errors           []struct {
+		Code  string `json:"code"`
+		Title string `json:"title"`
+	} `json:"errors"`
+}
+
+// requestIdHeaders are where the providers put their request ID.
+var requestIdHeaders = []string{"X-Uber-Request-Id", "X-Request-Id", "Request-Id"}
+
+// newAPIError reads an error response's body into an APIError. The caller
+// still closes the body.
+func newAPIError(provider string, response *http.Response) error {
+	apiError := &APIError{
+		Provider:   provider,
+		StatusCode: response.StatusCode,
+		RetryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+	}
+	for _, header := range requestIdHeaders {
+		if apiError.RequestId = response.Header.Get(header); apiError.RequestId != "" {
+			break
+		}
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		apiError.Message = err.Error()
+		return apiError
+	}
+
+	parsed := apiErrorBody{}
+	if json.Unmarshal(body, &parsed) != nil {
+		apiError.Message = string(body)
+		return apiError
+	}
+	apiError.Code, apiError.Message = parsed.Code, parsed.Message
+	if apiError.Code == "" {
+		apiError.Code, apiError.Message = parsed.Error, parsed.ErrorDescription
+	}
+	if apiError.Code == "" && len(parsed.Errors) > 0 {
+		apiError.Code, apiError.Message = parsed.Errors[0].Code, parsed.Errors[0].Title
+	}
+	if apiError.Code == "" && apiError.Message == "" {
+		apiError.Message = string(body)
+	}
+	return apiError
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
+
+func apiErrorStatus(err error) int {
+	var apiError *APIError
+	if errors.As(err, &apiError) {
+		return apiError.StatusCode
+	}
+	return 0
+}
+
+// IsUnauthorized reports whether the provider rejected our access token, or
+// the refresh token when we tried to get a new one. The user has probably
+// revoked access.
+func IsUnauthorized(err error) bool {
+	var apiError *APIError
+	if !errors.As(err, &apiError) {
+		return false
+	}
+	return apiError.StatusCode == http.StatusUnauthorized || apiError.Code == "invalid_grant"
+}
+
+func IsForbidden(err error) bool {
+	return apiErrorStatus(err) == http.StatusForbidden
+}
+
+func IsNotFound(err error) bool {
+	return apiErrorStatus(err) == http.StatusNotFound
+}
+
+func IsRateLimited(err error) bool {
+	return apiErrorStatus(err) == http.StatusTooManyRequests
+}
+
+// IsServerError reports whether the provider failed with a 5xx, which is
+// usually worth retrying.
+func IsServerError(err error) bool {
+	return apiErrorStatus(err) >= 500
+}
+
+// RetryAfter returns how long the provider asked us to wait before trying
+// again, or 0 if it didn't say.
+func RetryAfter(err error) time.Duration {
+	var apiError *APIError
+	if errors.As(err, &apiError) {
+		return apiError.RetryAfter
+	}
+	return 0
+}
+
+// writeAPIError writes the response for a handler whose API call failed: 503
+// with Retry-After if we're being rate limited, 403 if the user needs to log
+// in again, and otherwise 502 since it's the provider that failed.
+func writeAPIError(w http.ResponseWriter, err error) {
+	switch {
+	case apiErrorStatus(err) == 0:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case IsRateLimited(err):
+		if retryAfter := RetryAfter(err); retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case IsUnauthorized(err) || IsForbidden(err):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
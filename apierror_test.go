@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testErrorResponse(status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{StatusCode: status, Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}
+}
+
+func TestNewAPIErrorParsesProviderFormats(t *testing.T) {
+	cases := []struct {
+		body    string
+		code    string
+		message string
+	}{
+		{`{"code": "unauthorized.bad_access_token", "message": "expired"}`, "unauthorized.bad_access_token", "expired"},
+		{`{"error": "invalid_grant", "error_description": "code used"}`, "invalid_grant", "code used"},
+		{`{"errors": [{"status": 404, "code": "not_found", "title": "No receipt"}]}`, "not_found", "No receipt"},
+		{`upstream timed out`, "", "upstream timed out"},
+	}
+	for _, c := range cases {
+		err := newAPIError(mondoProvider, testErrorResponse(400, nil, c.body)).(*APIError)
+		if err.Code != c.code || err.Message != c.message {
+			t.Errorf("%s: expected %s %q, got %s %q", c.body, c.code, c.message, err.Code, err.Message)
+		}
+	}
+}
+
+func TestNewAPIErrorReadsHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "120")
+	header.Set("X-Uber-Request-Id", "req_1")
+	err := newAPIError(uberProvider, testErrorResponse(429, header, `{"code": "rate_limited"}`))
+
+	if !IsRateLimited(err) || IsUnauthorized(err) {
+		t.Errorf("expected rate limited error, got %s", err.Error())
+	}
+	if RetryAfter(err) != 2*time.Minute {
+		t.Errorf("expected Retry-After 2m, got %s", RetryAfter(err))
+	}
+	if !strings.Contains(err.Error(), "req_1") {
+		t.Errorf("expected request id in %s", err.Error())
+	}
+}
+
+func TestParseRetryAfterDate(t *testing.T) {
+	retryAfter := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if retryAfter <= 0 || retryAfter > time.Minute {
+		t.Errorf("expected up to a minute, got %s", retryAfter)
+	}
+	if parseRetryAfter("soon") != 0 {
+		t.Errorf("expected 0 for unparseable Retry-After")
+	}
+}
+
+func TestAPIErrorHelpers(t *testing.T) {
+	revoked := &APIError{Provider: mondoProvider, StatusCode: 400, Code: "invalid_grant"}
+	if !IsUnauthorized(revoked) || !IsUnauthorized(fmt.Errorf("refresh: %w", revoked)) {
+		t.Errorf("expected a rejected refresh token to count as unauthorized")
+	}
+	if IsNotFound(fmt.Errorf("plain error")) || IsServerError(nil) {
+		t.Errorf("expected non-API errors to match nothing")
+	}
+	if !IsServerError(&APIError{StatusCode: 503}) || !IsNotFound(&APIError{StatusCode: 404}) {
+		t.Errorf("expected status helpers to match")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// apiTransportConfig controls how the API clients talk to Uber and Mondo.
+type apiTransportConfig struct {
+	// Timeout bounds a whole request, including retries
+	Timeout time.Duration
+	// Retries is how many times a failed request is retried
+	Retries   int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxRetryAfter is the longest Retry-After we'll wait out inline. Longer
+	// ones are returned to the caller, e.g. for the job queue to reschedule.
+	MaxRetryAfter time.Duration
+	// RateLimit is the requests per second allowed for each access token,
+	// with bursts of up to Burst requests. 0 disables rate limiting.
+	RateLimit float64
+	Burst     int
+}
+
+// newApiHttpClient returns an HTTP client using apiTransport.
+func newApiHttpClient(config apiTransportConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	base := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: config.Timeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   10,
+	}
+	return &http.Client{
+		Timeout:   config.Timeout,
+		Transport: newApiTransport(base, config),
+	}
+}
+
+// apiTransport retries failed requests with jittered exponential backoff, and
+// limits how fast each access token is used so we stay inside Uber's per-user
+// rate limits. GETs are retried after network errors and 5xx responses; any
+// request is retried after a 429, since the provider didn't act on it.
+type apiTransport struct {
+	base    http.RoundTripper
+	config  apiTransportConfig
+	limiter *rateLimiter
+}
+
+func newApiTransport(base http.RoundTripper, config apiTransportConfig) *apiTransport {
+	return &apiTransport{
+		base:    base,
+		config:  config,
+		limiter: newRateLimiter(config.RateLimit, config.Burst),
+	}
+}
+
+func (t *apiTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	limitKey := ""
+	if authorization := request.Header.Get(Authorization); authorization != "" {
+		// Don't keep access tokens around in the limiter
+		sum := sha256.Sum256([]byte(authorization))
+		limitKey = string(sum[:])
+	}
+
+	for attempt := 0; ; attempt++ {
+		if limitKey != "" {
+			if err := t.limiter.Wait(request.Context(), limitKey); err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := t.base.RoundTrip(request)
+		if attempt >= t.config.Retries || !t.retryable(request, response, err) {
+			return response, err
+		}
+
+		delay := t.backoff(attempt)
+		if response != nil && response.StatusCode == http.StatusTooManyRequests {
+			retryAfter := parseRetryAfter(response.Header.Get("Retry-After"))
+			if retryAfter > t.config.MaxRetryAfter {
+				return response, nil
+			}
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+			if limitKey != "" {
+				t.limiter.Pause(limitKey, delay)
+			}
+		}
+
+		if response != nil {
+			log.Printf("Retrying %s %s in %s: %s\n", request.Method, request.URL.Path, delay, response.Status)
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		} else {
+			log.Printf("Retrying %s %s in %s: %s\n", request.Method, request.URL.Path, delay, err.Error())
+		}
+
+		if request.Body != nil && request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			request = request.Clone(request.Context())
+			request.Body = body
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+	}
+}
+
+func (t *apiTransport) retryable(request *http.Request, response *http.Response, err error) bool {
+	if request.Body != nil && request.GetBody == nil {
+		// Can't send the body again
+		return false
+	}
+	if response != nil && response.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return false
+	}
+	if err != nil {
+		return request.Context().Err() == nil
+	}
+	return response.StatusCode >= 500
+}
+
+// backoff returns a random delay between half and all of the exponential
+// backoff for an attempt, so clients retrying together spread out.
+func (t *apiTransport) backoff(attempt int) time.Duration {
+	delay := t.config.BaseDelay
+	for i := 0; i < attempt && delay < t.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.config.MaxDelay {
+		delay = t.config.MaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
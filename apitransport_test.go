@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestApiClient(rateLimit float64, burst int) *http.Client {
+	return &http.Client{Transport: newApiTransport(http.DefaultTransport, apiTransportConfig{
+		Retries:       3,
+		BaseDelay:     time.Millisecond,
+		MaxDelay:      5 * time.Millisecond,
+		MaxRetryAfter: time.Second,
+		RateLimit:     rateLimit,
+		Burst:         burst,
+	})}
+}
+
+// newFlakyServer fails the first failures requests with status.
+func newFlakyServer(failures, status int, header http.Header) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= failures {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(status)
+			return
+		}
+		r.ParseForm()
+		w.Write([]byte(r.PostForm.Get("body")))
+	}))
+	return server, &requests
+}
+
+func TestApiTransportRetriesGets(t *testing.T) {
+	server, requests := newFlakyServer(2, http.StatusServiceUnavailable, nil)
+	defer server.Close()
+
+	response, err := newTestApiClient(0, 0).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 || *requests != 3 {
+		t.Errorf("expected success on 3rd request, got %d after %d", response.StatusCode, *requests)
+	}
+}
+
+func TestApiTransportDoesNotRetryFailedPosts(t *testing.T) {
+	server, requests := newFlakyServer(1, http.StatusInternalServerError, nil)
+	defer server.Close()
+
+	response, err := newTestApiClient(0, 0).PostForm(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 500 || *requests != 1 {
+		t.Errorf("expected the 500 to be returned, got %d after %d requests", response.StatusCode, *requests)
+	}
+}
+
+func TestApiTransportRetriesRateLimitedPosts(t *testing.T) {
+	server, requests := newFlakyServer(1, http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}})
+	defer server.Close()
+
+	response, err := newTestApiClient(0, 0).Post(server.URL, "application/x-www-form-urlencoded", strings.NewReader("body=resent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != 200 || *requests != 2 || string(body) != "resent" {
+		t.Errorf("expected body to be resent, got %d %q after %d requests", response.StatusCode, body, *requests)
+	}
+}
+
+func TestApiTransportReturnsLongRetryAfter(t *testing.T) {
+	server, requests := newFlakyServer(1, http.StatusTooManyRequests, http.Header{"Retry-After": {"3600"}})
+	defer server.Close()
+
+	response, err := newTestApiClient(0, 0).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 429 || *requests != 1 {
+		t.Errorf("expected the 429 to be returned, got %d after %d requests", response.StatusCode, *requests)
+	}
+}
+
+func TestApiTransportLimitsEachToken(t *testing.T) {
+	server, _ := newFlakyServer(0, 0, nil)
+	defer server.Close()
+	client := newTestApiClient(20, 1)
+
+	get := func(token string) {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		request.Header.Set(Authorization, Bearer+token)
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	started := time.Now()
+	get("a")
+	get("b")
+	if elapsed := time.Since(started); elapsed > 40*time.Millisecond {
+		t.Errorf("expected different tokens not to wait for each other, took %s", elapsed)
+	}
+	get("a")
+	get("a")
+	if elapsed := time.Since(started); elapsed < 90*time.Millisecond {
+		t.Errorf("expected token a to be limited to 20/s, took %s", elapsed)
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	limiter := newRateLimiter(1, 1)
+	limiter.Pause("a", time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx, "a"); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/nu7hatch/gouuid"
+	"log"
+	"strings"
+	"time"
+)
+
+// The most transactions Mondo returns at once
+const transactionPageSize = 100
+
+var ErrBackfillRunning = errors.New("a backfill is already running")
+
+// startBackfill queues a backfill of the session's transactions between since
+// and until, unless one is already running.
+func startBackfill(sessionId string, since, until time.Time) (*backfillProgress, error) {
+	if !since.Before(until) {
+		return nil, fmt.Errorf("backfill from %s is not before %s", since.Format(time.RFC3339), until.Format(time.RFC3339))
+	}
+	existing, err := backfills.Get(sessionId)
+	if err == nil && existing.Status == backfillRunning {
+		return nil, ErrBackfillRunning
+	}
+	if err != nil && err != ErrNoSuchBackfill {
+		return nil, err
+	}
+
+	jobId, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	progress := &backfillProgress{
+		SessionId: sessionId,
+		JobId:     jobId.String(),
+		Since:     since,
+		Until:     until,
+		Status:    backfillRunning,
+		Started:   now,
+		Updated:   now,
+	}
+	if err := backfills.Put(progress); err != nil {
+		return nil, err
+	}
+	return progress, jobs.Enqueue(&job{Id: progress.JobId, Type: backfillJob, SessionId: sessionId})
+}
+
+// runBackfillJob runs the session's backfill, unless it has since been
+// replaced by another.
+func runBackfillJob(ctx context.Context, session *session, j *job) error {
+	progress, err := backfills.Get(session.sessionId)
+	if err == ErrNoSuchBackfill || (err == nil && progress.JobId != j.Id) {
+		log.Printf("Dropping superseded backfill job %s\n", j.Id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return runBackfill(ctx, session, progress, backfills.Put)
+}
+
+// runBackfill lists the session's Uber transactions in the progress's date
+// range and attaches receipts to them, calling report after each. These are
+// usually from before the user linked their accounts, so unlike new
+// transactions no feed items are published for them. If it fails part way,
+// running it again skips the transactions already done.
+func runBackfill(ctx context.Context, session *session, progress *backfillProgress, report func(*backfillProgress) error) error {
+	update := func() error {
+		progress.Updated = time.Now()
+		return report(progress)
+	}
+
+	transactions, err := listUberTransactions(ctx, session, progress.Since, progress.Until)
+	if err != nil {
+		progress.LastError = err.Error()
+		update()
+		return err
+	}
+
+	progress.Transactions = len(transactions)
+	progress.Processed, progress.Attached, progress.Skipped, progress.Review = 0, 0, 0, 0
+	if err := update(); err != nil {
+		return err
+	}
+
+	for _, transaction := range transactions {
+		status, err := backfillTransaction(ctx, session, transaction)
+		if err != nil {
+			progress.LastError = fmt.Sprintf("transaction %s: %s", transaction.Id, err.Error())
+			update()
+			return err
+		}
+		switch status {
+		case ledgerAttached:
+			progress.Attached++
+		case ledgerReview:
+			progress.Review++
+		default:
+			progress.Skipped++
+		}
+		progress.Processed++
+		if err := update(); err != nil {
+			return err
+		}
+	}
+
+	progress.Status = backfillFinished
+	progress.LastError = ""
+	log.Printf("Backfilled session %s: %d attached, %d skipped, %d for review\n", session.sessionId, progress.Attached, progress.Skipped, progress.Review)
+	return update()
+}
+
+// listUberTransactions pages through the session's Mondo transactions
+// between since and until, returning the Uber payments.
+func listUberTransactions(ctx context.Context, session *session, since, until time.Time) ([]MondoTransaction, error) {
+	var transactions []MondoTransaction
+	after := since.Format(time.RFC3339)
+	for {
+		page, err := mondoApiClient.ListTransactionsContext(ctx, session.mondoToken(), session.mondoAccountId, after, until.Format(time.RFC3339), transactionPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, transaction := range page.Transactions {
+			if isUberPayment(transaction) {
+				transactions = append(transactions, transaction)
+			}
+		}
+		if len(page.Transactions) < transactionPageSize {
+			return transactions, nil
+		}
+		after = page.Transactions[len(page.Transactions)-1].Id
+	}
+}
+
+func isUberPayment(transaction MondoTransaction) bool {
+	if transaction.Amount >= 0 || transaction.DeclineReason != "" {
+		return false
+	}
+	if transaction.Merchant != nil && strings.Contains(strings.ToUpper(transaction.Merchant.Name), "UBER") {
+		return true
+	}
+	return strings.Contains(strings.ToUpper(transaction.Description), "UBER")
+}
+
+// backfillTransaction attaches a receipt to a past transaction unless it has
+// one already, returning the ledger status it ends up with.
+func backfillTransaction(ctx context.Context, session *session, transaction MondoTransaction) (string, error) {
+	if transaction.Metadata["uber_trip_id"] != "" {
+		return ledgerPublished, nil
+	}
+
+	key := transactionKey(transaction.Id)
+	claimed, err := ledger.Claim(key)
+	if err != nil {
+		return "", err
+	}
+	if !claimed {
+		// Done already, or the webhook is on it
+		return ledgerQueued, nil
+	}
+
+	entry, err := attachTransaction(ctx, session, transaction.WebhookData())
+	if err != nil {
+		if releaseErr := ledger.Release(key); releaseErr != nil {
+			log.Printf("Transaction %s release error: %s\n", transaction.Id, releaseErr.Error())
+		}
+		return "", err
+	}
+	return entry.Status, ledger.Complete(key, entry)
+}
+
+// attachTransaction matches a past transaction to a trip and attaches the
+// receipt, or records it for review if there's no confident match.
+func attachTransaction(ctx context.Context, session *session, transaction WebhookData) (*ledgerEntry, error) {
+	match, err := matchTransaction(ctx, uberApiClient, session.uberToken(), transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if !match.Confident {
+		log.Printf("Transaction %s needs review: %s\n", transaction.Id, match.Reason)
+		err = reviews.Add(newReviewItem(session.sessionId, transaction, match))
+		if err != nil {
+			return nil, err
+		}
+		return &ledgerEntry{
+			Status:        ledgerReview,
+			TransactionId: transaction.Id,
+			SessionId:     session.sessionId,
+		}, nil
+	}
+
+	trip, receipt := match.Best().Trip, match.Best().Receipt
+	imageUrl, err := tripImageUrl(ctx, session, trip)
+	if err != nil {
+		return nil, err
+	}
+	attachmentId, err := attachReceipt(ctx, session, transaction.Id, trip, receipt, imageUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerEntry{
+		Status:        ledgerAttached,
+		TransactionId: transaction.Id,
+		RequestId:     trip.RequestId,
+		SessionId:     session.sessionId,
+		AttachmentId:  attachmentId,
+	}, nil
+}
+
+// backfillCommand runs a backfill from the command line, e.g.
+//
+//	hackathon-uber-mondo [flags] backfill -session <id> -since 2016-01-01
+//
+// With -db, the server must be stopped first as it holds the database open.
+func backfillCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	sessionId := flags.String("session", "", "session ID to backfill (required)")
+	since := flags.String("since", "", "first day to backfill, e.g. 2016-01-01 (required)")
+	until := flags.String("until", time.Now().UTC().Format(dateLayout), "last day to backfill")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *sessionId == "" || *since == "" {
+		flags.PrintDefaults()
+		return errors.New("-session and -since are required")
+	}
+
+	sinceTime, untilTime, err := parseBackfillRange(*since, *until)
+	if err != nil {
+		return err
+	}
+	session, err := sessions.Get(*sessionId)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	progress := &backfillProgress{
+		SessionId: *sessionId,
+		Since:     sinceTime,
+		Until:     untilTime,
+		Status:    backfillRunning,
+		Started:   now,
+	}
+	return runBackfill(ctx, session, progress, func(progress *backfillProgress) error {
+		fmt.Printf("%d/%d transactions: %d attached, %d skipped, %d for review\n",
+			progress.Processed, progress.Transactions, progress.Attached, progress.Skipped, progress.Review)
+		return backfills.Put(progress)
+	})
+}
+
+const dateLayout = "2006-01-02"
+
+// parseBackfillRange parses the first and last days of a backfill, returning
+// the range from the start of the first to the end of the last, in UTC.
+func parseBackfillRange(since, until string) (time.Time, time.Time, error) {
+	sinceTime, err := time.Parse(dateLayout, since)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	untilTime, err := time.Parse(dateLayout, until)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	untilTime = untilTime.AddDate(0, 0, 1)
+	if !sinceTime.Before(untilTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s is after %s", since, until)
+	}
+	return sinceTime, untilTime, nil
+}
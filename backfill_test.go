@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTransactionsServer serves transactions (oldest first) from /transactions,
+// paging by transaction ID as Mondo does.
+func newTransactionsServer(t *testing.T, transactions []MondoTransaction) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/transactions" || r.FormValue("expand[]") != "merchant" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		start := 0
+		for i, transaction := range transactions {
+			if transaction.Id == r.FormValue("since") {
+				start = i + 1
+			}
+		}
+		response := MondoTransactionsResponse{}
+		for i := start; i < start+limit && i < len(transactions); i++ {
+			response.Transactions = append(response.Transactions, transactions[i])
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func TestRunBackfill(t *testing.T) {
+	created := matchTestNow.Format(time.RFC3339)
+	var transactions []MondoTransaction
+	for i := 0; i < transactionPageSize; i++ {
+		transactions = append(transactions, MondoTransaction{Id: fmt.Sprintf("tx_coffee%d", i), Amount: -250, Description: "COFFEE", Created: created})
+	}
+	transactions = append(transactions,
+		MondoTransaction{Id: "tx_attached", Amount: -1234, Description: "UBER BV", Created: created, Metadata: map[string]string{"uber_trip_id": "trip_1"}},
+		MondoTransaction{Id: "tx_webhook", Amount: -1234, Description: "UBER BV", Created: created},
+		MondoTransaction{Id: "tx_unmatched", Amount: -999, Currency: "GBP", Description: "PAYMENT", Created: created, Merchant: &MondoMerchant{Name: "Uber"}},
+		MondoTransaction{Id: "tx_refund", Amount: 1234, Description: "UBER BV", Created: created},
+		MondoTransaction{Id: "tx_declined", Amount: -1234, Description: "UBER BV", Created: created, DeclineReason: "INSUFFICIENT_FUNDS"},
+	)
+	mondoServer := newTransactionsServer(t, transactions)
+	defer mondoServer.Close()
+	uberServer := newHistoryServer([]testTrip{{"other", "completed", matchTestNow.Add(-10 * time.Minute), "£3.00"}})
+	defer uberServer.Close()
+
+	oldMondo, oldUber, oldLedger, oldReviews := mondoApiClient, uberApiClient, ledger, reviews
+	defer func() { mondoApiClient, uberApiClient, ledger, reviews = oldMondo, oldUber, oldLedger, oldReviews }()
+	mondoApiClient = &MondoApiClient{url: mondoServer.URL}
+	uberApiClient = &UberApiClient{url: uberServer.URL}
+	ledger = newMemoryLedger()
+	reviews = newMemoryReviewStore()
+
+	// The webhook got to this one first
+	if _, err := ledger.Claim(transactionKey("tx_webhook")); err != nil {
+		t.Fatal(err)
+	}
+
+	session := &session{sessionId: "abc", mondoAccountId: "acc_1"}
+	progress := &backfillProgress{SessionId: "abc", Since: matchTestNow.Add(-time.Hour), Until: matchTestNow.Add(time.Hour), Status: backfillRunning}
+	reports := 0
+	err := runBackfill(context.Background(), session, progress, func(*backfillProgress) error {
+		reports++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if progress.Status != backfillFinished || progress.Transactions != 3 || progress.Processed != 3 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	if progress.Skipped != 2 || progress.Review != 1 || progress.Attached != 0 {
+		t.Errorf("unexpected outcomes %+v", progress)
+	}
+	if reports != 5 {
+		t.Errorf("expected a report per transaction plus start and end, got %d", reports)
+	}
+	if entry, err := ledger.Get(transactionKey("tx_unmatched")); err != nil || entry.Status != ledgerReview {
+		t.Errorf("expected tx_unmatched to be recorded for review, got %+v %v", entry, err)
+	}
+}
+
+func TestParseBackfillRange(t *testing.T) {
+	since, until, err := parseBackfillRange("2016-01-01", "2016-01-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !since.Equal(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)) || !until.Equal(time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected range %s to %s", since, until)
+	}
+	if _, _, err := parseBackfillRange("2016-02-01", "2016-01-31"); err == nil {
+		t.Errorf("expected error for backwards range")
+	}
+}
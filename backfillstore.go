@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var ErrNoSuchBackfill = errors.New("no such backfill")
+
+var backfillsBucket = []byte("backfills")
+
+const (
+	backfillRunning  = "running"
+	backfillFinished = "finished"
+	backfillFailed   = "failed"
+)
+
+// backfillProgress is how far a session's latest backfill has got.
+type backfillProgress struct {
+	SessionId string    `json:"session_id"`
+	JobId     string    `json:"job_id,omitempty"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+	Status    string    `json:"status"`
+	// Transactions is how many Uber transactions are in the range, and
+	// Processed how many of those have been looked at so far
+	Transactions int `json:"transactions"`
+	Processed    int `json:"processed"`
+	// Attached were matched and given a receipt, Skipped already had one or
+	// are being handled by the webhook, and Review need the user to pick
+	// the trip
+	Attached  int       `json:"attached"`
+	Skipped   int       `json:"skipped"`
+	Review    int       `json:"review"`
+	LastError string    `json:"last_error,omitempty"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+}
+
+// BackfillStore keeps the progress of each session's latest backfill.
+type BackfillStore interface {
+	Get(sessionId string) (*backfillProgress, error)
+	Put(progress *backfillProgress) error
+	Delete(sessionId string) error
+}
+
+type memoryBackfillStore struct {
+	mutex     sync.Mutex
+	backfills map[string]*backfillProgress
+}
+
+func newMemoryBackfillStore() *memoryBackfillStore {
+	return &memoryBackfillStore{backfills: make(map[string]*backfillProgress)}
+}
+
+func (m *memoryBackfillStore) Get(sessionId string) (*backfillProgress, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	progress, exists := m.backfills[sessionId]
+	if !exists {
+		return nil, ErrNoSuchBackfill
+	}
+	copy := *progress
+	return &copy, nil
+}
+
+func (m *memoryBackfillStore) Put(progress *backfillProgress) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	copy := *progress
+	m.backfills[progress.SessionId] = &copy
+	return nil
+}
+
+func (m *memoryBackfillStore) Delete(sessionId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.backfills, sessionId)
+	return nil
+}
+
+type boltBackfillStore struct {
+	db *bolt.DB
+}
+
+func newBoltBackfillStore(db *bolt.DB) (*boltBackfillStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(backfillsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltBackfillStore{db: db}, nil
+}
+
+func (b *boltBackfillStore) Get(sessionId string) (*backfillProgress, error) {
+	progress := &backfillProgress{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(backfillsBucket).Get([]byte(sessionId))
+		if data == nil {
+			return ErrNoSuchBackfill
+		}
+		return json.Unmarshal(data, progress)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+func (b *boltBackfillStore) Put(progress *backfillProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(backfillsBucket).Put([]byte(progress.SessionId), data)
+	})
+}
+
+func (b *boltBackfillStore) Delete(sessionId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(backfillsBucket).Delete([]byte(sessionId))
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Every flag can also be set by an UBER_MONDO_* environment variable or in a
+// YAML config file, which keeps secrets out of process listings. A value on
+// the command line wins over the environment, which wins over the file, which
+// wins over the default. The file uses the flag names as keys, e.g.
+//
+//	uberClientId: abc
+//	uberClientSecret: def
+//	apiTimeout: 30s
+//
+// and the environment variables are the names in upper snake case, e.g.
+// UBER_MONDO_UBER_CLIENT_SECRET.
+
+const envPrefix = "UBER_MONDO_"
+
+var configFile = flag.String("config", "", "YAML file of settings, keyed by flag name (also UBER_MONDO_CONFIG)")
+
+// envName returns the environment variable for a flag, e.g.
+// UBER_MONDO_UBER_CLIENT_ID for uberClientId.
+func envName(flagName string) string {
+	var name strings.Builder
+	name.WriteString(envPrefix)
+	for i, r := range flagName {
+		if unicode.IsUpper(r) && i > 0 {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// loadConfig fills in the flags not given on the command line from the
+// environment and then the config file.
+func loadConfig(flags *flag.FlagSet, getenv func(string) string) error {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	file := flags.Lookup("config").Value.String()
+	if !set["config"] && getenv(envName("config")) != "" {
+		file = getenv(envName("config"))
+	}
+	fileValues := map[string]interface{}{}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(data, &fileValues); err != nil {
+			return fmt.Errorf("%s: %s", file, err.Error())
+		}
+	}
+
+	var problems []string
+	for name := range fileValues {
+		if flags.Lookup(name) == nil || name == "config" {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting %q", file, name))
+		}
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || f.Name == "config" {
+			return
+		}
+		source, value := envName(f.Name), getenv(envName(f.Name))
+		if value == "" {
+			fileValue, ok := fileValues[f.Name]
+			if !ok {
+				return
+			}
+			source, value = fmt.Sprintf("%s: %s", file, f.Name), fmt.Sprint(fileValue)
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", source, err.Error()))
+		}
+	})
+	return configError("invalid configuration", problems)
+}
+
+// configError lists every problem found in one error, or returns nil if
+// there are none.
+func configError(summary string, problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New(summary + ":\n  " + strings.Join(problems, "\n  "))
+}
+
+// settingName describes the ways to set a flag, for error messages.
+func settingName(flagName string) string {
+	return fmt.Sprintf("-%s (or %s)", flagName, envName(flagName))
+}
+
+// validateConfig checks every required setting is present and makes sense,
+// reporting all the problems at once.
+func validateConfig() error {
+	var problems []string
+	required := map[string]string{
+		"httpsUrl": *httpsUrl,
+	}
+	// The fake APIs make up client credentials
+	if !*fakeApis {
+		required["uberClientId"] = *uberClientId
+		required["uberClientSecret"] = *uberClientSecret
+		required["mondoClientId"] = *mondoClientId
+		required["mondoClientSecret"] = *mondoClientSecret
+	}
+	for name, value := range required {
+		if value == "" {
+			problems = append(problems, settingName(name)+" is required")
+		}
+	}
+
+	if *googleMapsApiKey == "" && *mapTilesDir == "" && *mapMbtilesFile == "" && !*fakeApis {
+		problems = append(problems, fmt.Sprintf("one of %s, %s or %s is required to draw maps",
+			settingName("gMapsApiKey"), settingName("mapTiles"), settingName("mapMbtiles")))
+	}
+	if *dbFile != "" && *tokenKey == "" && *tokenKeyFile == "" {
+		problems = append(problems, fmt.Sprintf("%s or %s is required to persist sessions",
+			settingName("tokenKey"), settingName("tokenKeyFile")))
+	}
+	switch *tlsMode {
+	case tlsOff, tlsStatic:
+	case tlsAcme:
+		if len(acmeHosts()) == 0 {
+			problems = append(problems, settingName("acmeDomains")+" or a -httpsUrl host is required with -tls acme")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s must be %s, %s or %s, not %q", settingName("tls"), tlsOff, tlsStatic, tlsAcme, *tlsMode))
+	}
+	return configError("invalid configuration", problems)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	for flagName, expected := range map[string]string{
+		"uberClientId":    "UBER_MONDO_UBER_CLIENT_ID",
+		"db":              "UBER_MONDO_DB",
+		"shutdownTimeout": "UBER_MONDO_SHUTDOWN_TIMEOUT",
+	} {
+		if actual := envName(flagName); actual != expected {
+			t.Errorf("envName(%s) = %s, expected %s", flagName, actual, expected)
+		}
+	}
+}
+
+func newTestFlagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.String("config", "", "")
+	flags.String("fromFlag", "default", "")
+	flags.String("fromEnv", "default", "")
+	flags.String("fromFile", "default", "")
+	flags.String("unset", "default", "")
+	flags.Duration("timeout", time.Second, "")
+	return flags
+}
+
+func writeTestConfig(t *testing.T, yaml string) string {
+	f, err := ioutil.TempFile("", "uber-mondo-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(yaml); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := writeTestConfig(t, "fromFlag: file\nfromEnv: file\nfromFile: file\ntimeout: 2m\n")
+	defer os.Remove(file)
+
+	flags := newTestFlagSet()
+	if err := flags.Parse([]string{"-fromFlag", "flag"}); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"UBER_MONDO_CONFIG":    file,
+		"UBER_MONDO_FROM_FLAG": "env",
+		"UBER_MONDO_FROM_ENV":  "env",
+	}
+	if err := loadConfig(flags, func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{
+		"fromFlag": "flag",
+		"fromEnv":  "env",
+		"fromFile": "file",
+		"unset":    "default",
+		"timeout":  "2m0s",
+	} {
+		if actual := flags.Lookup(name).Value.String(); actual != expected {
+			t.Errorf("%s = %s, expected %s", name, actual, expected)
+		}
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	file := writeTestConfig(t, "timeout: soon\nmystery: 1\n")
+	defer os.Remove(file)
+
+	flags := newTestFlagSet()
+	if err := flags.Parse([]string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+	err := loadConfig(flags, func(string) string { return "" })
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{`unknown setting "mystery"`, file + ": timeout"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %s", expected, err.Error())
+		}
+	}
+}
+
+func TestValidateConfigReportsEveryMissingValue(t *testing.T) {
+	oldStrings := map[*string]string{}
+	for _, value := range []*string{httpsUrl, httpUrl, uberClientId, uberClientSecret, mondoClientId, mondoClientSecret, googleMapsApiKey, mapTilesDir, mapMbtilesFile, dbFile, tokenKey, tokenKeyFile} {
+		oldStrings[value] = *value
+		*value = ""
+	}
+	oldFakeApis, oldTlsMode := *fakeApis, *tlsMode
+	defer func() {
+		for value, old := range oldStrings {
+			*value = old
+		}
+		*fakeApis, *tlsMode = oldFakeApis, oldTlsMode
+	}()
+
+	*httpsUrl, *httpUrl, *dbFile = "https://example.com", "http://example.com", "sessions.db"
+	*fakeApis = false
+	err := validateConfig()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{"-uberClientId", "-uberClientSecret", "-mondoClientId", "UBER_MONDO_MONDO_CLIENT_SECRET", "-gMapsApiKey", "-tokenKey"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %s", expected, err.Error())
+		}
+	}
+	if strings.Contains(err.Error(), "-httpsUrl") {
+		t.Errorf("didn't expect -httpsUrl in %s", err.Error())
+	}
+
+	// The fake APIs need no credentials or maps
+	*fakeApis, *dbFile = true, ""
+	if err := validateConfig(); err != nil {
+		t.Errorf("unexpected error %s", err.Error())
+	}
+
+	*tlsMode = "sometimes"
+	if err := validateConfig(); err == nil || !strings.Contains(err.Error(), `not "sometimes"`) {
+		t.Errorf("expected an unknown -tls error, got %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// e2eEnv is the app wired up to fake Uber and Mondo APIs, all in process.
+type e2eEnv struct {
+	server *httptest.Server
+	uber   *fakeUber
+	mondo  *fakeMondo
+	client *http.Client
+}
+
+// newE2EEnv points the globals at fresh memory stores and the fake APIs, and
+// returns a function that puts them back.
+func newE2EEnv(t *testing.T) (*e2eEnv, func()) {
+	oldRouter, oldSessions, oldReviews, oldLedger, oldJobStore, oldBackfills := router, sessions, reviews, ledger, jobStore, backfills
+	oldJobs, oldMapStore, oldMaps, oldTileMaps, oldImages := jobs, mapStore, maps, tileMaps, images
+	oldUber, oldMondo := uberApiClient, mondoApiClient
+	oldFlags := map[*string]string{}
+	for _, value := range []*string{httpsUrl, httpUrl, uberClientId, uberClientSecret, uberAuthHost, mondoClientId, mondoClientSecret, mondoAuthHost} {
+		oldFlags[value] = *value
+	}
+
+	cacheDir, err := ioutil.TempDir("", "uber-mondo-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := openDiskCache(cacheDir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router = mux.NewRouter()
+	sessions = newMemorySessionStore()
+	reviews = newMemoryReviewStore()
+	ledger = newMemoryLedger()
+	jobStore = newMemoryJobStore()
+	backfills = newMemoryBackfillStore()
+	mapStore = newMemoryMapStore()
+	// No tiles, so maps are blank but still rendered and proxied
+	tileMaps = &tileMapProvider{
+		tiles: tileSources{},
+		store: mapStore,
+		url: func(mapId string) (string, error) {
+			return callbackUrl(MapImage, "id", mapId)
+		},
+	}
+	maps = tileMaps
+	images = &imageProxy{
+		key:   []byte("secret"),
+		ttl:   time.Hour,
+		cache: cache,
+		endpoint: func() (string, error) {
+			return callbackUrl(ImageProxy)
+		},
+	}
+	registerRoutes()
+	server := httptest.NewServer(middleware(router))
+	*httpsUrl, *httpUrl = server.URL, server.URL
+
+	fixtures := defaultFakeFixtures()
+	*uberClientId, *uberClientSecret = "uber-client", "uber-secret"
+	*mondoClientId, *mondoClientSecret = "mondo-client", "mondo-secret"
+	uber := newFakeUber(*uberClientId, *uberClientSecret, fixtures)
+	uber.redirectUrl = func() (string, error) { return callbackUrl(SetAuthCode) }
+	uber.webhookUrl = func() (string, error) { return callbackUrl(UberWebhook) }
+	mondo := newFakeMondo(*mondoClientId, *mondoClientSecret, fixtures)
+	uberServer := httptest.NewServer(uber.Handler())
+	mondoServer := httptest.NewServer(mondo.Handler())
+	*uberAuthHost, *mondoAuthHost = uberServer.URL, mondoServer.URL
+	uberApiClient = &UberApiClient{url: uberServer.URL, authUrl: uberServer.URL, clientId: *uberClientId, clientSecret: *uberClientSecret}
+	mondoApiClient = &MondoApiClient{url: mondoServer.URL, clientId: *mondoClientId, clientSecret: *mondoClientSecret}
+
+	run := runJob
+	if webhookLog != nil {
+		run = webhookLog.recordJobs(run)
+	}
+	jobs = newJobQueue(jobStore, run, jobDeadLettered, 2, 5)
+	jobs.baseDelay, jobs.poll = 10*time.Millisecond, 10*time.Millisecond
+	jobs.Start()
+
+	env := &e2eEnv{server: server, uber: uber, mondo: mondo, client: &http.Client{Timeout: 10 * time.Second}}
+	return env, func() {
+		jobs.Stop()
+		server.Close()
+		uberServer.Close()
+		mondoServer.Close()
+		os.RemoveAll(cacheDir)
+		router, sessions, reviews, ledger, jobStore, backfills = oldRouter, oldSessions, oldReviews, oldLedger, oldJobStore, oldBackfills
+		jobs, mapStore, maps, tileMaps, images = oldJobs, oldMapStore, oldMaps, oldTileMaps, oldImages
+		uberApiClient, mondoApiClient = oldUber, oldMondo
+		for value, old := range oldFlags {
+			*value = old
+		}
+	}
+}
+
+func (e *e2eEnv) get(t *testing.T, pageUrl string) string {
+	response, err := e.client.Get(pageUrl)
+	return e.page(t, response, err)
+}
+
+func (e *e2eEnv) post(t *testing.T, path string, form url.Values) string {
+	response, err := e.client.PostForm(e.server.URL+path, form)
+	return e.page(t, response, err)
+}
+
+// page checks a response was OK and returns its body.
+func (e *e2eEnv) page(t *testing.T, response *http.Response, err error) string {
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("%s %s got %s: %s", response.Request.Method, response.Request.URL, response.Status, body)
+	}
+	return string(body)
+}
+
+var pleaseWaitRedirect = regexp.MustCompile(`window.location = "([^"]*)"`)
+var stateInput = regexp.MustCompile(`name="state" value="([^"]*)"`)
+var sessionIdInput = regexp.MustCompile(`name="session-id" value="([^"]*)"`)
+
+// pleaseWaitUrl returns the URL a please wait page redirects to.
+func pleaseWaitUrl(t *testing.T, pleaseWait string) string {
+	match := pleaseWaitRedirect.FindStringSubmatch(pleaseWait)
+	if match == nil {
+		t.Fatalf("no redirect in %s", pleaseWait)
+	}
+	// Undo the template's JavaScript string escaping
+	return strings.NewReplacer(`\/`, "/", `\u0026`, "&").Replace(match[1])
+}
+
+// follow fetches the page a please wait page redirects to.
+func (e *e2eEnv) follow(t *testing.T, pleaseWait string) string {
+	return e.get(t, pleaseWaitUrl(t, pleaseWait))
+}
+
+// login goes through the Mondo and Uber OAuth flows, as a user clicking
+// through would, and returns the new session's ID.
+func (e *e2eEnv) login(t *testing.T) string {
+	accountPicker := e.follow(t, e.post(t, "/login", nil))
+	state := stateInput.FindStringSubmatch(accountPicker)
+	if state == nil || !strings.Contains(accountPicker, "acc_fake") {
+		t.Fatalf("unexpected account picker %s", accountPicker)
+	}
+	pleaseWait := e.post(t, "/mondo/account", url.Values{
+		"state":            {state[1]},
+		"mondo-account-id": {"acc_fake"},
+	})
+	loginSuccess := e.follow(t, pleaseWait)
+	sessionId := sessionIdInput.FindStringSubmatch(loginSuccess)
+	if sessionId == nil || !strings.Contains(loginSuccess, "/logout") {
+		t.Fatalf("unexpected login success page %s", loginSuccess)
+	}
+	return sessionId[1]
+}
+
+// eventually waits for condition to hold, failing the test if it doesn't
+// within a few seconds.
+func eventually(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+
+	env.login(t)
+	webhooks := env.mondo.Webhooks()
+	if len(webhooks) != 1 || webhooks[0].AccountId != "acc_fake" || !strings.HasPrefix(webhooks[0].Url, env.server.URL) {
+		t.Fatalf("unexpected webhooks %+v", webhooks)
+	}
+
+	// The first feed item fails, and the job retries it
+	env.mondo.faults.Inject(fakeFault{Method: "POST", Path: "/feed", Status: http.StatusServiceUnavailable, Times: 1})
+	trip, err := env.uber.CompleteTrip(fakeTrip{
+		Receipt: UberReceiptResponse{TotalCharged: "£12.34", CurrencyCode: "GBP", Duration: "00:15:00", Distance: "3.2", DistanceLabel: "miles"},
+		Request: UberRequestResponse{
+			Pickup:      &UberRequestLocation{Latitude: 51.5033, Longitude: -0.1196},
+			Destination: &UberRequestLocation{Latitude: 51.5194, Longitude: -0.1270},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the feed item", func() bool { return len(env.mondo.FeedItems()) == 1 })
+	item := env.mondo.FeedItems()[0]
+	if item.AccountId != "acc_fake" || item.Type != "image" || !strings.Contains(item.Title, "Uber Receipt") || !strings.HasPrefix(item.ImageUrl, env.server.URL) {
+		t.Errorf("unexpected feed item %+v", item)
+	}
+	feedPosts := 0
+	for _, request := range env.mondo.faults.Requests() {
+		if request == "POST /feed" {
+			feedPosts++
+		}
+	}
+	if feedPosts != 2 {
+		t.Errorf("expected the feed item to be posted twice, got %d", feedPosts)
+	}
+
+	transaction, err := env.mondo.CreateTransaction(MondoTransaction{
+		Amount:      -1234,
+		Description: "UBER BV",
+		Merchant:    &MondoMerchant{Name: "Uber"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the receipt attachment", func() bool {
+		attached, _ := env.mondo.Transaction(transaction.Id)
+		return attached.Metadata["uber_trip_id"] != ""
+	})
+	attached, _ := env.mondo.Transaction(transaction.Id)
+	if attached.Metadata["uber_trip_id"] != trip.History.RequestId || attached.Metadata["uber_total_charged"] != "£12.34" {
+		t.Errorf("unexpected metadata %v", attached.Metadata)
+	}
+	if len(attached.Attachments) != 1 || attached.Attachments[0].FileType != "image/png" {
+		t.Errorf("unexpected attachments %+v", attached.Attachments)
+	}
+	// The transaction reuses the trip's feed item rather than posting another
+	if len(env.mondo.FeedItems()) != 1 {
+		t.Errorf("expected one feed item, got %+v", env.mondo.FeedItems())
+	}
+}
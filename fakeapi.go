@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The fake Uber and Mondo APIs stand in for the real ones in tests and, with
+// -fakeApis, during development. Each has an OAuth server, the endpoints the
+// API clients call, and control endpoints under /_fake/ to add fixtures and
+// inject faults, e.g.
+//
+//	curl -X POST http://127.0.0.1:<port>/_fake/faults -d '{"method": "POST", "path": "/feed", "status": 503, "times": 2}'
+
+const fakeControlPrefix = "/_fake/"
+
+// fakeFixtures is the starting state of the fake APIs, loaded with
+// -fakeFixtures.
+type fakeFixtures struct {
+	UberUserId   string             `json:"uber_user_id"`
+	Trips        []fakeTrip         `json:"trips"`
+	Accounts     []MondoAccount     `json:"accounts"`
+	Transactions []MondoTransaction `json:"transactions"`
+}
+
+func defaultFakeFixtures() *fakeFixtures {
+	return &fakeFixtures{
+		UberUserId: "fake-uber-user",
+		Accounts:   []MondoAccount{{Id: "acc_fake", Description: "Fake current account", Created: "2015-09-01T00:00:00Z"}},
+	}
+}
+
+// loadFakeFixtures reads fixtures from a JSON file, or returns the defaults
+// if file is empty.
+func loadFakeFixtures(file string) (*fakeFixtures, error) {
+	fixtures := defaultFakeFixtures()
+	if file == "" {
+		return fixtures, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, fixtures); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	return fixtures, nil
+}
+
+// startFakeApis serves fake Uber and Mondo APIs on local ports, and points
+// the API flags at them. Client IDs and secrets default to made up ones.
+func startFakeApis(fixturesFile string) (*fakeUber, *fakeMondo, error) {
+	fixtures, err := loadFakeFixtures(fixturesFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, value := range []*string{uberClientId, uberClientSecret, mondoClientId, mondoClientSecret} {
+		if *value == "" {
+			*value = "fake"
+		}
+	}
+
+	uber := newFakeUber(*uberClientId, *uberClientSecret, fixtures)
+	uber.redirectUrl = func() (string, error) { return callbackUrl(SetAuthCode) }
+	uber.webhookUrl = func() (string, error) { return callbackUrl(UberWebhook) }
+	mondo := newFakeMondo(*mondoClientId, *mondoClientSecret, fixtures)
+
+	uberUrl, err := serveLocally(uber.Handler())
+	if err != nil {
+		return nil, nil, err
+	}
+	mondoUrl, err := serveLocally(mondo.Handler())
+	if err != nil {
+		return nil, nil, err
+	}
+	*uberApiHost, *uberAuthHost = uberUrl, uberUrl
+	*mondoApiUrl, *mondoAuthHost = mondoUrl, mondoUrl
+	log.Printf("Fake Uber API on %s, POST a trip to %strips to complete it\n", uberUrl, fakeControlPrefix)
+	log.Printf("Fake Mondo API on %s, POST a transaction to %stransactions to create it\n", mondoUrl, fakeControlPrefix)
+	return uber, mondo, nil
+}
+
+// serveLocally serves handler on a free local port, returning its URL.
+func serveLocally(handler http.Handler) (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		log.Fatal(http.Serve(listener, handler))
+	}()
+	return "http://" + listener.Addr().String(), nil
+}
+
+func writeFakeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set(ContentType, ApplicationJson)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message})
+}
+
+func writeFakeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set(ContentType, ApplicationJson)
+	json.NewEncoder(w).Encode(value)
+}
+
+// fakeOAuth issues and checks a fake API's authorization codes and tokens.
+type fakeOAuth struct {
+	clientId     string
+	clientSecret string
+	// expiresIn is the lifetime given with access tokens, in seconds
+	expiresIn uint32
+
+	mutex         sync.Mutex
+	issued        int
+	codes         map[string]bool
+	accessTokens  map[string]bool
+	refreshTokens map[string]bool
+}
+
+func newFakeOAuth(clientId, clientSecret string) *fakeOAuth {
+	return &fakeOAuth{
+		clientId:      clientId,
+		clientSecret:  clientSecret,
+		expiresIn:     3600,
+		codes:         make(map[string]bool),
+		accessTokens:  make(map[string]bool),
+		refreshTokens: make(map[string]bool),
+	}
+}
+
+func (o *fakeOAuth) newToken(prefix string) string {
+	o.issued++
+	return fmt.Sprintf("%s-%d", prefix, o.issued)
+}
+
+// authorize plays the provider's login page, sending the user straight back
+// to redirectUri with a new code and the state they came with.
+func (o *fakeOAuth) authorize(w http.ResponseWriter, r *http.Request, redirectUri string) {
+	if r.FormValue("client_id") != o.clientId {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	o.mutex.Lock()
+	code := o.newToken("code")
+	o.codes[code] = true
+	o.mutex.Unlock()
+
+	redirect, err := url.Parse(redirectUri)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := redirect.Query()
+	query.Set("code", code)
+	query.Set("state", r.FormValue("state"))
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token exchanges an authorization code or refresh token for a new access
+// token. Codes and refresh tokens can only be used once.
+func (o *fakeOAuth) token(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("client_id") != o.clientId || r.FormValue("client_secret") != o.clientSecret {
+		writeFakeError(w, http.StatusUnauthorized, "invalid_client", "bad client credentials")
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var grants map[string]bool
+	var grant string
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		grants, grant = o.codes, r.FormValue("code")
+	case "refresh_token":
+		grants, grant = o.refreshTokens, r.FormValue("refresh_token")
+	default:
+		writeFakeError(w, http.StatusBadRequest, "unsupported_grant_type", r.FormValue("grant_type"))
+		return
+	}
+	if !grants[grant] {
+		w.Header().Set(ContentType, ApplicationJson)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "unknown or used grant"})
+		return
+	}
+	delete(grants, grant)
+
+	accessToken, refreshToken := o.newToken("access"), o.newToken("refresh")
+	o.accessTokens[accessToken] = true
+	o.refreshTokens[refreshToken] = true
+	writeFakeJson(w, map[string]interface{}{
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+		"expires_in":    o.expiresIn,
+		"token_type":    "Bearer",
+		"client_id":     o.clientId,
+	})
+}
+
+// authorized reports whether a request carries a live access token.
+func (o *fakeOAuth) authorized(r *http.Request) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.accessTokens[strings.TrimPrefix(r.Header.Get(Authorization), Bearer)]
+}
+
+// ExpireAccessTokens invalidates every access token, so clients have to
+// refresh them.
+func (o *fakeOAuth) ExpireAccessTokens() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.accessTokens = make(map[string]bool)
+}
+
+// Revoke invalidates every token, as if the user revoked our access.
+func (o *fakeOAuth) Revoke() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.accessTokens = make(map[string]bool)
+	o.refreshTokens = make(map[string]bool)
+}
+
+// fakeFault makes matching requests to a fake API fail. A Status of 0 drops
+// the connection instead of responding.
+type fakeFault struct {
+	// Method and Path (a prefix) select requests; an empty Method matches
+	// any
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	// RetryAfter is sent as the Retry-After header, in seconds, if set
+	RetryAfter int `json:"retry_after,omitempty"`
+	// Times is how many requests fail before the fault clears; 0 is forever
+	Times int `json:"times,omitempty"`
+}
+
+// fakeFaults holds a fake API's injected faults, and logs the requests it
+// gets.
+type fakeFaults struct {
+	mutex    sync.Mutex
+	faults   []*fakeFault
+	requests []string
+}
+
+// Inject adds a fault. Faults are tried in the order they were added.
+func (f *fakeFaults) Inject(fault fakeFault) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+func (f *fakeFaults) Clear() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.faults = nil
+}
+
+// Requests returns the requests received so far, as "METHOD /path".
+func (f *fakeFaults) Requests() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// match logs a request and returns the fault it should get, if any.
+func (f *fakeFaults) match(r *http.Request) *fakeFault {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	for i, fault := range f.faults {
+		if (fault.Method != "" && fault.Method != r.Method) || !strings.HasPrefix(r.URL.Path, fault.Path) {
+			continue
+		}
+		matched := *fault
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			}
+		}
+		return &matched
+	}
+	return nil
+}
+
+// wrap fails requests to h as the injected faults say.
+func (f *fakeFaults) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fault := f.match(r)
+		if fault == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if fault.Status == 0 {
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if connection, _, err := hijacker.Hijack(); err == nil {
+					connection.Close()
+					return
+				}
+			}
+			fault.Status = http.StatusBadGateway
+		}
+		if fault.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(fault.RetryAfter))
+		}
+		writeFakeError(w, fault.Status, "fake.fault", fmt.Sprintf("injected fault for %s %s", r.Method, r.URL.Path))
+	})
+}
+
+// control handles POST (to inject) and DELETE (to clear) on
+// /_fake/faults.
+func (f *fakeFaults) control(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		f.Clear()
+		return
+	}
+	fault := fakeFault{}
+	if err := json.NewDecoder(r.Body).Decode(&fault); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Inject(fault)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeFeedItem is a feed item posted to the fake Mondo.
+type fakeFeedItem struct {
+	AccountId string `json:"account_id"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	ImageUrl  string `json:"image_url"`
+	Body      string `json:"body"`
+}
+
+// fakeMondo is an in-process Mondo API, see fakeapi.go. Attachments are
+// uploaded to it too, standing in for S3.
+type fakeMondo struct {
+	oauth  *fakeOAuth
+	faults *fakeFaults
+
+	mutex        sync.Mutex
+	issued       int
+	accounts     []MondoAccount
+	transactions []MondoTransaction // oldest first
+	webhooks     []Webhook
+	feedItems    []fakeFeedItem
+	files        map[string][]byte
+}
+
+func newFakeMondo(clientId, clientSecret string, fixtures *fakeFixtures) *fakeMondo {
+	return &fakeMondo{
+		oauth:        newFakeOAuth(clientId, clientSecret),
+		faults:       &fakeFaults{},
+		accounts:     append([]MondoAccount(nil), fixtures.Accounts...),
+		transactions: append([]MondoTransaction(nil), fixtures.Transactions...),
+		files:        make(map[string][]byte),
+	}
+}
+
+func (m *fakeMondo) Handler() http.Handler {
+	api := mux.NewRouter()
+	api.HandleFunc("/", m.authorizeGet).Methods("GET")
+	api.HandleFunc("/oauth2/token", m.oauth.token).Methods("POST")
+	api.HandleFunc("/accounts", m.authorized(m.accountsGet)).Methods("GET")
+	api.HandleFunc("/transactions", m.authorized(m.transactionsGet)).Methods("GET")
+	api.HandleFunc("/transactions/{id}", m.authorized(m.transactionPatch)).Methods("PATCH")
+	api.HandleFunc("/webhooks", m.authorized(m.webhooksPost)).Methods("POST")
+	api.HandleFunc("/webhooks/{id}", m.authorized(m.webhookDelete)).Methods("DELETE")
+	api.HandleFunc("/feed", m.authorized(m.feedPost)).Methods("POST")
+	api.HandleFunc("/attachment/upload", m.authorized(m.uploadPost)).Methods("POST")
+	api.HandleFunc("/attachment/register", m.authorized(m.registerPost)).Methods("POST")
+	api.HandleFunc("/attachment/deregister", m.authorized(m.deregisterPost)).Methods("POST")
+	api.HandleFunc("/files/{id}", m.filePut).Methods("PUT")
+	api.HandleFunc("/files/{id}", m.fileGet).Methods("GET")
+
+	router := mux.NewRouter()
+	router.HandleFunc(fakeControlPrefix+"faults", m.faults.control).Methods("POST", "DELETE")
+	router.HandleFunc(fakeControlPrefix+"transactions", m.transactionsPost).Methods("POST")
+	router.PathPrefix("/").Handler(m.faults.wrap(api))
+	return router
+}
+
+func (m *fakeMondo) newId(prefix string) string {
+	m.issued++
+	return fmt.Sprintf("%s_fake%d", prefix, m.issued)
+}
+
+// CreateTransaction adds a transaction and delivers the transaction.created
+// webhook to the account's webhooks. Missing IDs and times are made up.
+func (m *fakeMondo) CreateTransaction(transaction MondoTransaction) (MondoTransaction, error) {
+	m.mutex.Lock()
+	if transaction.Id == "" {
+		transaction.Id = m.newId("tx")
+	}
+	if transaction.AccountId == "" && len(m.accounts) > 0 {
+		transaction.AccountId = m.accounts[0].Id
+	}
+	if transaction.Created == "" {
+		transaction.Created = time.Now().UTC().Format(time.RFC3339)
+	}
+	if transaction.Currency == "" {
+		transaction.Currency = "GBP"
+	}
+	m.transactions = append(m.transactions, transaction)
+	var webhookUrls []string
+	for _, webhook := range m.webhooks {
+		if webhook.AccountId == transaction.AccountId {
+			webhookUrls = append(webhookUrls, webhook.Url)
+		}
+	}
+	m.mutex.Unlock()
+
+	body, err := json.Marshal(WebhookRequest{Type: "transaction.created", Data: transaction.WebhookData()})
+	if err != nil {
+		return transaction, err
+	}
+	for _, webhookUrl := range webhookUrls {
+		response, err := http.Post(webhookUrl, ApplicationJson, bytes.NewReader(body))
+		if err != nil {
+			return transaction, err
+		}
+		response.Body.Close()
+		if response.StatusCode != 200 {
+			return transaction, fmt.Errorf("transaction.created webhook got %s", response.Status)
+		}
+	}
+	return transaction, nil
+}
+
+// Transaction returns a transaction as it is now, e.g. with attachments.
+func (m *fakeMondo) Transaction(transactionId string) (MondoTransaction, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, transaction := range m.transactions {
+		if transaction.Id == transactionId {
+			return transaction, true
+		}
+	}
+	return MondoTransaction{}, false
+}
+
+func (m *fakeMondo) FeedItems() []fakeFeedItem {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]fakeFeedItem(nil), m.feedItems...)
+}
+
+func (m *fakeMondo) Webhooks() []Webhook {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]Webhook(nil), m.webhooks...)
+}
+
+func (m *fakeMondo) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !m.oauth.authorized(r) {
+			writeFakeError(w, http.StatusUnauthorized, "unauthorized.bad_access_token", "invalid access token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (m *fakeMondo) authorizeGet(w http.ResponseWriter, r *http.Request) {
+	m.oauth.authorize(w, r, r.FormValue("redirect_uri"))
+}
+
+func (m *fakeMondo) accountsGet(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	writeFakeJson(w, MondoAccountsResponse{Accounts: m.accounts})
+}
+
+// transactionsGet lists an account's transactions, oldest first. since is a
+// time or the ID of the last transaction seen.
+func (m *fakeMondo) transactionsGet(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit > transactionPageSize {
+		limit = transactionPageSize
+	}
+	since, before := r.FormValue("since"), r.FormValue("before")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seenSince := !strings.HasPrefix(since, "tx_")
+	response := MondoTransactionsResponse{Transactions: []MondoTransaction{}}
+	for _, transaction := range m.transactions {
+		if !seenSince {
+			seenSince = transaction.Id == since
+			continue
+		}
+		// RFC 3339 times in UTC compare as strings
+		if transaction.AccountId != r.FormValue("account_id") || (since != "" && !strings.HasPrefix(since, "tx_") && transaction.Created < since) {
+			continue
+		}
+		if before != "" && transaction.Created >= before {
+			continue
+		}
+		if len(response.Transactions) == limit {
+			break
+		}
+		response.Transactions = append(response.Transactions, transaction)
+	}
+	writeFakeJson(w, response)
+}
+
+// transactionPatch sets metadata[key] values on a transaction.
+func (m *fakeMondo) transactionPatch(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	transaction := m.transaction(mux.Vars(r)["id"])
+	if transaction == nil {
+		writeFakeError(w, http.StatusNotFound, "not_found", "transaction not found")
+		return
+	}
+	if transaction.Metadata == nil {
+		transaction.Metadata = make(map[string]string)
+	}
+	for key, values := range r.PostForm {
+		if strings.HasPrefix(key, "metadata[") && strings.HasSuffix(key, "]") {
+			transaction.Metadata[strings.TrimSuffix(strings.TrimPrefix(key, "metadata["), "]")] = values[0]
+		}
+	}
+	writeFakeJson(w, map[string]interface{}{"transaction": transaction})
+}
+
+// transaction finds a transaction to change. The mutex must be held.
+func (m *fakeMondo) transaction(transactionId string) *MondoTransaction {
+	for i := range m.transactions {
+		if m.transactions[i].Id == transactionId {
+			return &m.transactions[i]
+		}
+	}
+	return nil
+}
+
+func (m *fakeMondo) webhooksPost(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	webhook := Webhook{Id: m.newId("webhook"), AccountId: r.FormValue("account_id"), Url: r.FormValue("url")}
+	m.webhooks = append(m.webhooks, webhook)
+	writeFakeJson(w, RegisterWebhookResponse{Webhook: webhook})
+}
+
+func (m *fakeMondo) webhookDelete(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, webhook := range m.webhooks {
+		if webhook.Id == mux.Vars(r)["id"] {
+			m.webhooks = append(m.webhooks[:i], m.webhooks[i+1:]...)
+			writeFakeJson(w, map[string]string{})
+			return
+		}
+	}
+	writeFakeError(w, http.StatusNotFound, "not_found", "webhook not found")
+}
+
+func (m *fakeMondo) feedPost(w http.ResponseWriter, r *http.Request) {
+	item := fakeFeedItem{
+		AccountId: r.FormValue("account_id"),
+		Type:      r.FormValue("type"),
+		Title:     r.FormValue("title"),
+		ImageUrl:  r.FormValue("image_url"),
+		Body:      r.FormValue("body"),
+	}
+	if item.Title == "" {
+		writeFakeError(w, http.StatusBadRequest, "bad_request.missing_param", "title is required")
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.feedItems = append(m.feedItems, item)
+	writeFakeJson(w, map[string]string{})
+}
+
+// uploadPost hands out a URL on the fake to PUT the file to.
+func (m *fakeMondo) uploadPost(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	fileId := m.newId("file")
+	m.mutex.Unlock()
+	fileUrl := fmt.Sprintf("http://%s/files/%s", r.Host, fileId)
+	writeFakeJson(w, AttachmentUploadResponse{FileUrl: fileUrl, UploadUrl: fileUrl})
+}
+
+func (m *fakeMondo) filePut(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.files[mux.Vars(r)["id"]] = data
+}
+
+func (m *fakeMondo) fileGet(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	data, exists := m.files[mux.Vars(r)["id"]]
+	m.mutex.Unlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+func (m *fakeMondo) registerPost(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	transaction := m.transaction(r.FormValue("external_id"))
+	if transaction == nil {
+		writeFakeError(w, http.StatusNotFound, "not_found", "transaction not found")
+		return
+	}
+	attachment := Attachment{
+		Id:         m.newId("attach"),
+		UserId:     "user_fake",
+		ExternalId: transaction.Id,
+		FileUrl:    r.FormValue("file_url"),
+		FileType:   r.FormValue("file_type"),
+		Created:    time.Now().UTC().Format(time.RFC3339),
+	}
+	transaction.Attachments = append(transaction.Attachments, attachment)
+	writeFakeJson(w, RegisterAttachmentResponse{Attachment: attachment})
+}
+
+func (m *fakeMondo) deregisterPost(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.transactions {
+		attachments := m.transactions[i].Attachments
+		for j, attachment := range attachments {
+			if attachment.Id == r.FormValue("id") {
+				m.transactions[i].Attachments = append(attachments[:j], attachments[j+1:]...)
+				writeFakeJson(w, map[string]string{})
+				return
+			}
+		}
+	}
+	writeFakeError(w, http.StatusNotFound, "not_found", "attachment not found")
+}
+
+// transactionsPost creates the posted MondoTransaction, and responds with it
+// as created.
+func (m *fakeMondo) transactionsPost(w http.ResponseWriter, r *http.Request) {
+	transaction := MondoTransaction{}
+	if err := json.NewDecoder(r.Body).Decode(&transaction); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	transaction, err := m.CreateTransaction(transaction)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeFakeJson(w, transaction)
+}
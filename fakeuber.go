@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fakeTrip is a trip in the fake Uber's history, with what the API says
+// about it.
+type fakeTrip struct {
+	History UberHistoryItem     `json:"history"`
+	Receipt UberReceiptResponse `json:"receipt"`
+	Request UberRequestResponse `json:"request"`
+}
+
+// fakeUber is an in-process Uber API, see fakeapi.go.
+type fakeUber struct {
+	oauth  *fakeOAuth
+	faults *fakeFaults
+	// redirectUrl is where the authorize page sends users back to, as
+	// registered with Uber, and webhookUrl where webhooks are sent
+	redirectUrl func() (string, error)
+	webhookUrl  func() (string, error)
+
+	mutex  sync.Mutex
+	userId string
+	trips  []fakeTrip // newest first
+}
+
+func newFakeUber(clientId, clientSecret string, fixtures *fakeFixtures) *fakeUber {
+	u := &fakeUber{
+		oauth:  newFakeOAuth(clientId, clientSecret),
+		faults: &fakeFaults{},
+		userId: fixtures.UberUserId,
+	}
+	for _, trip := range fixtures.Trips {
+		u.AddTrip(trip)
+	}
+	return u
+}
+
+func (u *fakeUber) Handler() http.Handler {
+	api := mux.NewRouter()
+	api.HandleFunc("/oauth/authorize", u.authorizeGet).Methods("GET")
+	api.HandleFunc("/oauth/token", u.oauth.token).Methods("POST")
+	api.HandleFunc("/v1/me", u.authorized(u.meGet)).Methods("GET")
+	api.HandleFunc("/v1.2/history", u.authorized(u.historyGet)).Methods("GET")
+	api.HandleFunc("/v1/requests/{id}/receipt", u.authorized(u.receiptGet)).Methods("GET")
+	api.HandleFunc("/v1.2/requests/{id}", u.authorized(u.requestGet)).Methods("GET")
+
+	router := mux.NewRouter()
+	router.HandleFunc(fakeControlPrefix+"faults", u.faults.control).Methods("POST", "DELETE")
+	router.HandleFunc(fakeControlPrefix+"trips", u.tripsPost).Methods("POST")
+	router.PathPrefix("/").Handler(u.faults.wrap(api))
+	return router
+}
+
+// AddTrip adds a trip to the user's history. If it has no request ID or
+// times, they're made up.
+func (u *fakeUber) AddTrip(trip fakeTrip) fakeTrip {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if trip.History.RequestId == "" {
+		trip.History.RequestId = fmt.Sprintf("fake-request-%d", len(u.trips)+1)
+	}
+	if trip.History.EndTime == 0 {
+		trip.History.EndTime = time.Now().Unix()
+	}
+	if trip.History.StartTime == 0 {
+		trip.History.StartTime = trip.History.EndTime - 15*60
+	}
+	if trip.History.RequestTime == 0 {
+		trip.History.RequestTime = trip.History.StartTime - 5*60
+	}
+	if trip.History.Status == "" {
+		trip.History.Status = "completed"
+	}
+	trip.Receipt.RequestId = trip.History.RequestId
+	trip.Request.RequestId = trip.History.RequestId
+	if trip.Request.Status == "" {
+		trip.Request.Status = "completed"
+	}
+	u.trips = append([]fakeTrip{trip}, u.trips...)
+	return trip
+}
+
+// CompleteTrip adds a trip and sends the receipt_ready webhook for it, as
+// Uber does a few minutes after a trip ends.
+func (u *fakeUber) CompleteTrip(trip fakeTrip) (fakeTrip, error) {
+	trip = u.AddTrip(trip)
+	webhookUrl, err := u.webhookUrl()
+	if err != nil {
+		return trip, err
+	}
+
+	body, err := json.Marshal(UberWebhookEvent{
+		EventId:   "event-" + trip.History.RequestId,
+		EventTime: time.Now().Unix(),
+		EventType: ReceiptReadyEvent,
+		Meta: UberWebhookMeta{
+			UserId:     u.userId,
+			ResourceId: trip.History.RequestId,
+			Status:     "ready",
+		},
+		ResourceHref: fmt.Sprintf("/v1/requests/%s/receipt", trip.History.RequestId),
+	})
+	if err != nil {
+		return trip, err
+	}
+	mac := hmac.New(sha256.New, []byte(u.oauth.clientSecret))
+	mac.Write(body)
+
+	request, err := http.NewRequest("POST", webhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return trip, err
+	}
+	request.Header.Set(ContentType, ApplicationJson)
+	request.Header.Set(UberSignature, hex.EncodeToString(mac.Sum(nil)))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return trip, err
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		return trip, fmt.Errorf("receipt_ready webhook got %s", response.Status)
+	}
+	return trip, nil
+}
+
+func (u *fakeUber) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !u.oauth.authorized(r) {
+			writeFakeError(w, http.StatusUnauthorized, "unauthorized", "Invalid OAuth 2.0 credentials provided.")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (u *fakeUber) authorizeGet(w http.ResponseWriter, r *http.Request) {
+	redirectUri, err := u.redirectUrl()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.oauth.authorize(w, r, redirectUri)
+}
+
+func (u *fakeUber) meGet(w http.ResponseWriter, r *http.Request) {
+	writeFakeJson(w, UberMeResponse{Uuid: u.userId, FirstName: "Fake", LastName: "Rider", Email: "rider@example.com"})
+}
+
+func (u *fakeUber) historyGet(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit > historyPageSize {
+		limit = historyPageSize
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	response := UberHistoryResponse{Offset: int64(offset), Limit: int64(limit), Count: int64(len(u.trips)), History: []UberHistoryItem{}}
+	for i := offset; i >= 0 && i < offset+limit && i < len(u.trips); i++ {
+		response.History = append(response.History, u.trips[i].History)
+	}
+	writeFakeJson(w, response)
+}
+
+func (u *fakeUber) trip(w http.ResponseWriter, r *http.Request) (fakeTrip, bool) {
+	requestId := mux.Vars(r)["id"]
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for _, trip := range u.trips {
+		if trip.History.RequestId == requestId {
+			return trip, true
+		}
+	}
+	writeFakeError(w, http.StatusNotFound, "not_found", "Request not found.")
+	return fakeTrip{}, false
+}
+
+func (u *fakeUber) receiptGet(w http.ResponseWriter, r *http.Request) {
+	if trip, ok := u.trip(w, r); ok {
+		writeFakeJson(w, trip.Receipt)
+	}
+}
+
+func (u *fakeUber) requestGet(w http.ResponseWriter, r *http.Request) {
+	if trip, ok := u.trip(w, r); ok {
+		writeFakeJson(w, trip.Request)
+	}
+}
+
+// tripsPost completes the posted fakeTrip, and responds with it as added.
+func (u *fakeUber) tripsPost(w http.ResponseWriter, r *http.Request) {
+	trip := fakeTrip{}
+	if err := json.NewDecoder(r.Body).Decode(&trip); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	trip, err := u.CompleteTrip(trip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeFakeJson(w, trip)
+}
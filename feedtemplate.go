@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Users can change the title and body of their feed items with text/template
+// templates, executed against a feedTemplateData. Empty templates mean the
+// defaults.
+const (
+	defaultTitleTemplate = "Uber Receipt {{.Emoji}}"
+	defaultBodyTemplate  = "{{.Breakdown}}"
+	maxTemplateLength    = 4096
+	// Limits on running a template, so a user's template can't tie up the
+	// server or a job worker
+	maxTemplateNesting = 2
+	maxRenderedLength  = 8 << 10
+	renderTimeout      = time.Second
+)
+
+// feedTemplateData is what feed item templates are executed against.
+type feedTemplateData struct {
+	Trip    UberHistoryItem
+	Receipt *UberReceiptResponse
+	// Transaction is the Mondo transaction the trip matched, or nil if the
+	// receipt is published from Uber's webhook before the transaction arrives
+	Transaction *WebhookData
+	Emoji       string
+	// Breakdown is the default body: a summary line then the fare breakdown
+	Breakdown string
+}
+
+var feedTemplateFuncs = template.FuncMap{
+	// {{amount "2.20" .Receipt.CurrencyCode}} gives "£2.20"
+	"amount": formatAmount,
+	// {{duration .Receipt.Duration}} gives e.g. "12 min"
+	"duration": formatTripDuration,
+	// {{money .Transaction.Amount .Transaction.Currency}} formats Mondo's
+	// minor units, e.g. -1278 gives "-£12.78"
+	"money": func(minorUnits int32, currency string) string {
+		return formatAmount(fmt.Sprintf("%.2f", float64(minorUnits)/100), currency)
+	},
+	// {{(unixTime .Trip.StartTime).Format "15:04"}}, in UTC
+	"unixTime": func(seconds int64) time.Time {
+		return time.Unix(seconds, 0).UTC()
+	},
+}
+
+func newFeedTemplateData(trip UberHistoryItem, receipt *UberReceiptResponse, transaction *WebhookData) feedTemplateData {
+	return feedTemplateData{
+		Trip:        trip,
+		Receipt:     receipt,
+		Transaction: transaction,
+		Emoji:       randomCarEmoji(),
+		Breakdown:   receiptBody(trip, receipt),
+	}
+}
+
+// sampleFeedTemplateData is a made up trip for previewing and checking
+// templates.
+func sampleFeedTemplateData() feedTemplateData {
+	trip := UberHistoryItem{
+		Status:      "completed",
+		Distance:    1.49,
+		RequestTime: 1442838000,
+		StartTime:   1442838240,
+		StartCity:   UberHistoryCity{Latitude: 51.5074, Longitude: -0.1278, DisplayName: "London"},
+		EndTime:     1442838935,
+		RequestId:   "b5512127-a134-4bf4-b1ba-fe9f48f56d9d",
+		ProductId:   "a1111c8c-c720-46c3-8534-2fcdd730040d",
+	}
+	receipt := &UberReceiptResponse{
+		RequestId: trip.RequestId,
+		Charges: []UberReceiptCharge{
+			{Name: "Base Fare", Amount: "2.20", Type: "base_fare"},
+			{Name: "Distance", Amount: "2.75", Type: "distance"},
+			{Name: "Time", Amount: "3.57", Type: "time"},
+		},
+		SurgeCharge: &UberReceiptCharge{Name: "Surge x1.5", Amount: "4.26", Type: "surge"},
+		ChargeAdjustments: []UberReceiptCharge{
+			{Name: "Booking Fee", Amount: "1.00", Type: "booking_fee"},
+		},
+		NormalFare:    "£9.52",
+		Subtotal:      "£13.78",
+		TotalCharged:  "£13.78",
+		TotalFare:     "£13.78",
+		CurrencyCode:  "GBP",
+		Duration:      "00:11:35",
+		Distance:      "1.49",
+		DistanceLabel: "miles",
+	}
+	transaction := &WebhookData{
+		Amount:      -1378,
+		Created:     "2015-09-21T12:29:10Z",
+		Currency:    "GBP",
+		Description: "UBER   *TRIP 7CZQV HELP.UBER.COM",
+		Id:          "tx_00008zIcpb1TB4yeIFXMzx",
+	}
+	return newFeedTemplateData(trip, receipt, transaction)
+}
+
+// parseFeedTemplate parses a title or body template, or the default if text
+// is empty.
+func parseFeedTemplate(name, text, defaultText string) (*template.Template, error) {
+	if text == "" {
+		text = defaultText
+	}
+	if len(text) > maxTemplateLength {
+		return nil, fmt.Errorf("%s template is longer than %d characters", name, maxTemplateLength)
+	}
+	parsed, err := template.New(name).Funcs(feedTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed.Templates()) > 1 {
+		return nil, fmt.Errorf("%s template can't define templates", name)
+	}
+	if err := checkTemplateNodes(name, parsed.Tree.Root, reflect.TypeOf(feedTemplateData{}), 0); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// checkTemplateNodes rejects the constructs that could make a template run
+// for a long time: range or with nested deeper than maxTemplateNesting,
+// calling other templates, which can recurse, and ranging over anything but
+// a list or map in the data, such as a number, which would loop that many
+// times without needing to write. dot is the type . has at node, or nil
+// where it isn't known, e.g. inside a with on a function's result.
+func checkTemplateNodes(name string, node parse.Node, dot reflect.Type, depth int) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkTemplateNodes(name, child, dot, depth); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkTemplateBranch(name, &n.BranchNode, dot, dot, depth)
+	case *parse.WithNode:
+		return checkTemplateBranch(name, &n.BranchNode, pipeType(n.Pipe, dot), dot, depth+1)
+	case *parse.RangeNode:
+		ranged := pipeType(n.Pipe, dot)
+		if ranged == nil {
+			return fmt.Errorf("%s template can only range over a list in the data", name)
+		}
+		switch ranged.Kind() {
+		case reflect.Array, reflect.Slice, reflect.Map:
+			return checkTemplateBranch(name, &n.BranchNode, ranged.Elem(), dot, depth+1)
+		}
+		return fmt.Errorf("%s template can only range over a list in the data, not a %s", name, ranged.Kind())
+	case *parse.TemplateNode:
+		return fmt.Errorf("%s template can't call other templates", name)
+	}
+	return nil
+}
+
+func checkTemplateBranch(name string, branch *parse.BranchNode, dot, elseDot reflect.Type, depth int) error {
+	if depth > maxTemplateNesting {
+		return fmt.Errorf("%s template nests range and with more than %d deep", name, maxTemplateNesting)
+	}
+	if err := checkTemplateNodes(name, branch.List, dot, depth); err != nil {
+		return err
+	}
+	return checkTemplateNodes(name, branch.ElseList, elseDot, depth)
+}
+
+// pipeType is the type of a pipeline that's just a field chain on . or $,
+// e.g. .Receipt.Charges, or nil for anything else, such as a variable,
+// function or method.
+func pipeType(pipe *parse.PipeNode, dot reflect.Type) reflect.Type {
+	if len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return nil
+	}
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		return fieldChainType(dot, arg.Ident)
+	case *parse.VariableNode:
+		if arg.Ident[0] == "$" {
+			return fieldChainType(reflect.TypeOf(feedTemplateData{}), arg.Ident[1:])
+		}
+	}
+	return nil
+}
+
+func fieldChainType(t reflect.Type, fields []string) reflect.Type {
+	for _, field := range fields {
+		if t == nil {
+			return nil
+		}
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		structField, ok := t.FieldByName(field)
+		if !ok || structField.PkgPath != "" {
+			return nil
+		}
+		t = structField.Type
+	}
+	return t
+}
+
+// renderWriter collects a template's output, failing the template once it
+// has written too much or been stopped.
+type renderWriter struct {
+	name    string
+	buffer  bytes.Buffer
+	stopped int32
+}
+
+var errRenderStopped = errors.New("template stopped")
+
+func (w *renderWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&w.stopped) != 0 {
+		return 0, errRenderStopped
+	}
+	if w.buffer.Len()+len(p) > maxRenderedLength {
+		return 0, fmt.Errorf("%s template rendered more than %d characters", w.name, maxRenderedLength)
+	}
+	return w.buffer.Write(p)
+}
+
+// executeFeedTemplate runs a template on its own goroutine, giving up on it
+// after renderTimeout. A template that keeps going stops the next time it
+// writes; checkTemplateNodes keeps out the loops that wouldn't.
+func executeFeedTemplate(parsed *template.Template, data feedTemplateData) (string, error) {
+	output := &renderWriter{name: parsed.Name()}
+	done := make(chan error, 1)
+	go func() {
+		done <- parsed.Execute(output, data)
+	}()
+
+	timer := time.NewTimer(renderTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			return "", err
+		}
+		return output.buffer.String(), nil
+	case <-timer.C:
+		atomic.StoreInt32(&output.stopped, 1)
+		return "", fmt.Errorf("%s template took longer than %s", parsed.Name(), renderTimeout)
+	}
+}
+
+// renderFeedTemplates executes title and body templates against data. The
+// title must not come out empty, since Mondo requires one.
+func renderFeedTemplates(titleText, bodyText string, data feedTemplateData) (string, string, error) {
+	var rendered [2]string
+	for i, t := range []struct{ name, text, defaultText string }{
+		{"title", titleText, defaultTitleTemplate},
+		{"body", bodyText, defaultBodyTemplate},
+	} {
+		parsed, err := parseFeedTemplate(t.name, t.text, t.defaultText)
+		if err != nil {
+			return "", "", err
+		}
+		output, err := executeFeedTemplate(parsed, data)
+		if err != nil {
+			return "", "", err
+		}
+		rendered[i] = strings.TrimSpace(output)
+	}
+	if rendered[0] == "" {
+		return "", "", fmt.Errorf("title template rendered an empty title")
+	}
+	return rendered[0], rendered[1], nil
+}
+
+// validateFeedTemplates checks templates parse and render against the sample
+// data, which catches most mistakes such as misspelt fields.
+func validateFeedTemplates(titleText, bodyText string) error {
+	_, _, err := renderFeedTemplates(titleText, bodyText, sampleFeedTemplateData())
+	return err
+}
+
+// feedItemText renders the session's feed item title and body. A template
+// can still fail on a real trip, e.g. using .Transaction when there isn't
+// one, in which case the defaults are used rather than losing the receipt.
+func (s *session) feedItemText(data feedTemplateData) (string, string) {
+	title, body, err := renderFeedTemplates(s.feedTitleTemplate, s.feedBodyTemplate, data)
+	if err == nil {
+		return title, body
+	}
+	log.Printf("Session %s feed template error, using defaults: %s\n", s.sessionId, err.Error())
+	return "Uber Receipt " + data.Emoji, data.Breakdown
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestDefaultFeedTemplates(t *testing.T) {
+	data := sampleFeedTemplateData()
+	title, body, err := renderFeedTemplates("", "", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Uber Receipt "+data.Emoji {
+		t.Errorf("unexpected title %q", title)
+	}
+	if body != receiptBody(data.Trip, data.Receipt) {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestCustomFeedTemplates(t *testing.T) {
+	title, body, err := renderFeedTemplates(
+		"{{.Trip.StartCity.DisplayName}} trip",
+		`{{.Receipt.TotalCharged}} for {{duration .Receipt.Duration}} at {{(unixTime .Trip.StartTime).Format "15:04"}}
+{{range .Receipt.Charges}}{{.Name}} {{amount .Amount $.Receipt.CurrencyCode}}; {{end}}
+{{with .Transaction}}Paid {{money .Amount .Currency}}{{end}}`,
+		sampleFeedTemplateData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "London trip" {
+		t.Errorf("unexpected title %q", title)
+	}
+	expected := "£13.78 for 12 min at 12:24\nBase Fare £2.20; Distance £2.75; Time £3.57; \nPaid -£13.78"
+	if body != expected {
+		t.Errorf("expected body %q, got %q", expected, body)
+	}
+}
+
+func TestValidateFeedTemplates(t *testing.T) {
+	for _, test := range []struct{ title, body, problem string }{
+		{"{{.Trip.Nope}}", "", "can't evaluate field Nope"},
+		{"{{.Emoji", "", "unclosed action"},
+		{"", "{{nope}}", `function "nope" not defined`},
+		{" ", "", "empty title"},
+		{strings.Repeat("x", maxTemplateLength+1), "", "longer than"},
+		{"x", "{{range .Receipt.Charges}}{{with .}}{{range $.Receipt.Charges}}{{end}}{{end}}{{end}}", "nests range and with"},
+		{"x", "{{range 1000000000}}{{end}}", "only range over a list"},
+		{"x", "{{$n := 1000000000}}{{range $n}}{{range $n}}{{end}}{{end}}x", "only range over a list"},
+		{"x", "{{range .Trip.StartTime}}{{end}}", "not a int64"},
+		{"x", "{{range (unixTime .Trip.StartTime).Unix}}{{end}}", "only range over a list"},
+		{"x", "{{with .Trip}}{{range .StartTime}}{{end}}{{end}}", "not a int64"},
+		{"x", "{{with unixTime 0}}{{range .}}{{end}}{{end}}", "only range over a list"},
+		{"x", `{{define "loop"}}{{template "loop"}}{{end}}`, "can't define templates"},
+		{"x", `{{template "body"}}`, "can't call other templates"},
+		{"x", `{{block "inner" .}}{{end}}`, "can't define templates"},
+		{"x", "{{range .Receipt.Charges}}{{range $.Receipt.Charges}}" + strings.Repeat("x", 1000) + "{{end}}{{end}}", "rendered more than"},
+	} {
+		err := validateFeedTemplates(test.title, test.body)
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("expected error containing %q for %q/%q, got %v", test.problem, test.title, test.body, err)
+		}
+	}
+}
+
+func TestValidateFeedTemplatesRangesOverTheData(t *testing.T) {
+	for _, body := range []string{
+		"{{range .Receipt.Charges}}{{.Name}}{{end}}",
+		"{{with .Receipt}}{{range .ChargeAdjustments}}{{.Name}}{{end}}{{end}}",
+		"{{range $i, $charge := $.Receipt.Charges}}{{$i}}{{end}}",
+	} {
+		if err := validateFeedTemplates("x", body); err != nil {
+			t.Errorf("expected %q to be valid, got %v", body, err)
+		}
+	}
+}
+
+func TestFeedItemTextFallsBackToDefaults(t *testing.T) {
+	s := &session{sessionId: "abc", feedBodyTemplate: "{{.Transaction.Id}}"}
+	data := sampleFeedTemplateData()
+
+	if _, body := s.feedItemText(data); body != data.Transaction.Id {
+		t.Errorf("expected transaction id, got %q", body)
+	}
+
+	data.Transaction = nil
+	title, body := s.feedItemText(data)
+	if title != "Uber Receipt "+data.Emoji || body != data.Breakdown {
+		t.Errorf("expected defaults without a transaction, got %q %q", title, body)
+	}
+}
+
+func TestExecuteFeedTemplateGivesUpAfterTimeout(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	release := make(chan struct{})
+	parsed := template.Must(template.New("body").Funcs(template.FuncMap{
+		"wait": func() string {
+			<-release
+			return ""
+		},
+	}).Parse("{{wait}}"))
+
+	start := time.Now()
+	_, err := executeFeedTemplate(parsed, sampleFeedTemplateData())
+	if err == nil || !strings.Contains(err.Error(), "took longer than") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*renderTimeout {
+		t.Errorf("expected to give up after %s, took %s", renderTimeout, elapsed)
+	}
+
+	// Once the template gets going again it doesn't outlive its stop
+	close(release)
+	eventually(t, "the template's goroutine to finish", func() bool {
+		return runtime.NumGoroutine() <= baseline
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// diskCache keeps files in a directory, evicting the least recently used once
+// they add up to more than maxBytes. File modification times record use, so
+// the order survives a restart.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mutex   sync.Mutex
+	size    int64
+	order   *list.List // of *diskCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	key  string
+	size int64
+}
+
+// openDiskCache creates the cache directory if need be and indexes any files
+// already in it.
+func openDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+
+	c := &diskCache{dir: dir, maxBytes: maxBytes, order: list.New(), entries: make(map[string]*list.Element)}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) == ".tmp" {
+			continue
+		}
+		c.entries[file.Name()] = c.order.PushBack(&diskCacheEntry{key: file.Name(), size: file.Size()})
+		c.size += file.Size()
+	}
+	c.evict()
+	return c, nil
+}
+
+// Get returns a cached file, or false if it isn't cached. Keys must be safe
+// to use as file names.
+func (c *diskCache) Get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	now := time.Now()
+	os.Chtimes(filepath.Join(c.dir, key), now, now)
+	return data, true
+}
+
+func (c *diskCache) Put(key string, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	temp := filepath.Join(c.dir, key+".tmp")
+	if err := ioutil.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, filepath.Join(c.dir, key)); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	if element, exists := c.entries[key]; exists {
+		c.size -= element.Value.(*diskCacheEntry).size
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&diskCacheEntry{key: key, size: int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+// evict removes least recently used files until the cache fits. The mutex
+// must be held.
+func (c *diskCache) evict() {
+	for c.size > c.maxBytes && c.order.Len() > 0 {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *diskCache) remove(element *list.Element) {
+	entry := element.Value.(*diskCacheEntry)
+	os.Remove(filepath.Join(c.dir, entry.key))
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
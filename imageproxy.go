@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Images bigger than this aren't proxied
+const maxProxiedImageBytes = 10 << 20
+
+var ErrImageUrlExpired = errors.New("image URL has expired")
+var ErrImageUrlSignature = errors.New("invalid image URL signature")
+
+// imageProxy serves feed item images from our own host. Its URLs carry the
+// upstream URL encrypted with AES-GCM, so the API key it may include can't be
+// read by Mondo or anyone it is shared with, plus an expiry time and an HMAC
+// of both, so the proxy can't be used to fetch anything else. Upstream images
+// are fetched once and cached on disk.
+type imageProxy struct {
+	key   []byte
+	ttl   time.Duration
+	cache *diskCache
+	// endpoint returns the public URL of the proxy route
+	endpoint func() (string, error)
+}
+
+func (p *imageProxy) signature(sealed string, expires int64) string {
+	mac := hmac.New(sha256.New, p.key)
+	fmt.Fprintf(mac, "%d\n%s", expires, sealed)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// aead returns the AES-GCM cipher for upstream URLs. Its key is derived
+// from the signing key, so one -imageProxyKey does both.
+func (p *imageProxy) aead() (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte("image proxy url encryption"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts an upstream URL for a proxy URL.
+func (p *imageProxy) seal(target string) (string, error) {
+	aead, err := p.aead()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(target), nil)), nil
+}
+
+// open decrypts an upstream URL sealed by seal.
+func (p *imageProxy) open(sealed string) (string, error) {
+	aead, err := p.aead()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", ErrImageUrlSignature
+	}
+	target, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrImageUrlSignature
+	}
+	return string(target), nil
+}
+
+// SignedUrl returns a proxy URL for an image, valid for the proxy's ttl.
+func (p *imageProxy) SignedUrl(target string) (string, error) {
+	endpoint, err := p.endpoint()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := p.seal(target)
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(p.ttl).Unix()
+	return fmt.Sprintf("%s?%s", endpoint, url.Values{
+		"id":      {sealed},
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {p.signature(sealed, expires)},
+	}.Encode()), nil
+}
+
+// Verify checks a proxy URL's query parameters, returning the upstream URL
+// and when the signature expires.
+func (p *imageProxy) Verify(query url.Values) (string, time.Time, error) {
+	target, expiry, err := p.verifySignature(query)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if time.Now().After(expiry) {
+		return "", time.Time{}, ErrImageUrlExpired
+	}
+	return target, expiry, nil
+}
+
+// Target returns the upstream URL behind one of our proxy URLs, even once it
+// has expired, so we can read the image ourselves.
+func (p *imageProxy) Target(proxyUrl string) (string, error) {
+	parsed, err := url.Parse(proxyUrl)
+	if err != nil {
+		return "", err
+	}
+	target, _, err := p.verifySignature(parsed.Query())
+	return target, err
+}
+
+func (p *imageProxy) verifySignature(query url.Values) (string, time.Time, error) {
+	sealed := query.Get("id")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || sealed == "" {
+		return "", time.Time{}, ErrImageUrlSignature
+	}
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(p.signature(sealed, expires))) {
+		return "", time.Time{}, ErrImageUrlSignature
+	}
+	target, err := p.open(sealed)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return target, time.Unix(expires, 0), nil
+}
+
+// Fetch returns an upstream image from the cache, or downloads and caches
+// it.
+func (p *imageProxy) Fetch(ctx context.Context, target string) ([]byte, error) {
+	sum := sha256.Sum256([]byte(target))
+	key := hex.EncodeToString(sum[:])
+	if data, cached := p.cache.Get(key); cached {
+		return data, nil
+	}
+
+	log.Printf("Fetching image %s\n", key)
+	request, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, maxProxiedImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("image %s: status %d", key, response.StatusCode)
+	}
+	if len(data) > maxProxiedImageBytes {
+		return nil, fmt.Errorf("image %s: bigger than %d bytes", key, maxProxiedImageBytes)
+	}
+	if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		return nil, fmt.Errorf("image %s: not an image", key)
+	}
+
+	if err := p.cache.Put(key, data); err != nil {
+		log.Printf("Image %s cache error: %s\n", key, err.Error())
+	}
+	return data, nil
+}
+
+// serveImage writes an image with headers letting clients and CDNs cache it
+// until its URL expires.
+func serveImage(w http.ResponseWriter, r *http.Request, data []byte, expiry time.Time) {
+	sum := sha256.Sum256(data)
+	maxAge := int64(time.Until(expiry) / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set(ContentType, http.DetectContentType(data))
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:16])))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", maxAge))
+	w.Header().Set("Expires", expiry.UTC().Format(http.TimeFormat))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
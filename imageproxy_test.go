@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestImageProxy(t *testing.T, maxBytes int64) (*imageProxy, func()) {
+	dir, err := ioutil.TempDir("", "uber-mondo-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := openDiskCache(dir, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &imageProxy{
+		key:   []byte("secret"),
+		ttl:   time.Hour,
+		cache: cache,
+		endpoint: func() (string, error) {
+			return "https://example.com/images/proxy", nil
+		},
+	}
+	return proxy, func() { os.RemoveAll(dir) }
+}
+
+func signedQuery(t *testing.T, proxy *imageProxy, target string) url.Values {
+	signed, err := proxy.SignedUrl(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Query()
+}
+
+func TestImageProxyVerifiesSignedUrl(t *testing.T) {
+	proxy, cleanup := newTestImageProxy(t, 1<<20)
+	defer cleanup()
+
+	query := signedQuery(t, proxy, "https://maps.example.com/map.png?key=abc")
+	target, expiry, err := proxy.Verify(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "https://maps.example.com/map.png?key=abc" {
+		t.Errorf("unexpected target %s", target)
+	}
+	if time.Until(expiry) <= 0 || time.Until(expiry) > time.Hour {
+		t.Errorf("unexpected expiry %s", expiry)
+	}
+
+	signed, err := proxy.SignedUrl(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(signed, "maps.example.com") || strings.Contains(signed, "key=abc") {
+		t.Errorf("expected the upstream URL to be hidden, got %s", signed)
+	}
+
+	other := signedQuery(t, proxy, "https://evil.example.com/")
+	tampered := url.Values{"id": other["id"], "expires": query["expires"], "sig": query["sig"]}
+	if _, _, err := proxy.Verify(tampered); err != ErrImageUrlSignature {
+		t.Errorf("expected ErrImageUrlSignature for changed id, got %v", err)
+	}
+	expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+	cleartext := url.Values{"url": {target}, "expires": query["expires"], "sig": {proxy.signature(target, expires)}}
+	if _, _, err := proxy.Verify(cleartext); err != ErrImageUrlSignature {
+		t.Errorf("expected ErrImageUrlSignature for a cleartext url, got %v", err)
+	}
+
+	otherKey := *proxy
+	otherKey.key = []byte("other")
+	if _, _, err := otherKey.Verify(query); err != ErrImageUrlSignature {
+		t.Errorf("expected ErrImageUrlSignature for another key, got %v", err)
+	}
+
+	proxy.ttl = -time.Minute
+	if _, _, err := proxy.Verify(signedQuery(t, proxy, target)); err != ErrImageUrlExpired {
+		t.Errorf("expected ErrImageUrlExpired, got %v", err)
+	}
+
+	// We can still read back an expired image ourselves
+	expired, err := proxy.SignedUrl(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved, err := proxy.Target(expired); err != nil || resolved != target {
+		t.Errorf("expected %s for an expired URL, got %s and %v", target, resolved, err)
+	}
+	if _, err := proxy.Target("https://example.com/images/proxy?" + tampered.Encode()); err != ErrImageUrlSignature {
+		t.Errorf("expected ErrImageUrlSignature for a changed URL, got %v", err)
+	}
+}
+
+func TestImageProxyFetchesOnce(t *testing.T) {
+	fetches := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(encodeTestTile(t))
+	}))
+	defer upstream.Close()
+
+	proxy, cleanup := newTestImageProxy(t, 1<<20)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		data, err := proxy.Fetch(context.Background(), upstream.URL+"/map.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if http.DetectContentType(data) != "image/png" {
+			t.Errorf("expected a png, got %s", http.DetectContentType(data))
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected 1 upstream fetch, got %d", fetches)
+	}
+}
+
+func TestImageProxyRejectsNonImages(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>not a map</html>"))
+	}))
+	defer upstream.Close()
+
+	proxy, cleanup := newTestImageProxy(t, 1<<20)
+	defer cleanup()
+
+	if _, err := proxy.Fetch(context.Background(), upstream.URL); err == nil {
+		t.Errorf("expected error for html response")
+	}
+}
+
+func TestServeImageCacheHeaders(t *testing.T) {
+	data := encodeTestTile(t)
+	expiry := time.Now().Add(time.Hour)
+
+	recorder := httptest.NewRecorder()
+	serveImage(recorder, httptest.NewRequest("GET", "/images/proxy", nil), data, expiry)
+	if recorder.Code != http.StatusOK || recorder.Header().Get(ContentType) != "image/png" {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Header().Get(ContentType))
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Cache-Control"), "public, max-age=35") {
+		t.Errorf("unexpected Cache-Control %s", recorder.Header().Get("Cache-Control"))
+	}
+
+	request := httptest.NewRequest("GET", "/images/proxy", nil)
+	request.Header.Set("If-None-Match", recorder.Header().Get("ETag"))
+	recorder = httptest.NewRecorder()
+	serveImage(recorder, request, data, expiry)
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", recorder.Code)
+	}
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uber-mondo-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := openDiskCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("a", []byte("aaaa"))
+	cache.Put("b", []byte("bbbb"))
+	cache.Get("a")
+	cache.Put("c", []byte("cccc"))
+
+	if _, cached := cache.Get("b"); cached {
+		t.Errorf("expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, cached := cache.Get(key); !cached {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+
+	reopened, err := openDiskCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, cached := reopened.Get("c"); !cached || string(data) != "cccc" {
+		t.Errorf("expected c to survive reopening, got %q", data)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/nu7hatch/gouuid"
+	"log"
+	"sync"
+	"time"
+)
+
+// jobQueue runs persisted jobs on a pool of workers. Failed jobs are retried
+// with exponential backoff, and moved to the dead-letter list once they have
+// failed maxAttempts times.
+type jobQueue struct {
+	store       JobStore
+	run         func(ctx context.Context, j *job) error
+	dead        func(j *job)
+	workers     int
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	poll        time.Duration
+
+	jobs    chan *job
+	wake    chan struct{}
+	stop    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	running map[string]bool
+}
+
+// newJobQueue returns a queue that calls run for each job, and dead for each
+// job that is given up on. The context passed to run is cancelled by Stop.
+func newJobQueue(store JobStore, run func(ctx context.Context, j *job) error, dead func(j *job), workers, maxAttempts int) *jobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobQueue{
+		store:       store,
+		run:         run,
+		dead:        dead,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		baseDelay:   30 * time.Second,
+		maxDelay:    time.Hour,
+		poll:        5 * time.Second,
+		jobs:        make(chan *job),
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		running:     make(map[string]bool),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Enqueue persists a job to be run as soon as a worker is free.
+func (q *jobQueue) Enqueue(j *job) error {
+	if j.Id == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		j.Id = id.String()
+	}
+	now := time.Now()
+	j.Created = now
+	j.NextAttempt = now
+
+	if err := q.store.Put(j); err != nil {
+		return err
+	}
+	log.Printf("Queued %s job %s\n", j.Type, j.Id)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start runs the dispatcher and workers. Jobs left in the store by a
+// previous run are picked up straight away.
+func (q *jobQueue) Start() {
+	q.wg.Add(1)
+	go q.dispatch()
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Stop stops dispatching, cancels running jobs' API calls and waits for them
+// to return. Queued and cancelled jobs stay in the store for next time.
+func (q *jobQueue) Stop() {
+	close(q.stop)
+	q.cancel()
+	q.wg.Wait()
+}
+
+// Drain waits until no jobs are due or running, e.g. before Stop on
+// shutdown. Jobs waiting to retry later aren't waited for. It gives up when
+// ctx is done.
+func (q *jobQueue) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		due, err := q.store.Due(time.Now())
+		if err != nil {
+			return err
+		}
+		q.mutex.Lock()
+		running := len(q.running)
+		q.mutex.Unlock()
+		if len(due) == 0 && running == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d jobs due and %d running: %w", len(due), running, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *jobQueue) dispatch() {
+	defer q.wg.Done()
+	defer close(q.jobs)
+
+	ticker := time.NewTicker(q.poll)
+	defer ticker.Stop()
+	for {
+		due, err := q.store.Due(time.Now())
+		if err != nil {
+			log.Printf("Job queue error: %s\n", err.Error())
+		}
+		for _, j := range due {
+			if !q.lease(j.Id) {
+				continue
+			}
+			// A worker may have finished or rescheduled it since Due
+			current, err := q.store.Get(j.Id)
+			if err != nil || current.NextAttempt.After(time.Now()) {
+				q.release(j.Id)
+				continue
+			}
+			select {
+			case q.jobs <- current:
+			case <-q.stop:
+				return
+			}
+		}
+
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *jobQueue) work() {
+	defer q.wg.Done()
+	for j := range q.jobs {
+		q.attempt(j)
+		q.release(j.Id)
+	}
+}
+
+func (q *jobQueue) attempt(j *job) {
+	j.Attempts++
+	err := q.run(q.ctx, j)
+	if err != nil && q.ctx.Err() != nil {
+		// Cancelled by Stop; that attempt doesn't count
+		log.Printf("Stopped %s job %s\n", j.Type, j.Id)
+		j.Attempts--
+		if err := q.store.Put(j); err != nil {
+			log.Printf("Job %s update error: %s\n", j.Id, err.Error())
+		}
+		return
+	}
+	if err == nil {
+		log.Printf("Finished %s job %s\n", j.Type, j.Id)
+		if err := q.store.Delete(j.Id); err != nil {
+			log.Printf("Job %s delete error: %s\n", j.Id, err.Error())
+		}
+		return
+	}
+
+	j.LastError = err.Error()
+	if j.Attempts >= q.maxAttempts || !retryable(err) {
+		log.Printf("Giving up on %s job %s after %d attempts: %s\n", j.Type, j.Id, j.Attempts, err.Error())
+		if err := q.store.DeadLetter(j); err != nil {
+			log.Printf("Job %s dead letter error: %s\n", j.Id, err.Error())
+		}
+		if q.dead != nil {
+			q.dead(j)
+		}
+		return
+	}
+
+	delay := q.backoff(j.Attempts)
+	if retryAfter := RetryAfter(err); retryAfter > delay {
+		delay = retryAfter
+	}
+	j.NextAttempt = time.Now().Add(delay)
+	log.Printf("Retrying %s job %s in %s: %s\n", j.Type, j.Id, delay, err.Error())
+	if err := q.store.Put(j); err != nil {
+		log.Printf("Job %s update error: %s\n", j.Id, err.Error())
+	}
+}
+
+// retryable reports whether a failed job is worth trying again. Once a user
+// has revoked our access to their account, it never will be.
+func retryable(err error) bool {
+	return !IsUnauthorized(err) && !IsForbidden(err)
+}
+
+// backoff returns how long to wait after a job's nth failed attempt.
+func (q *jobQueue) backoff(attempts int) time.Duration {
+	delay := q.baseDelay
+	for i := 1; i < attempts && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+	return delay
+}
+
+// lease marks a job as running so the dispatcher doesn't hand it out twice.
+func (q *jobQueue) lease(jobId string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.running[jobId] {
+		return false
+	}
+	q.running[jobId] = true
+	return true
+}
+
+func (q *jobQueue) release(jobId string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.running, jobId)
+}
+
+// deadLettersCommand lists the jobs that were given up on, and why.
+func deadLettersCommand(args []string) error {
+	flags := flag.NewFlagSet("deadletters", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	dead, err := jobStore.DeadLetters()
+	if err != nil {
+		return err
+	}
+	for _, j := range dead {
+		fmt.Printf("%s job %s for session %s, created %s, %d attempts: %s\n",
+			j.Type, j.Id, j.SessionId, j.Created.Format(time.RFC3339), j.Attempts, j.LastError)
+	}
+	fmt.Printf("%d dead letters\n", len(dead))
+	return nil
+}
+
+// logDeadLetters logs how many jobs have been given up on, so they aren't
+// forgotten about.
+func logDeadLetters() {
+	dead, err := jobStore.DeadLetters()
+	if err != nil {
+		log.Printf("Dead letters error: %s\n", err.Error())
+		return
+	}
+	if len(dead) > 0 {
+		log.Printf("%d jobs have been given up on, run the deadletters command to list them\n", len(dead))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestJobQueue(store JobStore, run func(ctx context.Context, j *job) error, dead func(j *job), maxAttempts int) *jobQueue {
+	q := newJobQueue(store, run, dead, 2, maxAttempts)
+	q.baseDelay = time.Millisecond
+	q.maxDelay = 5 * time.Millisecond
+	q.poll = time.Millisecond
+	return q
+}
+
+func TestJobQueueRetriesUntilSuccess(t *testing.T) {
+	store := newMemoryJobStore()
+	done := make(chan *job, 1)
+	q := newTestJobQueue(store, func(ctx context.Context, j *job) error {
+		if j.Attempts < 3 {
+			return errors.New("receipt not ready")
+		}
+		done <- j
+		return nil
+	}, nil, 5)
+	q.Start()
+	defer q.Stop()
+
+	if err := q.Enqueue(&job{Type: receiptReadyJob, RequestId: "trip_1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case j := <-done:
+		if j.Attempts != 3 || j.LastError != "receipt not ready" {
+			t.Errorf("unexpected job %+v", j)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never succeeded")
+	}
+
+	// Give the worker a moment to delete it
+	time.Sleep(20 * time.Millisecond)
+	if due, _ := store.Due(time.Now().Add(time.Hour)); len(due) != 0 {
+		t.Errorf("expected finished job to be removed, got %d", len(due))
+	}
+}
+
+func TestJobQueueDeadLetters(t *testing.T) {
+	store := newMemoryJobStore()
+	dead := make(chan *job, 1)
+	q := newTestJobQueue(store, func(ctx context.Context, j *job) error {
+		return errors.New("boom")
+	}, func(j *job) {
+		dead <- j
+	}, 3)
+	q.Start()
+	defer q.Stop()
+
+	q.Enqueue(&job{Type: receiptReadyJob, RequestId: "trip_1"})
+
+	select {
+	case j := <-dead:
+		if j.Attempts != 3 {
+			t.Errorf("expected 3 attempts, got %d", j.Attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never dead lettered")
+	}
+
+	deadLetters, _ := store.DeadLetters()
+	if len(deadLetters) != 1 || deadLetters[0].LastError != "boom" {
+		t.Errorf("unexpected dead letters %+v", deadLetters)
+	}
+}
+
+func TestJobQueueResumesStoredJobs(t *testing.T) {
+	db := newTestBoltDb(t)
+	defer closeTestBoltDb(db)
+	store, err := newBoltJobStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Left behind by a previous run
+	store.Put(&job{Id: "left-over", Type: receiptReadyJob, NextAttempt: time.Now()})
+
+	var mutex sync.Mutex
+	ran := make(map[string]int)
+	done := make(chan bool, 1)
+	q := newTestJobQueue(store, func(ctx context.Context, j *job) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ran[j.Id]++
+		done <- true
+		return nil
+	}, nil, 3)
+	q.Start()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stored job never ran")
+	}
+	q.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if ran["left-over"] != 1 {
+		t.Errorf("expected stored job to run once, ran %d times", ran["left-over"])
+	}
+}
+
+func TestJobQueueBackoff(t *testing.T) {
+	q := newJobQueue(newMemoryJobStore(), nil, nil, 1, 10)
+	expected := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, delay := range expected {
+		if actual := q.backoff(i + 1); actual != delay {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, delay, actual)
+		}
+	}
+	if actual := q.backoff(20); actual != time.Hour {
+		t.Errorf("expected backoff capped at an hour, got %s", actual)
+	}
+}
+
+func TestJobQueueGivesUpWhenAccessRevoked(t *testing.T) {
+	store := newMemoryJobStore()
+	dead := make(chan *job, 1)
+	q := newTestJobQueue(store, func(ctx context.Context, j *job) error {
+		return &APIError{Provider: uberProvider, StatusCode: 401}
+	}, func(j *job) {
+		dead <- j
+	}, 5)
+	q.Start()
+	defer q.Stop()
+
+	q.Enqueue(&job{Type: receiptReadyJob, RequestId: "trip_1"})
+
+	select {
+	case j := <-dead:
+		if j.Attempts != 1 {
+			t.Errorf("expected 1 attempt, got %d", j.Attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never dead lettered")
+	}
+}
+
+func TestJobQueueHonoursRetryAfter(t *testing.T) {
+	store := newMemoryJobStore()
+	q := newTestJobQueue(store, func(ctx context.Context, j *job) error {
+		return &APIError{Provider: uberProvider, StatusCode: 429, RetryAfter: time.Hour}
+	}, nil, 5)
+
+	j := &job{Id: "job_1", Type: receiptReadyJob, RequestId: "trip_1"}
+	q.attempt(j)
+
+	stored, err := store.Get("job_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(stored.NextAttempt) < 59*time.Minute {
+		t.Errorf("expected retry in an hour, got %s", time.Until(stored.NextAttempt))
+	}
+}
+
+func TestJobQueueStopCancelsRunningJobs(t *testing.T) {
+	store := newMemoryJobStore()
+	started := make(chan struct{})
+	q := newTestJobQueue(store, func(ctx context.Context, j *job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, nil, 5)
+	q.Start()
+
+	q.Enqueue(&job{Id: "job_1", Type: receiptReadyJob, RequestId: "trip_1"})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never started")
+	}
+	q.Stop()
+
+	stored, err := store.Get("job_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Attempts != 0 {
+		t.Errorf("expected cancelled attempt not to count, got %d", stored.Attempts)
+	}
+}
+
+func TestJobQueueDrain(t *testing.T) {
+	store := newMemoryJobStore()
+	release := make(chan struct{})
+	q := newTestJobQueue(store, func(ctx context.Context, j *job) error {
+		if j.RequestId == "later" {
+			return errors.New("receipt not ready")
+		}
+		<-release
+		return nil
+	}, nil, 5)
+	q.maxDelay = time.Hour
+	q.baseDelay = time.Hour
+	q.Start()
+	defer q.Stop()
+
+	// Waiting to retry in an hour, so not waited for
+	q.Enqueue(&job{Type: receiptReadyJob, RequestId: "later"})
+	q.Enqueue(&job{Type: receiptReadyJob, RequestId: "trip_1"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := q.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected drain to time out while a job runs, got %v", err)
+	}
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ := store.Due(time.Now().Add(2 * time.Hour)); len(due) != 1 || due[0].RequestId != "later" {
+		t.Errorf("expected only the retrying job left, got %+v", due)
+	}
+}
+
+func TestBoltJobStoreIndexesDueJobs(t *testing.T) {
+	db := newTestBoltDb(t)
+	defer closeTestBoltDb(db)
+	store, err := newBoltJobStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, j := range []*job{
+		{Id: "later", NextAttempt: now.Add(time.Hour)},
+		{Id: "soon", NextAttempt: now.Add(-time.Second)},
+		{Id: "soonest", NextAttempt: now.Add(-time.Minute)},
+		{Id: "dead", NextAttempt: now.Add(-time.Minute)},
+	} {
+		if err := store.Put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rescheduling moves a job in the index rather than adding it again
+	if err := store.Put(&job{Id: "soon", NextAttempt: now.Add(-2 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeadLetter(&job{Id: "dead", LastError: "boom"}); err != nil {
+		t.Fatal(err)
+	}
+
+	due, err := store.Due(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 || due[0].Id != "soonest" || due[1].Id != "soon" {
+		t.Errorf("expected soonest then soon, got %+v", due)
+	}
+
+	if err := store.Delete("soonest"); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ := store.Due(now.Add(2 * time.Hour)); len(due) != 2 || due[0].Id != "soon" || due[1].Id != "later" {
+		t.Errorf("expected soon then later, got %+v", due)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNoSuchJob = errors.New("no such job")
+
+var jobsBucket = []byte("jobs")
+var deadJobsBucket = []byte("dead_jobs")
+
+// dueJobsBucket indexes the queued jobs by their next attempt, so finding
+// the due ones doesn't mean reading every job. See dueKey.
+var dueJobsBucket = []byte("due_jobs")
+
+const (
+	// Match a Mondo transaction to a trip and publish its receipt
+	transactionJob = "transaction"
+	// Publish the receipt for a trip Uber told us about
+	receiptReadyJob = "receipt_ready"
+	// Attach receipts to a session's past transactions, see backfillProgress
+	backfillJob = "backfill"
+	// Attach the trip a user picked for a transaction that needed review
+	reviewedJob = "reviewed"
+)
+
+type job struct {
+	Id          string       `json:"id"`
+	Type        string       `json:"type"`
+	SessionId   string       `json:"session_id"`
+	Transaction *WebhookData `json:"transaction,omitempty"`
+	RequestId   string       `json:"request_id,omitempty"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	LastError   string       `json:"last_error,omitempty"`
+	Created     time.Time    `json:"created"`
+}
+
+// JobStore holds queued jobs, and jobs that failed too many times in a
+// separate dead-letter list.
+type JobStore interface {
+	Get(jobId string) (*job, error)
+	Put(j *job) error
+	Delete(jobId string) error
+	// Due returns the queued jobs whose next attempt is at or before now,
+	// soonest first.
+	Due(now time.Time) ([]*job, error)
+	// DeadLetter moves a job from the queue to the dead-letter list.
+	DeadLetter(j *job) error
+	DeadLetters() ([]*job, error)
+}
+
+func sortJobs(jobs []*job) {
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].NextAttempt.Before(jobs[j].NextAttempt) })
+}
+
+type memoryJobStore struct {
+	mutex sync.Mutex
+	jobs  map[string]*job
+	dead  map[string]*job
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{jobs: make(map[string]*job), dead: make(map[string]*job)}
+}
+
+func (m *memoryJobStore) Get(jobId string) (*job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	j, exists := m.jobs[jobId]
+	if !exists {
+		return nil, ErrNoSuchJob
+	}
+	copy := *j
+	return &copy, nil
+}
+
+func (m *memoryJobStore) Put(j *job) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	copy := *j
+	m.jobs[j.Id] = &copy
+	return nil
+}
+
+func (m *memoryJobStore) Delete(jobId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.jobs, jobId)
+	return nil
+}
+
+func (m *memoryJobStore) Due(now time.Time) ([]*job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var due []*job
+	for _, j := range m.jobs {
+		if !j.NextAttempt.After(now) {
+			copy := *j
+			due = append(due, &copy)
+		}
+	}
+	sortJobs(due)
+	return due, nil
+}
+
+func (m *memoryJobStore) DeadLetter(j *job) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.jobs, j.Id)
+	copy := *j
+	m.dead[j.Id] = &copy
+	return nil
+}
+
+func (m *memoryJobStore) DeadLetters() ([]*job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var dead []*job
+	for _, j := range m.dead {
+		copy := *j
+		dead = append(dead, &copy)
+	}
+	sortJobs(dead)
+	return dead, nil
+}
+
+// boltJobStore keeps jobs in a BoltDB file. Queued jobs are also indexed by
+// their next attempt in dueJobsBucket.
+type boltJobStore struct {
+	db *bolt.DB
+}
+
+func newBoltJobStore(db *bolt.DB) (*boltJobStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(jobsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(deadJobsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(dueJobsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltJobStore{db: db}, nil
+}
+
+const dueKeyLayout = "20060102T150405.000000000Z"
+
+// dueKey is a job's key in dueJobsBucket: its next attempt, in a format that
+// sorts by time, then its ID.
+func dueKey(nextAttempt time.Time, jobId string) []byte {
+	return []byte(nextAttempt.UTC().Format(dueKeyLayout) + "/" + jobId)
+}
+
+func (b *boltJobStore) Get(jobId string) (*job, error) {
+	j := &job{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobsBucket).Get([]byte(jobId))
+		if data == nil {
+			return ErrNoSuchJob
+		}
+		return json.Unmarshal(data, j)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (b *boltJobStore) Put(j *job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := b.unindex(tx, j.Id); err != nil {
+			return err
+		}
+		if err := tx.Bucket(dueJobsBucket).Put(dueKey(j.NextAttempt, j.Id), nil); err != nil {
+			return err
+		}
+		return tx.Bucket(jobsBucket).Put([]byte(j.Id), data)
+	})
+}
+
+func (b *boltJobStore) Delete(jobId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := b.unindex(tx, jobId); err != nil {
+			return err
+		}
+		return tx.Bucket(jobsBucket).Delete([]byte(jobId))
+	})
+}
+
+// unindex removes a queued job's entry from dueJobsBucket, if it has one.
+func (b *boltJobStore) unindex(tx *bolt.Tx, jobId string) error {
+	data := tx.Bucket(jobsBucket).Get([]byte(jobId))
+	if data == nil {
+		return nil
+	}
+	old := &job{}
+	if err := json.Unmarshal(data, old); err != nil {
+		return err
+	}
+	return tx.Bucket(dueJobsBucket).Delete(dueKey(old.NextAttempt, jobId))
+}
+
+func (b *boltJobStore) Due(now time.Time) ([]*job, error) {
+	end := []byte(now.UTC().Format(dueKeyLayout))
+	var due []*job
+	err := b.db.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(jobsBucket)
+		cursor := tx.Bucket(dueJobsBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && bytes.Compare(key[:len(end)], end) <= 0; key, _ = cursor.Next() {
+			data := jobs.Get(key[len(end)+1:])
+			if data == nil {
+				continue
+			}
+			j := &job{}
+			if err := json.Unmarshal(data, j); err != nil {
+				return err
+			}
+			due = append(due, j)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return due, nil
+}
+
+func (b *boltJobStore) DeadLetter(j *job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := b.unindex(tx, j.Id); err != nil {
+			return err
+		}
+		if err := tx.Bucket(jobsBucket).Delete([]byte(j.Id)); err != nil {
+			return err
+		}
+		return tx.Bucket(deadJobsBucket).Put([]byte(j.Id), data)
+	})
+}
+
+func (b *boltJobStore) DeadLetters() ([]*job, error) {
+	return b.list(deadJobsBucket)
+}
+
+func (b *boltJobStore) list(bucket []byte) ([]*job, error) {
+	var jobs []*job
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(key, data []byte) error {
+			j := &job{}
+			if err := json.Unmarshal(data, j); err != nil {
+				return err
+			}
+			jobs = append(jobs, j)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortJobs(jobs)
+	return jobs, nil
+}
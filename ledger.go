@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var ErrNoSuchLedgerEntry = errors.New("no such ledger entry")
+
+var ledgerBucket = []byte("ledger")
+
+// A claim that has been pending this long is assumed to belong to a request
+// that died part way through, and may be claimed again.
+const staleClaimAge = 10 * time.Minute
+
+const (
+	ledgerPending   = "pending"
+	ledgerQueued    = "queued"
+	ledgerPublished = "published"
+	ledgerReview    = "review"
+	// Backfilled transactions get a receipt attached but no feed item
+	ledgerAttached = "attached"
+)
+
+// ledgerEntry records what was done for a Mondo transaction or an Uber trip,
+// so webhook retries don't publish the same receipt twice.
+type ledgerEntry struct {
+	Status        string    `json:"status"`
+	TransactionId string    `json:"transaction_id,omitempty"`
+	RequestId     string    `json:"request_id,omitempty"`
+	SessionId     string    `json:"session_id,omitempty"`
+	FeedItem      *feedItem `json:"feed_item,omitempty"`
+	AttachmentId  string    `json:"attachment_id,omitempty"`
+	Updated       time.Time `json:"updated"`
+}
+
+// Ledger keys entries by transactionKey or tripKey. Claim atomically marks a
+// key as being processed and returns false if it already was. Complete then
+// records the outcome (published, unless the entry says otherwise), or
+// Release gives the key up so a retry can have it.
+type Ledger interface {
+	Claim(key string) (bool, error)
+	Release(key string) error
+	Complete(key string, entry *ledgerEntry) error
+	Get(key string) (*ledgerEntry, error)
+}
+
+func transactionKey(transactionId string) string {
+	return "transaction:" + transactionId
+}
+
+func tripKey(requestId string) string {
+	return "trip:" + requestId
+}
+
+func (e *ledgerEntry) claimable() bool {
+	return e.Status == ledgerPending && time.Since(e.Updated) > staleClaimAge
+}
+
+func completed(entry *ledgerEntry) *ledgerEntry {
+	copy := *entry
+	if copy.Status == "" || copy.Status == ledgerPending {
+		copy.Status = ledgerPublished
+	}
+	copy.Updated = time.Now()
+	return &copy
+}
+
+type memoryLedger struct {
+	mutex   sync.Mutex
+	entries map[string]*ledgerEntry
+}
+
+func newMemoryLedger() *memoryLedger {
+	return &memoryLedger{entries: make(map[string]*ledgerEntry)}
+}
+
+func (m *memoryLedger) Claim(key string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if entry, exists := m.entries[key]; exists && !entry.claimable() {
+		return false, nil
+	}
+	m.entries[key] = &ledgerEntry{Status: ledgerPending, Updated: time.Now()}
+	return true, nil
+}
+
+func (m *memoryLedger) Release(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *memoryLedger) Complete(key string, entry *ledgerEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.entries[key] = completed(entry)
+	return nil
+}
+
+func (m *memoryLedger) Get(key string) (*ledgerEntry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, exists := m.entries[key]
+	if !exists {
+		return nil, ErrNoSuchLedgerEntry
+	}
+	copy := *entry
+	return &copy, nil
+}
+
+type boltLedger struct {
+	db *bolt.DB
+}
+
+func newBoltLedger(db *bolt.DB) (*boltLedger, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(ledgerBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltLedger{db: db}, nil
+}
+
+func (b *boltLedger) Claim(key string) (bool, error) {
+	claimed := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ledgerBucket)
+		if data := bucket.Get([]byte(key)); data != nil {
+			entry := &ledgerEntry{}
+			if err := json.Unmarshal(data, entry); err != nil {
+				return err
+			}
+			if !entry.claimable() {
+				return nil
+			}
+		}
+
+		data, err := json.Marshal(&ledgerEntry{Status: ledgerPending, Updated: time.Now()})
+		if err != nil {
+			return err
+		}
+		claimed = true
+		return bucket.Put([]byte(key), data)
+	})
+	return claimed, err
+}
+
+func (b *boltLedger) Release(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ledgerBucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltLedger) Complete(key string, entry *ledgerEntry) error {
+	data, err := json.Marshal(completed(entry))
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ledgerBucket).Put([]byte(key), data)
+	})
+}
+
+func (b *boltLedger) Get(key string) (*ledgerEntry, error) {
+	entry := &ledgerEntry{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(ledgerBucket).Get([]byte(key))
+		if data == nil {
+			return ErrNoSuchLedgerEntry
+		}
+		return json.Unmarshal(data, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testLedger(t *testing.T, ledger Ledger) {
+	key := transactionKey("tx_1")
+
+	claimed, err := ledger.Claim(key)
+	if err != nil || !claimed {
+		t.Fatalf("expected first claim to succeed, got %v %v", claimed, err)
+	}
+	claimed, _ = ledger.Claim(key)
+	if claimed {
+		t.Errorf("expected duplicate claim to fail")
+	}
+
+	if err := ledger.Release(key); err != nil {
+		t.Fatal(err)
+	}
+	claimed, _ = ledger.Claim(key)
+	if !claimed {
+		t.Errorf("expected claim after release to succeed")
+	}
+
+	err = ledger.Complete(key, &ledgerEntry{TransactionId: "tx_1", RequestId: "trip_1", FeedItem: &feedItem{Title: "Uber Receipt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, _ = ledger.Claim(key)
+	if claimed {
+		t.Errorf("expected claim after completion to fail")
+	}
+
+	entry, err := ledger.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != ledgerPublished || entry.RequestId != "trip_1" || entry.FeedItem.Title != "Uber Receipt" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	if _, err := ledger.Get(tripKey("missing")); err != ErrNoSuchLedgerEntry {
+		t.Errorf("expected ErrNoSuchLedgerEntry, got %v", err)
+	}
+}
+
+func TestMemoryLedger(t *testing.T) {
+	testLedger(t, newMemoryLedger())
+}
+
+func TestBoltLedger(t *testing.T) {
+	db := newTestBoltDb(t)
+	defer closeTestBoltDb(db)
+
+	ledger, err := newBoltLedger(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLedger(t, ledger)
+}
+
+func TestLedgerStaleClaim(t *testing.T) {
+	ledger := newMemoryLedger()
+	ledger.Claim(tripKey("trip_1"))
+	ledger.entries[tripKey("trip_1")].Updated = time.Now().Add(-staleClaimAge - time.Minute)
+
+	claimed, _ := ledger.Claim(tripKey("trip_1"))
+	if !claimed {
+		t.Errorf("expected stale claim to be reclaimable")
+	}
+}
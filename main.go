@@ -1,57 +1,133 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	_ "crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/nu7hatch/gouuid"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/acme/autocert"
 	"html/template"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const (
 	// Route names
-	Index        = "/"
-	Login        = "/login"
-	Logout       = "/logout"
-	SetAuthCode  = "/uber/setauthcode"
-	ReceiptReady = "/uber/webooks/requests.receipt_ready"
-	UberWebhook  = "/uber/webhook"
-	MondoWebhook = "/mondo/webhook"
+	Index            = "/"
+	Login            = "/login"
+	Logout           = "/logout"
+	SetAuthCode      = "/uber/setauthcode"
+	ReceiptReady     = "/uber/webooks/requests.receipt_ready"
+	UberWebhook      = "/uber/webhook"
+	MondoSetAuthCode = "/mondo/setauthcode"
+	SelectAccount    = "/mondo/account"
+	MondoWebhook     = "/mondo/webhook"
+	MapImage         = "/maps"
+	ImageProxy       = "/images"
+	Templates        = "/templates"
+	TemplatePreview  = "/templates/preview"
+	Backfill         = "/backfill"
+	BackfillProgress = "/backfill/progress"
+	Reviews          = "/reviews"
 )
 
 type session struct {
-	sessionId        string
-	mondoAccessToken string
-	mondoAccountId   string
-	mondoWebhookId   string
-	uberAccessToken  string
+	sessionId          string
+	oauthState         string
+	loginExpiry        time.Time
+	mondoAccessToken   string
+	mondoRefreshToken  string
+	mondoTokenExpiry   time.Time
+	mondoAccountId     string
+	mondoWebhookId     string
+	mondoWebhookSecret string
+	uberUserId         string
+	uberAccessToken    string
+	uberRefreshToken   string
+	uberTokenExpiry    time.Time
+	// Feed item templates, empty for the defaults
+	feedTitleTemplate string
+	feedBodyTemplate  string
 }
 
-var googleMapsApiKey = flag.String("gMapsApiKey", "", "Google Maps API key (required)")
+var googleMapsApiKey = flag.String("gMapsApiKey", "", "Google Maps API key (required unless -mapTiles, -mapMbtiles or -fakeApis is set)")
+var mapTilesDir = flag.String("mapTiles", "", "directory of OpenStreetMap tiles laid out as {z}/{x}/{y}.png to render receipt maps from")
+var mapMbtilesFile = flag.String("mapMbtiles", "", "MBTiles file to render receipt maps from (after -mapTiles if both are set)")
+var tlsMode = flag.String("tls", tlsStatic, "how the HTTPS listener gets its certificate: off (serve plain HTTP, e.g. behind a proxy), static (-certFile and -keyFile, reloaded when they change) or acme (from -acmeDirectory)")
 var certFile = flag.String("certFile", "cert.pem", "SSL certificate")
-var keyFile = flag.String("keyFile", "key.pem", "SSL certificate")
+var keyFile = flag.String("keyFile", "key.pem", "SSL certificate key")
+var acmeDomains = flag.String("acmeDomains", "", "comma separated domains to get ACME certificates for (defaults to the -httpsUrl host)")
+var acmeCacheDir = flag.String("acmeCacheDir", "acme", "directory to keep the ACME account key and certificates in")
+var acmeDirectory = flag.String("acmeDirectory", autocert.DefaultACMEDirectory, "ACME directory URL, e.g. a local pebble server's for testing")
+var acmeDirectoryCa = flag.String("acmeDirectoryCa", "", "PEM file of CA certificates to trust when talking to -acmeDirectory, e.g. pebble's")
+var acmeEmail = flag.String("acmeEmail", "", "contact email for the ACME account")
 var httpsAddr = flag.String("https", ":443", "HTTPS address to bind on")
 var httpAddr = flag.String("http", ":80", "HTTP address to bind on")
 var httpsUrl = flag.String("httpsUrl", "", "public HTTPS URL for Uber redirect e.g. https://foo (required)")
-var httpUrl = flag.String("httpUrl", "", "public HTTP URL for Mondo webhook e.g. http://foo (required)")
+var httpUrl = flag.String("httpUrl", "", "deprecated and ignored: Mondo webhooks are registered under -httpsUrl, as their URL holds a secret")
 var uberClientId = flag.String("uberClientId", "", "Uber client_id (required)")
 var uberClientSecret = flag.String("uberClientSecret", "", "Uber client_secret (required)")
 var uberApiHost = flag.String("uberApi", "https://api.uber.com", "Uber API URL (no trailing slash)")
+var uberAuthHost = flag.String("uberAuth", UberAuthHost, "Uber OAuth URL (no trailing slash)")
+var mondoClientId = flag.String("mondoClientId", "", "Mondo client_id (required)")
+var mondoClientSecret = flag.String("mondoClientSecret", "", "Mondo client_secret (required)")
 var mondoApiUrl = flag.String("mondoApi", "https://api.getmondo.co.uk", "Mondo API URL")
+var mondoAuthHost = flag.String("mondoAuth", MondoAuthHost, "Mondo OAuth URL (no trailing slash)")
+var workers = flag.Int("workers", 4, "number of workers publishing receipts")
+var jobAttempts = flag.Int("jobAttempts", 10, "attempts before a receipt job is moved to the dead-letter list")
+var mondoWebhookIps = flag.String("mondoWebhookIps", "", "comma separated IPs/CIDRs Mondo webhooks may come from (empty allows any)")
+var imageProxyKey = flag.String("imageProxyKey", "", "secret used to sign image proxy URLs and encrypt the image URLs in them (if empty a random one is used, and URLs stop working on restart)")
+var imageUrlTtl = flag.Duration("imageUrlTtl", 365*24*time.Hour, "how long signed image proxy URLs stay valid")
+var imageCacheDir = flag.String("imageCacheDir", "imagecache", "directory to cache proxied images in")
+var imageCacheSize = flag.Int64("imageCacheSize", 256, "maximum size of the image cache in MB")
+var apiTimeout = flag.Duration("apiTimeout", 30*time.Second, "timeout for Uber and Mondo API requests, including retries")
+var apiRetries = flag.Int("apiRetries", 3, "times to retry a failed Uber or Mondo API request")
+var apiMaxRetryAfter = flag.Duration("apiMaxRetryAfter", 10*time.Second, "longest Retry-After to wait for before giving up on an API request")
+var apiRateLimit = flag.Float64("apiRateLimit", 0.5, "API requests per second allowed per access token (0 for no limit)")
+var apiBurst = flag.Int("apiBurst", 10, "API requests per access token allowed in a burst above -apiRateLimit")
+var dbFile = flag.String("db", "sessions.db", "BoltDB file to persist sessions, unmatched transactions, the processed-webhook ledger, queued jobs and backfill progress in (empty to keep them in memory)")
+var tokenKey = flag.String("tokenKey", "", "base64 AES-256 key used to encrypt stored access tokens (required with -db unless -tokenKeyFile is set)")
+var tokenKeyFile = flag.String("tokenKeyFile", "", "file of base64 AES-256 keys, one per line; the first encrypts, the rest are old keys being rotated out")
+var fakeApis = flag.Bool("fakeApis", false, "serve fake Uber and Mondo APIs on local ports and use them instead of the real ones, for development")
+var fakeFixturesFile = flag.String("fakeFixtures", "", "JSON file of trips, accounts and transactions to start the fake APIs with")
+var shutdownTimeout = flag.Duration("shutdownTimeout", 30*time.Second, "how long to wait on shutdown for in-flight requests and queued jobs to finish")
+var webhookLogFile = flag.String("webhookLog", "", "file to record inbound webhooks, and the API calls made for them, to as JSON lines for replay (empty to not record)")
 
 var indexTemplate = template.Must(template.ParseFiles("index.html"))
 var pleaseWaitTemplate = template.Must(template.ParseFiles("pleasewait.html"))
 var loginSuccessTemplate = template.Must(template.ParseFiles("loginsuccess.html"))
+var accountPickerTemplate = template.Must(template.ParseFiles("accountpicker.html"))
 
-var sessions = make(map[string]*session)
+var sessions SessionStore
+var reviews ReviewStore
+var ledger Ledger
+var jobStore JobStore
+var backfills BackfillStore
+var jobs *jobQueue
+var mapStore MapStore
+var maps MapProvider
+var tileMaps *tileMapProvider
+var images *imageProxy
 var router = mux.NewRouter()
 var uberApiClient *UberApiClient
 var mondoApiClient *MondoApiClient
+var mondoWebhookAllowlist ipAllowlist
 
 func indexGet(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -59,15 +135,6 @@ func indexGet(w http.ResponseWriter, r *http.Request) {
 }
 
 func loginPost(w http.ResponseWriter, r *http.Request) {
-	mondoAccessToken := r.FormValue("mondo-access-token")
-	mondoAccountId := r.FormValue("mondo-account-id")
-
-	if mondoAccessToken == "" || mondoAccountId == "" {
-		http.Error(w, "required: mondo-access-token, mondo-account-id", http.StatusBadRequest)
-		log.Printf("%s required: mondo-access-token, mondo-account-id", Login)
-		return
-	}
-
 	// Register session
 	uuid, err := uuid.NewV4()
 	if err != nil {
@@ -76,80 +143,289 @@ func loginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	oauthState, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s generate oauth state error: %s", Login, err.Error())
+		return
+	}
+
 	sessionId := uuid.String()
 	session := &session{
-		sessionId:        sessionId,
-		mondoAccessToken: mondoAccessToken,
-		mondoAccountId:   mondoAccountId}
+		sessionId:   sessionId,
+		oauthState:  oauthState,
+		loginExpiry: time.Now().Add(loginTimeout)}
+
+	err = sessions.Put(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s save session error: %s", Login, err.Error())
+		return
+	}
+
+	redirectUri, err := callbackUrl(MondoSetAuthCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s error: %s", Login, err.Error())
+		return
+	}
+
+	mondoAuthorizeUrl := fmt.Sprintf("%s/?%s", *mondoAuthHost, url.Values{
+		"client_id":     {*mondoClientId},
+		"redirect_uri":  {redirectUri},
+		"response_type": {"code"},
+		"state":         {session.oauthStateParam()},
+	}.Encode())
+	log.Printf("%s started login for session %s", Login, sessionId)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct{ RedirectUrl string }{RedirectUrl: mondoAuthorizeUrl}
+	pleaseWaitTemplate.Execute(w, data)
+}
+
+func mondoSetAuthCodeGet(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromOAuthState(w, r.FormValue("state"), MondoSetAuthCode, false)
+	if !ok {
+		return
+	}
+
+	mondoAuthorizationCode := r.FormValue("code")
+	if mondoAuthorizationCode == "" {
+		http.Error(w, "required: code", http.StatusBadRequest)
+		log.Printf("%s required: code", MondoSetAuthCode)
+		return
+	}
+
+	redirectUri, err := callbackUrl(MondoSetAuthCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s error: %s", MondoSetAuthCode, err.Error())
+		return
+	}
+
+	mondoTokenResponse, err := mondoApiClient.GetOAuthTokenContext(r.Context(), mondoAuthorizationCode, redirectUri)
+	if err != nil {
+		writeAPIError(w, err)
+		log.Printf("%s mondo oauth token error: %s", MondoSetAuthCode, err.Error())
+		return
+	}
+
+	s.mondoAccessToken = mondoTokenResponse.AccessToken
+	s.mondoRefreshToken = mondoTokenResponse.RefreshToken
+	s.mondoTokenExpiry = expiryTime(mondoTokenResponse.ExpiresIn)
+	log.Printf("%s assigned session id=%s Mondo access_token\n", MondoSetAuthCode, s.sessionId)
+
+	err = sessions.Update(s.sessionId, func(stored *session) error {
+		stored.mondoAccessToken, stored.mondoRefreshToken, stored.mondoTokenExpiry = s.mondoAccessToken, s.mondoRefreshToken, s.mondoTokenExpiry
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s save session error: %s", MondoSetAuthCode, err.Error())
+		return
+	}
+
+	mondoAccountsResponse, err := mondoApiClient.ListAccountsContext(r.Context(), s.mondoToken())
+	if err != nil {
+		writeAPIError(w, err)
+		log.Printf("%s list accounts error: %s", MondoSetAuthCode, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		State    string
+		Accounts []MondoAccount
+	}{State: s.oauthStateParam(), Accounts: mondoAccountsResponse.Accounts}
+	accountPickerTemplate.Execute(w, data)
+}
+
+func selectAccountPost(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromOAuthState(w, r.FormValue("state"), SelectAccount, false)
+	if !ok {
+		return
+	}
+
+	mondoAccountId := r.FormValue("mondo-account-id")
+	if mondoAccountId == "" {
+		http.Error(w, "required: mondo-account-id", http.StatusBadRequest)
+		log.Printf("%s required: mondo-account-id", SelectAccount)
+		return
+	}
+
+	// Only accept one of the user's own accounts
+	mondoAccountsResponse, err := mondoApiClient.ListAccountsContext(r.Context(), s.mondoToken())
+	if err != nil {
+		writeAPIError(w, err)
+		log.Printf("%s list accounts error: %s", SelectAccount, err.Error())
+		return
+	}
+	found := false
+	for _, account := range mondoAccountsResponse.Accounts {
+		found = found || account.Id == mondoAccountId
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("No such account %s", mondoAccountId), http.StatusBadRequest)
+		log.Printf("%s no such account %s", SelectAccount, mondoAccountId)
+		return
+	}
 
-	sessions[sessionId] = session
+	s.mondoAccountId = mondoAccountId
+	err = sessions.Update(s.sessionId, func(stored *session) error {
+		stored.mondoAccountId = mondoAccountId
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s save session error: %s", SelectAccount, err.Error())
+		return
+	}
 
-	uberAuthorizeUrl := fmt.Sprintf("%s/oauth/authorize?response_type=code&scope=history request request_receipt&client_id=%s&state=%s", UberAuthHost, *uberClientId, sessionId)
-	log.Printf("redirecting to %s", uberAuthorizeUrl)
+	uberAuthorizeUrl := fmt.Sprintf("%s/oauth/authorize?%s", *uberAuthHost, url.Values{
+		"response_type": {"code"},
+		"scope":         {"profile history request request_receipt"},
+		"client_id":     {*uberClientId},
+		"state":         {s.oauthStateParam()},
+	}.Encode())
+	log.Printf("%s session %s picked account %s", SelectAccount, s.sessionId, mondoAccountId)
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	data := struct{ UberAuthorizeUrl string }{UberAuthorizeUrl: uberAuthorizeUrl}
+	data := struct{ RedirectUrl string }{RedirectUrl: uberAuthorizeUrl}
 	pleaseWaitTemplate.Execute(w, data)
 }
 
 func uberSetAuthCodeGet(w http.ResponseWriter, r *http.Request) {
-	sessionId := r.URL.Query()["state"][0]
-	session, exists := sessions[sessionId]
-	if !exists {
-		http.Error(w, fmt.Sprintf("No such session %s", sessionId), http.StatusNotFound)
+	s, ok := sessionFromOAuthState(w, r.FormValue("state"), SetAuthCode, true)
+	if !ok {
 		return
 	}
+	sessionId := s.sessionId
 
-	redirectUriPath, err := router.Get(SetAuthCode).URLPath()
+	redirectUri, err := callbackUrl(SetAuthCode)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Printf("%s error: %s", SetAuthCode, err.Error())
 		return
 	}
-	redirectUri := fmt.Sprintf("%s%s", *httpsUrl, redirectUriPath)
 
-	uberAuthorizationCode := r.URL.Query()["code"][0]
-	uberTokenResponse, err := uberApiClient.GetOAuthToken(uberAuthorizationCode, redirectUri)
+	uberAuthorizationCode := r.FormValue("code")
+	if uberAuthorizationCode == "" {
+		http.Error(w, "required: code", http.StatusBadRequest)
+		log.Printf("%s required: code", SetAuthCode)
+		return
+	}
+	uberTokenResponse, err := uberApiClient.GetOAuthTokenContext(r.Context(), uberAuthorizationCode, redirectUri)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeAPIError(w, err)
 		log.Printf("%s uber oauth token error: %s", SetAuthCode, err.Error())
 		return
 	}
 
-	session.uberAccessToken = uberTokenResponse.AccessToken
-	log.Printf("%s assigned session id=%s Uber access_token=%s\n", SetAuthCode, sessionId, uberTokenResponse.AccessToken)
+	s.uberAccessToken = uberTokenResponse.AccessToken
+	s.uberRefreshToken = uberTokenResponse.RefreshToken
+	s.uberTokenExpiry = expiryTime(uberTokenResponse.ExpiresIn)
+	log.Printf("%s assigned session id=%s Uber access_token\n", SetAuthCode, sessionId)
 
-	// Register Mondo webhook
-	mondoWebhookPath, err := router.Get(MondoWebhook).URLPath("sessionId", sessionId)
+	// Remember who the Uber user is so their receipt webhooks can be routed here
+	uberMeResponse, err := uberApiClient.GetMeContext(r.Context(), s.uberToken())
+	if err != nil {
+		writeAPIError(w, err)
+		log.Printf("%s get uber user error: %s", SetAuthCode, err.Error())
+		return
+	}
+	s.uberUserId = uberMeResponse.Uuid
+
+	// Register Mondo webhook, with a secret in the URL so we know it's from Mondo
+	s.mondoWebhookSecret, err = randomToken()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("%s error: %s", SetAuthCode, err.Error())
+		log.Printf("%s generate webhook secret error: %s", SetAuthCode, err.Error())
 		return
 	}
-	mondoWebhookUrl := fmt.Sprintf("%s%s", *httpUrl, mondoWebhookPath)
-	log.Printf("%s registering mondo webhook url=%s", SetAuthCode, mondoWebhookUrl)
-	mondoWebhookResponse, err := mondoApiClient.RegisterWebHook(session.mondoAccessToken, session.mondoAccountId, mondoWebhookUrl)
+	// Over HTTPS, so the secret can't be read in transit
+	mondoWebhookUrl, err := callbackUrl(MondoWebhook, "sessionId", sessionId, "secret", s.mondoWebhookSecret)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s error: %s", SetAuthCode, err.Error())
+		return
+	}
+	log.Printf("%s registering mondo webhook for session id=%s", SetAuthCode, sessionId)
+	mondoWebhookResponse, err := mondoApiClient.RegisterWebHookContext(r.Context(), s.mondoToken(), s.mondoAccountId, mondoWebhookUrl)
+	if err != nil {
+		writeAPIError(w, err)
 		log.Printf("%s register mondo webhook error: %s", SetAuthCode, err.Error())
 		return
 	}
 
-	session.mondoWebhookId = mondoWebhookResponse.Webhook.Id
+	s.mondoWebhookId = mondoWebhookResponse.Webhook.Id
 	log.Printf("%s successfully registered mondo webhook id=%s", SetAuthCode, mondoWebhookResponse.Webhook.Id)
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	data := struct {
-		SessionId string
-		WebhookId string
-	}{SessionId: sessionId, WebhookId: session.mondoWebhookId}
-	loginSuccessTemplate.Execute(w, data)
+	err = sessions.Update(sessionId, func(stored *session) error {
+		stored.uberAccessToken, stored.uberRefreshToken, stored.uberTokenExpiry = s.uberAccessToken, s.uberRefreshToken, s.uberTokenExpiry
+		stored.uberUserId = s.uberUserId
+		stored.mondoWebhookSecret, stored.mondoWebhookId = s.mondoWebhookSecret, s.mondoWebhookId
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s save session error: %s", SetAuthCode, err.Error())
+		return
+	}
+	supersedeSessions(r.Context(), s)
+
+	writeLoginSuccess(w, s, "")
+}
+
+// supersedeSessions deletes the Uber user's sessions from before s, so their
+// receipt webhooks only go to the newest login, and unregisters the earlier
+// sessions' Mondo webhooks. It's best effort: failures are only logged.
+func supersedeSessions(ctx context.Context, s *session) {
+	earlier, err := sessions.ListByUberUserId(s.uberUserId)
+	if err != nil {
+		log.Printf("%s list sessions error: %s", SetAuthCode, err.Error())
+		return
+	}
+	for _, other := range earlier {
+		if other.sessionId == s.sessionId {
+			continue
+		}
+		err := mondoApiClient.UnregisterWebHookContext(ctx, other.mondoToken(), other.mondoWebhookId)
+		if err != nil {
+			log.Printf("%s unregister superseded webhook %s error: %s", SetAuthCode, other.mondoWebhookId, err.Error())
+		}
+		if err := sessions.Delete(other.sessionId); err != nil {
+			log.Printf("%s delete superseded session error: %s", SetAuthCode, err.Error())
+			continue
+		}
+		if err := backfills.Delete(other.sessionId); err != nil {
+			log.Printf("%s delete superseded backfill error: %s", SetAuthCode, err.Error())
+		}
+		log.Printf("%s session id=%s superseded session id=%s", SetAuthCode, s.sessionId, other.sessionId)
+	}
 }
 
 func mondoWebhookPost(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	vars := mux.Vars(r)
+	sessionId := vars["sessionId"]
+	session, err := sessions.Get(sessionId)
+	if err != nil && err != ErrNoSuchSession {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s load session error: %s", MondoWebhook, err.Error())
+		return
+	}
+
+	// An unknown session is rejected just like a wrong secret, so that
+	// webhook URLs can't be used to find out which sessions exist
+	err = verifyMondoWebhook(r, session, vars["secret"])
+	if err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		log.Printf("%s rejected webhook for session %s: %s", MondoWebhook, sessionId, err.Error())
+		return
+	}
+
 	var request = &WebhookRequest{}
-	err := json.NewDecoder(r.Body).Decode(request)
+	err = json.NewDecoder(r.Body).Decode(request)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Printf("%s json parse error: %s", MondoWebhook, err.Error())
@@ -161,127 +437,906 @@ func mondoWebhookPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vars := mux.Vars(r)
-	sessionId := vars["sessionId"]
-	session, exists := sessions[sessionId]
-	if !exists {
-		http.Error(w, fmt.Sprintf("No such session %s", sessionId), http.StatusNotFound)
+	key := transactionKey(request.Data.Id)
+	claimed, err := ledger.Claim(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s ledger claim error: %s", MondoWebhook, err.Error())
+		return
+	}
+	if !claimed {
+		log.Printf("%s duplicate delivery of transaction %s", MondoWebhook, request.Data.Id)
 		return
 	}
 
-	uberHistoryResponse, err := uberApiClient.GetHistory(session.uberAccessToken)
+	// Recorded as queued before the job exists, so this can't overwrite the
+	// entry of a job that has already finished
+	transaction := request.Data
+	err = ledger.Complete(key, &ledgerEntry{Status: ledgerQueued, TransactionId: transaction.Id, SessionId: sessionId})
+	if err == nil {
+		err = jobs.Enqueue(&job{Type: transactionJob, SessionId: sessionId, Transaction: &transaction})
+	}
 	if err != nil {
+		if releaseErr := ledger.Release(key); releaseErr != nil {
+			log.Printf("%s ledger release error: %s", MondoWebhook, releaseErr.Error())
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("%s get history error: %s", SetAuthCode, err.Error())
+		log.Printf("%s queue error: %s", MondoWebhook, err.Error())
+		return
+	}
+}
+
+// The largest webhook body read. Webhooks are small, and are read before
+// they're authenticated.
+const maxWebhookBody = 1 << 20
+
+func uberWebhookPost(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("%s read error: %s", UberWebhook, err.Error())
+		return
+	}
+
+	if !uberApiClient.VerifyWebhookSignature(body, r.Header.Get(UberSignature)) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		log.Printf("%s invalid signature from %s", UberWebhook, r.RemoteAddr)
 		return
 	}
 
-	uberHistoryItem := uberHistoryResponse.History[0]
-	requestId := uberHistoryItem.RequestId
-	uberReceiptResponse, err := uberApiClient.GetReceipt(session.uberAccessToken, requestId)
+	var event = &UberWebhookEvent{}
+	err = json.Unmarshal(body, event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("%s json parse error: %s", UberWebhook, err.Error())
+		return
+	}
+
+	if event.EventType != ReceiptReadyEvent {
+		log.Printf("%s ignored event %s type %s", UberWebhook, event.EventId, event.EventType)
+		return
+	}
+
+	session, err := sessions.FindByUberUserId(event.Meta.UserId)
+	if err == ErrNoSuchSession {
+		// Not one of ours any more, e.g. the user logged out
+		log.Printf("%s no session for Uber user %s", UberWebhook, event.Meta.UserId)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("%s get receipt error: %s", SetAuthCode, err.Error())
+		log.Printf("%s find session error: %s", UberWebhook, err.Error())
+		return
+	}
+
+	requestId := event.Meta.ResourceId
+	if _, err := ledger.Get(tripKey(requestId)); err == nil {
+		log.Printf("%s trip %s already published", UberWebhook, requestId)
 		return
 	}
 
-	uberRequestResponse, err := uberApiClient.GetRequest(session.uberAccessToken, requestId)
+	log.Printf("%s receipt ready for trip %s session %s", UberWebhook, requestId, session.sessionId)
+	err = jobs.Enqueue(&job{Type: receiptReadyJob, SessionId: session.sessionId, RequestId: requestId})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("%s get request error: %s", SetAuthCode, err.Error())
+		log.Printf("%s enqueue error: %s", UberWebhook, err.Error())
 		return
 	}
+}
 
-	start := coordinate{
-		Latitude:  uberHistoryItem.StartCity.Latitude,
-		Longitude: uberHistoryItem.StartCity.Longitude,
+func logoutPost(w http.ResponseWriter, r *http.Request) {
+	sessionId := r.FormValue("session-id")
+	session, ok := getSession(w, sessionId, Logout)
+	if !ok {
+		return
 	}
 
-	end := coordinate{
-		Latitude:  uberRequestResponse.Location.Latitude,
-		Longitude: uberRequestResponse.Location.Longitude,
+	err := mondoApiClient.UnregisterWebHookContext(r.Context(), session.mondoToken(), session.mondoWebhookId)
+	if IsNotFound(err) || IsUnauthorized(err) {
+		// The webhook or our access to the account is already gone, so
+		// there's nothing stopping the session from being deleted.
+		log.Printf("%s webhook %s already unregistered: %s", Logout, session.mondoWebhookId, err.Error())
+	} else if err != nil {
+		writeAPIError(w, err)
+		log.Printf("%s unregister webhook error: %s", Logout, err.Error())
+		return
 	}
 
-	feedItemImageUrl := googleMapsUrl(start, end, *googleMapsApiKey)
+	err = sessions.Delete(sessionId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s delete session error: %s", Logout, err.Error())
+		return
+	}
+	if err := backfills.Delete(sessionId); err != nil {
+		log.Printf("%s delete backfill error: %s", Logout, err.Error())
+	}
 
-	feedItemTitle := fmt.Sprintf("%s %s", uberReceiptResponse.TotalCharged, uberHistoryItem.StartCity.DisplayName)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTemplate.Execute(w, r.Host)
+}
 
-	err = mondoApiClient.CreateFeedItem(
-		session.mondoAccessToken,
-		session.mondoAccountId,
-		"image",
-		fmt.Sprintf("Uber Receipt %s", randomCarEmoji()),
-		feedItemImageUrl,
-		feedItemTitle)
+func templatesPost(w http.ResponseWriter, r *http.Request) {
+	sessionId := r.FormValue("session-id")
+	s, ok := getLoggedInSession(w, sessionId, Templates)
+	if !ok {
+		return
+	}
 
+	// Store the defaults as empty, so the user gets any later changes to them
+	s.feedTitleTemplate = strings.TrimSpace(r.FormValue("title-template"))
+	if s.feedTitleTemplate == defaultTitleTemplate {
+		s.feedTitleTemplate = ""
+	}
+	s.feedBodyTemplate = strings.TrimSpace(r.FormValue("body-template"))
+	if s.feedBodyTemplate == defaultBodyTemplate {
+		s.feedBodyTemplate = ""
+	}
+	err := validateFeedTemplates(s.feedTitleTemplate, s.feedBodyTemplate)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeLoginSuccess(w, s, err.Error())
+		return
+	}
+
+	// Only save the templates, in case a job has refreshed a token meanwhile
+	err = sessions.Update(sessionId, func(stored *session) error {
+		stored.feedTitleTemplate, stored.feedBodyTemplate = s.feedTitleTemplate, s.feedBodyTemplate
+		return nil
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("%s create feed item error: %s", SetAuthCode, err.Error())
+		log.Printf("%s save session error: %s", Templates, err.Error())
 		return
 	}
+	log.Printf("%s saved feed templates for session %s", Templates, sessionId)
+	writeLoginSuccess(w, s, "")
 }
 
-func logoutPost(w http.ResponseWriter, r *http.Request) {
+// templatePreviewPost renders title and body templates against a sample trip,
+// returning {"title", "body"} or a 400 with the template error.
+func templatePreviewPost(w http.ResponseWriter, r *http.Request) {
+	// Rendering templates takes some work, so only users get to
+	if _, ok := getLoggedInSession(w, r.FormValue("session-id"), TemplatePreview); !ok {
+		return
+	}
+
+	title, body, err := renderFeedTemplates(r.FormValue("title-template"), r.FormValue("body-template"), sampleFeedTemplateData())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set(ContentType, "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	}{Title: title, Body: body})
+}
+
+func backfillPost(w http.ResponseWriter, r *http.Request) {
 	sessionId := r.FormValue("session-id")
-	session, exists := sessions[sessionId]
-	if !exists {
-		http.Error(w, fmt.Sprintf("No such session %s", sessionId), http.StatusNotFound)
+	session, ok := getSession(w, sessionId, Backfill)
+	if !ok {
+		return
+	}
+
+	since, until, err := parseBackfillRange(r.FormValue("since"), r.FormValue("until"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeLoginSuccess(w, session, err.Error())
+		return
+	}
+
+	_, err = startBackfill(sessionId, since, until)
+	if err == ErrBackfillRunning {
+		w.WriteHeader(http.StatusConflict)
+		writeLoginSuccess(w, session, err.Error())
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s start error: %s", Backfill, err.Error())
+		return
+	}
+	log.Printf("%s started backfill of session %s from %s to %s", Backfill, sessionId, since.Format(dateLayout), until.Format(dateLayout))
+	writeLoginSuccess(w, session, "")
+}
+
+// backfillProgressPost returns the session's latest backfillProgress as JSON.
+func backfillProgressPost(w http.ResponseWriter, r *http.Request) {
+	sessionId := r.FormValue("session-id")
+	if _, ok := getSession(w, sessionId, BackfillProgress); !ok {
+		return
+	}
+
+	progress, err := backfills.Get(sessionId)
+	if err == ErrNoSuchBackfill {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s error: %s", BackfillProgress, err.Error())
+		return
+	}
+
+	w.Header().Set(ContentType, ApplicationJson)
+	json.NewEncoder(w).Encode(progress)
+}
+
+// reviewPost resolves a transaction that needed review, either attaching the
+// candidate trip the user picked as request-id or, with dismiss set,
+// dismissing it.
+func reviewPost(w http.ResponseWriter, r *http.Request) {
+	sessionId := r.FormValue("session-id")
+	session, ok := getSession(w, sessionId, Reviews)
+	if !ok {
+		return
+	}
+
+	items, err := sessionReviews(sessionId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s list error: %s", Reviews, err.Error())
+		return
+	}
+	var item *reviewItem
+	for _, candidate := range items {
+		if candidate.TransactionId == r.FormValue("transaction-id") {
+			item = candidate
+		}
+	}
+	if item == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if item.Picked != "" {
+		w.WriteHeader(http.StatusConflict)
+		writeLoginSuccess(w, session, ErrReviewPicked.Error())
+		return
+	}
+
+	if r.FormValue("dismiss") != "" {
+		if err := reviews.Delete(item.TransactionId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("%s delete error: %s", Reviews, err.Error())
+			return
+		}
+		log.Printf("%s session %s dismissed transaction %s", Reviews, sessionId, item.TransactionId)
+		writeLoginSuccess(w, session, "")
+		return
+	}
+
+	requestId := r.FormValue("request-id")
+	found := false
+	for _, candidate := range item.Candidates {
+		found = found || candidate.RequestId == requestId
+	}
+	if !found {
+		w.WriteHeader(http.StatusBadRequest)
+		writeLoginSuccess(w, session, fmt.Sprintf("Trip %s isn't a candidate for that transaction", requestId))
+		return
+	}
+	// Marked as picked first, so a double submit can't queue a second job
+	err = reviews.Pick(item.TransactionId, requestId)
+	if err == ErrReviewPicked || err == ErrNoSuchReview {
+		w.WriteHeader(http.StatusConflict)
+		writeLoginSuccess(w, session, err.Error())
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s pick error: %s", Reviews, err.Error())
+		return
+	}
+	transaction := item.Transaction
+	err = jobs.Enqueue(&job{Type: reviewedJob, SessionId: sessionId, Transaction: &transaction, RequestId: requestId})
+	if err != nil {
+		if unpickErr := reviews.Pick(item.TransactionId, ""); unpickErr != nil {
+			log.Printf("%s unpick error: %s", Reviews, unpickErr.Error())
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s enqueue error: %s", Reviews, err.Error())
 		return
 	}
+	log.Printf("%s session %s picked trip %s for transaction %s", Reviews, sessionId, requestId, item.TransactionId)
+	writeLoginSuccess(w, session, "")
+}
 
-	err := mondoApiClient.UnregisterWebHook(session.mondoAccessToken, session.mondoWebhookId)
+// sessionReviews returns the transactions of a session that need review.
+func sessionReviews(sessionId string) ([]*reviewItem, error) {
+	items, err := reviews.List()
+	if err != nil {
+		return nil, err
+	}
+	var own []*reviewItem
+	for _, item := range items {
+		if item.SessionId == sessionId {
+			own = append(own, item)
+		}
+	}
+	return own, nil
+}
 
+func mapGet(w http.ResponseWriter, r *http.Request) {
+	mapId := mux.Vars(r)["id"]
+	image, err := tileMaps.Render(mapId)
+	if err == ErrNoSuchMap {
+		http.NotFound(w, r)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("%s create feed item error: %s", Logout, err.Error())
+		log.Printf("%s render %s error: %s", MapImage, mapId, err.Error())
+		return
+	}
+
+	w.Header().Set(ContentType, "image/png")
+	w.Write(image)
+}
+
+func imageProxyGet(w http.ResponseWriter, r *http.Request) {
+	target, expiry, err := images.Verify(r.URL.Query())
+	if err == ErrImageUrlExpired {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		log.Printf("%s error: %s", ImageProxy, err.Error())
 		return
 	}
 
+	image, err := images.Fetch(r.Context(), target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		log.Printf("%s fetch error: %s", ImageProxy, err.Error())
+		return
+	}
+	serveImage(w, r, image, expiry)
+}
+
+// writeLoginSuccess writes the page shown once a session is set up, where the
+// user can edit their feed templates, backfill past transactions, resolve
+// transactions that need review or log out.
+// problem is shown at the top, if there is one.
+func writeLoginSuccess(w http.ResponseWriter, session *session, problem string) {
+	titleTemplate, bodyTemplate := session.feedTitleTemplate, session.feedBodyTemplate
+	if titleTemplate == "" {
+		titleTemplate = defaultTitleTemplate
+	}
+	if bodyTemplate == "" {
+		bodyTemplate = defaultBodyTemplate
+	}
+
+	backfill, err := backfills.Get(session.sessionId)
+	if err != nil && err != ErrNoSuchBackfill {
+		log.Printf("Session %s load backfill error: %s", session.sessionId, err.Error())
+	}
+	reviewItems, err := sessionReviews(session.sessionId)
+	if err != nil {
+		log.Printf("Session %s load reviews error: %s", session.sessionId, err.Error())
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	indexTemplate.Execute(w, r.Host)
+	data := struct {
+		SessionId     string
+		WebhookId     string
+		TitleTemplate string
+		BodyTemplate  string
+		Backfill      *backfillProgress
+		Reviews       []*reviewItem
+		Today         string
+		Problem       string
+	}{
+		SessionId:     session.sessionId,
+		WebhookId:     session.mondoWebhookId,
+		TitleTemplate: titleTemplate,
+		BodyTemplate:  bodyTemplate,
+		Backfill:      backfill,
+		Reviews:       reviewItems,
+		Today:         time.Now().UTC().Format(dateLayout),
+		Problem:       problem,
+	}
+	loginSuccessTemplate.Execute(w, data)
+}
+
+// mondoToken returns the session's Mondo token. If the API client refreshes
+// it, the new token is saved back to the session store.
+func (s *session) mondoToken() *OAuthToken {
+	return s.token(mondoProvider, func(s *session) (*string, *string, *time.Time) {
+		return &s.mondoAccessToken, &s.mondoRefreshToken, &s.mondoTokenExpiry
+	})
+}
+
+// uberToken returns the session's Uber token. If the API client refreshes it,
+// the new token is saved back to the session store.
+func (s *session) uberToken() *OAuthToken {
+	return s.token(uberProvider, func(s *session) (*string, *string, *time.Time) {
+		return &s.uberAccessToken, &s.uberRefreshToken, &s.uberTokenExpiry
+	})
+}
+
+// tokenRefreshes stops jobs for the same session refreshing a token at once.
+// With rotating refresh tokens all but one would be left with revoked ones.
+var tokenRefreshes refreshLocks
+
+// token returns one of the session's tokens, whose fields are picked out by
+// fields. Refreshes are serialised per session, and a job that waited picks
+// up the token the first one refreshed rather than refreshing it again. Only
+// the token's fields are saved, so other changes to the session aren't lost.
+func (s *session) token(provider string, fields func(s *session) (accessToken, refreshToken *string, expiry *time.Time)) *OAuthToken {
+	accessToken, refreshToken, expiry := fields(s)
+	return &OAuthToken{
+		AccessToken:  *accessToken,
+		RefreshToken: *refreshToken,
+		Expiry:       *expiry,
+		Serialize: func(token *OAuthToken, refresh func() error) error {
+			defer tokenRefreshes.lock(provider + " " + s.sessionId)()
+			latest, err := sessions.Get(s.sessionId)
+			if err != nil {
+				return err
+			}
+			latestAccessToken, latestRefreshToken, latestExpiry := fields(latest)
+			if *latestAccessToken == token.AccessToken {
+				return refresh()
+			}
+			// Another job refreshed it while this one waited
+			token.AccessToken, token.RefreshToken, token.Expiry = *latestAccessToken, *latestRefreshToken, *latestExpiry
+			*accessToken, *refreshToken, *expiry = token.AccessToken, token.RefreshToken, token.Expiry
+			return nil
+		},
+		Refreshed: func(token *OAuthToken) error {
+			*accessToken, *refreshToken, *expiry = token.AccessToken, token.RefreshToken, token.Expiry
+			return sessions.Update(s.sessionId, func(stored *session) error {
+				storedAccessToken, storedRefreshToken, storedExpiry := fields(stored)
+				*storedAccessToken, *storedRefreshToken, *storedExpiry = token.AccessToken, token.RefreshToken, token.Expiry
+				return nil
+			})
+		},
+	}
+}
+
+// oauthStateParam returns the state parameter for the session's OAuth
+// redirects: the session id plus a random secret the callback must echo.
+func (s *session) oauthStateParam() string {
+	return s.sessionId + "." + s.oauthState
+}
+
+// How long a user has to finish logging in before their session is deleted
+const loginTimeout = time.Hour
+
+var errInvalidOAuthState = errors.New("invalid state")
+
+// sessionFromOAuthState loads the session named by an OAuth state parameter,
+// writing an error response if it doesn't exist, the secret doesn't match or
+// the login has expired. Each state can only be used once: the secret is
+// replaced by a new one for the next step of the login, or cleared if final
+// is set.
+func sessionFromOAuthState(w http.ResponseWriter, state, route string, final bool) (*session, bool) {
+	parts := strings.SplitN(state, ".", 2)
+	if len(parts) != 2 {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		log.Printf("%s malformed state", route)
+		return nil, false
+	}
+
+	next := ""
+	if !final {
+		var err error
+		next, err = randomToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("%s generate oauth state error: %s", route, err.Error())
+			return nil, false
+		}
+	}
+
+	// Checked and replaced in one update, so two requests can't both use it
+	var used session
+	err := sessions.Update(parts[0], func(s *session) error {
+		if s.oauthState == "" || s.loginExpired(time.Now()) || subtle.ConstantTimeCompare([]byte(parts[1]), []byte(s.oauthState)) != 1 {
+			return errInvalidOAuthState
+		}
+		s.oauthState = next
+		used = *s
+		return nil
+	})
+	if err == errInvalidOAuthState || err == ErrNoSuchSession {
+		// The same response either way, so states can't be used to find sessions
+		http.Error(w, "invalid state", http.StatusForbidden)
+		log.Printf("%s state rejected: %s", route, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s load session error: %s", route, err.Error())
+		return nil, false
+	}
+	return &used, true
+}
+
+// callbackUrl returns the public URL of a route, e.g. an OAuth redirect.
+func callbackUrl(route string, pairs ...string) (string, error) {
+	path, err := router.Get(route).URLPath(pairs...)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s", *httpsUrl, path), nil
+}
+
+// randomToken returns 128 random bits, hex encoded.
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// getSession loads a session from the store, writing a 404 or 500 response if
+// it can't.
+func getSession(w http.ResponseWriter, sessionId, route string) (*session, bool) {
+	session, err := sessions.Get(sessionId)
+	if err == ErrNoSuchSession {
+		http.Error(w, fmt.Sprintf("No such session %s", sessionId), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("%s load session error: %s", route, err.Error())
+		return nil, false
+	}
+	return session, true
+}
+
+// getLoggedInSession is getSession for routes only for users who finished
+// logging in.
+func getLoggedInSession(w http.ResponseWriter, sessionId, route string) (*session, bool) {
+	session, ok := getSession(w, sessionId, route)
+	if ok && session.mondoWebhookId == "" {
+		http.Error(w, fmt.Sprintf("No such session %s", sessionId), http.StatusNotFound)
+		return nil, false
+	}
+	return session, ok
+}
+
+// openStores sets up the session, review, ledger, job, backfill and map stores, in a
+// BoltDB file if -db is set or otherwise in memory.
+func openStores() error {
+	if *dbFile == "" {
+		log.Printf("Keeping sessions in memory\n")
+		sessions = newMemorySessionStore()
+		reviews = newMemoryReviewStore()
+		ledger = newMemoryLedger()
+		jobStore = newMemoryJobStore()
+		backfills = newMemoryBackfillStore()
+		mapStore = newMemoryMapStore()
+		return nil
+	}
+
+	cipher, err := loadTokenCipher(*tokenKey, *tokenKeyFile)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Opening session database %s\n", *dbFile)
+	db, err := bolt.Open(*dbFile, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+
+	sessionStore, err := newBoltSessionStore(db, cipher)
+	if err != nil {
+		return err
+	}
+
+	rotated, err := sessionStore.RotateKeys()
+	if err != nil {
+		return err
+	}
+	log.Printf("Re-encrypted tokens in %d sessions with key %s\n", rotated, cipher.primaryKeyId)
+
+	reviews, err = newBoltReviewStore(db)
+	if err != nil {
+		return err
+	}
+
+	ledger, err = newBoltLedger(db)
+	if err != nil {
+		return err
+	}
+
+	jobStore, err = newBoltJobStore(db)
+	if err != nil {
+		return err
+	}
+
+	backfills, err = newBoltBackfillStore(db)
+	if err != nil {
+		return err
+	}
+
+	mapStore, err = newBoltMapStore(db)
+	if err != nil {
+		return err
+	}
+
+	sessions = sessionStore
+	return nil
+}
+
+// openMapProvider renders maps from local tiles if -mapTiles or -mapMbtiles
+// is set, or otherwise links to Google Static Maps.
+func openMapProvider() error {
+	var tiles tileSources
+	if *mapTilesDir != "" {
+		log.Printf("Rendering maps from tiles in %s\n", *mapTilesDir)
+		tiles = append(tiles, &tileDirectory{dir: *mapTilesDir})
+	}
+	if *mapMbtilesFile != "" {
+		log.Printf("Rendering maps from %s\n", *mapMbtilesFile)
+		source, err := openMbtiles(*mapMbtilesFile)
+		if err != nil {
+			return err
+		}
+		tiles = append(tiles, source)
+	}
+
+	if len(tiles) == 0 && *googleMapsApiKey != "" {
+		maps = &googleMapsProvider{apiKey: *googleMapsApiKey}
+		return nil
+	}
+	if len(tiles) == 0 {
+		log.Printf("No map tiles or Google Maps API key, maps will be blank\n")
+	}
+
+	tileMaps = &tileMapProvider{
+		tiles: tiles,
+		store: mapStore,
+		url: func(mapId string) (string, error) {
+			return callbackUrl(MapImage, "id", mapId)
+		},
+	}
+	maps = tileMaps
+	return nil
+}
+
+// openImageProxy sets up the image proxy and its disk cache.
+func openImageProxy() error {
+	key := []byte(*imageProxyKey)
+	if len(key) == 0 {
+		log.Printf("No -imageProxyKey set, image URLs will stop working on restart\n")
+		random, err := randomToken()
+		if err != nil {
+			return err
+		}
+		key = []byte(random)
+	}
+
+	cache, err := openDiskCache(*imageCacheDir, *imageCacheSize<<20)
+	if err != nil {
+		return err
+	}
+
+	images = &imageProxy{
+		key:   key,
+		ttl:   *imageUrlTtl,
+		cache: cache,
+		endpoint: func() (string, error) {
+			return callbackUrl(ImageProxy)
+		},
+	}
+	return nil
+}
+
+// registerRoutes sets up the router. The map route only exists when maps are
+// rendered from local tiles.
+func registerRoutes() {
+	router.HandleFunc("/", indexGet).Methods("GET").Name(Index)
+	router.HandleFunc("/login", loginPost).Methods("POST").Name(Login)
+	router.HandleFunc("/logout", logoutPost).Methods("POST").Name(Logout)
+	router.HandleFunc("/uber/setauthcode", uberSetAuthCodeGet).Methods("GET").Name(SetAuthCode)
+	router.HandleFunc("/mondo/setauthcode", mondoSetAuthCodeGet).Methods("GET").Name(MondoSetAuthCode)
+	router.HandleFunc("/mondo/account", selectAccountPost).Methods("POST").Name(SelectAccount)
+	router.HandleFunc("/mondo/webhook/{sessionId}/{secret}", recordWebhook(MondoWebhook, mondoWebhookPost)).Methods("POST").Name(MondoWebhook)
+	router.HandleFunc("/uber/webhook", recordWebhook(UberWebhook, uberWebhookPost)).Methods("POST").Name(UberWebhook)
+	router.HandleFunc("/uber/webooks/requests.receipt_ready", recordWebhook(ReceiptReady, uberWebhookPost)).Methods("POST").Name(ReceiptReady)
+	router.HandleFunc("/templates", templatesPost).Methods("POST").Name(Templates)
+	router.HandleFunc("/templates/preview", templatePreviewPost).Methods("POST").Name(TemplatePreview)
+	router.HandleFunc("/backfill", backfillPost).Methods("POST").Name(Backfill)
+	router.HandleFunc("/backfill/progress", backfillProgressPost).Methods("POST").Name(BackfillProgress)
+	router.HandleFunc("/reviews", reviewPost).Methods("POST").Name(Reviews)
+	router.HandleFunc("/images/proxy", imageProxyGet).Methods("GET").Name(ImageProxy)
+	if tileMaps != nil {
+		router.HandleFunc("/maps/{id}.png", mapGet).Methods("GET").Name(MapImage)
+	}
+	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./")))
+}
+
+// Query parameters that are secrets, so aren't logged
+var secretParams = []string{"code", "state"}
+
+// Paths whose last segment is a secret, so isn't logged
+var secretPathPrefixes = []string{"/mondo/webhook/"}
+
+// redactedUrl returns a request's URL with its secrets replaced, for logging.
+func redactedUrl(u *url.URL) string {
+	redacted := *u
+	for _, prefix := range secretPathPrefixes {
+		last := strings.LastIndex(redacted.Path, "/")
+		if strings.HasPrefix(redacted.Path, prefix) && last >= len(prefix) {
+			redacted.Path = redacted.Path[:last+1] + "REDACTED"
+			redacted.RawPath = ""
+		}
+	}
+	query := redacted.Query()
+	for _, param := range secretParams {
+		if query.Get(param) != "" {
+			query.Set(param, "REDACTED")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
 }
 
 func middleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s\n", r.Method, r.URL)
+		log.Printf("%s %s\n", r.Method, redactedUrl(r.URL))
 		h.ServeHTTP(w, r)
 	})
 }
 
+// deleteExpiredLogins deletes the sessions of abandoned logins every interval
+// until ctx is done.
+func deleteExpiredLogins(ctx context.Context, interval time.Duration) {
+	for {
+		deleted, err := sessions.DeleteExpiredLogins(time.Now())
+		if err != nil {
+			log.Printf("Delete expired logins error: %s\n", err.Error())
+		} else if deleted > 0 {
+			log.Printf("Deleted %d expired logins\n", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
 func main() {
 	flag.Parse()
-	if *uberClientId == "" || *uberClientSecret == "" || *httpsUrl == "" || *httpUrl == "" || *googleMapsApiKey == "" {
-		flag.PrintDefaults()
-		return
+	err := loadConfig(flag.CommandLine, os.Getenv)
+	if err == nil {
+		err = validateConfig()
 	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\nRun with -h to list every setting.\n", err.Error())
+		os.Exit(2)
+	}
+	if *fakeApis {
+		if _, _, err := startFakeApis(*fakeFixturesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	httpClient = newApiHttpClient(apiTransportConfig{
+		Timeout:       *apiTimeout,
+		Retries:       *apiRetries,
+		BaseDelay:     500 * time.Millisecond,
+		MaxDelay:      10 * time.Second,
+		MaxRetryAfter: *apiMaxRetryAfter,
+		RateLimit:     *apiRateLimit,
+		Burst:         *apiBurst,
+	})
+
+	run := runJob
+	if *webhookLogFile != "" {
+		webhookLog, err = openWebhookLog(*webhookLogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer webhookLog.Close()
+		httpClient.Transport = webhookLog.Transport(httpClient.Transport)
+		run = webhookLog.recordJobs(run)
+	}
+
 	uberApiClient = &UberApiClient{
 		url:          *uberApiHost,
 		clientSecret: *uberClientSecret,
 		clientId:     *uberClientId,
+		authUrl:      *uberAuthHost,
 	}
 
-	mondoApiClient = &MondoApiClient{url: *mondoApiUrl}
+	mondoApiClient = &MondoApiClient{
+		url:          *mondoApiUrl,
+		clientSecret: *mondoClientSecret,
+		clientId:     *mondoClientId,
+	}
 
-	router.HandleFunc("/", indexGet).Methods("GET").Name(Index)
-	router.HandleFunc("/login", loginPost).Methods("POST").Name(Login)
-	router.HandleFunc("/logout", logoutPost).Methods("POST").Name(Logout)
-	router.HandleFunc("/uber/setauthcode", uberSetAuthCodeGet).Methods("GET").Name(SetAuthCode)
-	router.HandleFunc("/mondo/webhook/{sessionId}", mondoWebhookPost).Methods("POST").Name(MondoWebhook)
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./")))
+	err = openStores()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	go func() {
-		log.Printf("Listening on %s\n", *httpAddr)
-		log.Fatal(http.ListenAndServe(*httpAddr, middleware(router)))
-	}()
+	err = openMapProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = openImageProxy()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Printf("Listening on %s\n", *httpsAddr)
-	if strings.Contains(*httpsAddr, "443") {
-		log.Fatal(http.ListenAndServeTLS(*httpsAddr, *certFile, *keyFile, middleware(router)))
-	} else {
-		log.Fatal(http.ListenAndServe(*httpsAddr, middleware(router)))
+	mondoWebhookAllowlist, err = parseIpAllowlist(*mondoWebhookIps)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Jobs need the routes to build URLs
+	registerRoutes()
+
+	jobs = newJobQueue(jobStore, run, jobDeadLettered, *workers, *jobAttempts)
+
+	switch flag.Arg(0) {
+	case "backfill":
+		err = backfillCommand(context.Background(), flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+
+	case "replay":
+		jobs.Start()
+		err = replayCommand(context.Background(), flag.Args()[1:])
+		jobs.Stop()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+
+	case "deadletters":
+		err = deadLettersCommand(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	logDeadLetters()
+	jobs.Start()
+
+	// Requests' contexts derive from this, so any API calls still running
+	// after the shutdown timeout are cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	baseContext := func(net.Listener) context.Context { return ctx }
+	httpServer := &http.Server{Addr: *httpAddr, Handler: middleware(router), BaseContext: baseContext}
+	httpsServer := &http.Server{Addr: *httpsAddr, Handler: middleware(router), BaseContext: baseContext}
+	servers := []*supervisedServer{
+		{name: "HTTP", server: httpServer, serve: httpServer.ListenAndServe},
+		{name: "HTTPS", server: httpsServer, serve: httpsServer.ListenAndServe},
+	}
+	err = configureTls(servers[0], servers[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	go deleteExpiredLogins(signals, 10*time.Minute)
+	err = runServers(signals, servers, jobs.Drain, *shutdownTimeout)
+	cancel()
+	jobs.Stop()
+	if err != nil {
+		log.Fatal(err)
 	}
+	log.Printf("Stopped\n")
 }
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// redirect returns where the provider's authorize page a please wait page
+// points at sends the user back to, without following it.
+func (e *e2eEnv) redirect(t *testing.T, pleaseWait string) string {
+	authorizeUrl := pleaseWaitUrl(t, pleaseWait)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get(authorizeUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect from %s, got %s", authorizeUrl, response.Status)
+	}
+	return response.Header.Get("Location")
+}
+
+// status makes a request and returns its status code. form is posted if it
+// isn't nil.
+func (e *e2eEnv) status(t *testing.T, requestUrl string, form url.Values) int {
+	var response *http.Response
+	var err error
+	if form == nil {
+		response, err = e.client.Get(requestUrl)
+	} else {
+		response, err = e.client.PostForm(requestUrl, form)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+// stateSessionId returns the session ID from a callback URL's state.
+func stateSessionId(t *testing.T, callback string) string {
+	parsed, err := url.Parse(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitN(parsed.Query().Get("state"), ".", 2)[0]
+}
+
+func TestOAuthStateIsSingleUse(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+
+	mondoCallback := env.redirect(t, env.post(t, "/login", nil))
+	sessionId := stateSessionId(t, mondoCallback)
+	accountPicker := env.get(t, mondoCallback)
+	state := stateInput.FindStringSubmatch(accountPicker)
+	if state == nil {
+		t.Fatalf("no state in %s", accountPicker)
+	}
+	if status := env.status(t, mondoCallback, nil); status != http.StatusForbidden {
+		t.Errorf("expected reusing the Mondo callback's state to be forbidden, got %d", status)
+	}
+
+	selectAccount := env.server.URL + "/mondo/account"
+	for _, attempt := range []struct {
+		state    string
+		expected int
+	}{
+		{"", http.StatusBadRequest},
+		{sessionId + ".wrong", http.StatusForbidden},
+		{"no-such-session.wrong", http.StatusForbidden},
+	} {
+		form := url.Values{"state": {attempt.state}, "mondo-account-id": {"acc_fake"}}
+		if status := env.status(t, selectAccount, form); status != attempt.expected {
+			t.Errorf("expected state %q to get %d, got %d", attempt.state, attempt.expected, status)
+		}
+	}
+
+	form := url.Values{"state": {state[1]}, "mondo-account-id": {"acc_fake"}}
+	uberCallback := env.redirect(t, env.post(t, "/mondo/account", form))
+	if status := env.status(t, selectAccount, form); status != http.StatusForbidden {
+		t.Errorf("expected reusing the account picker's state to be forbidden, got %d", status)
+	}
+
+	if loginSuccess := env.get(t, uberCallback); !strings.Contains(loginSuccess, "/logout") {
+		t.Fatalf("unexpected login success page %s", loginSuccess)
+	}
+	if status := env.status(t, uberCallback, nil); status != http.StatusForbidden {
+		t.Errorf("expected reusing the Uber callback's state to be forbidden, got %d", status)
+	}
+	s, err := sessions.Get(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.oauthState != "" {
+		t.Errorf("expected the state to be cleared once logged in, got %q", s.oauthState)
+	}
+}
+
+func TestOAuthCallbackRejectsMissingAndWrongState(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+
+	mondoCallback := env.redirect(t, env.post(t, "/login", nil))
+	sessionId := stateSessionId(t, mondoCallback)
+	for _, attempt := range []struct {
+		state    string
+		expected int
+	}{
+		{"", http.StatusBadRequest},
+		{sessionId + ".wrong", http.StatusForbidden},
+		{sessionId + ".", http.StatusForbidden},
+	} {
+		callback := env.server.URL + "/mondo/setauthcode?" + url.Values{"code": {"code"}, "state": {attempt.state}}.Encode()
+		if status := env.status(t, callback, nil); status != attempt.expected {
+			t.Errorf("expected state %q to get %d, got %d", attempt.state, attempt.expected, status)
+		}
+	}
+
+	// Wrong guesses don't use up the real state
+	if accountPicker := env.get(t, mondoCallback); !strings.Contains(accountPicker, "acc_fake") {
+		t.Errorf("unexpected account picker %s", accountPicker)
+	}
+}
+
+func TestExpiredLoginIsRejectedAndDeleted(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+
+	mondoCallback := env.redirect(t, env.post(t, "/login", nil))
+	sessionId := stateSessionId(t, mondoCallback)
+	err := sessions.Update(sessionId, func(s *session) error {
+		s.loginExpiry = time.Now().Add(-time.Second)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := env.status(t, mondoCallback, nil); status != http.StatusForbidden {
+		t.Errorf("expected an expired login's state to be forbidden, got %d", status)
+	}
+
+	deleted, err := sessions.DeleteExpiredLogins(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sessions.Get(sessionId); deleted != 1 || err != ErrNoSuchSession {
+		t.Errorf("expected the expired login to be deleted, deleted %d and got %v", deleted, err)
+	}
+}
+
+func TestRedactedUrl(t *testing.T) {
+	parsed, err := url.Parse("/mondo/setauthcode?code=secret-code&state=abc.secret-state&other=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted := redactedUrl(parsed)
+	if strings.Contains(redacted, "secret") || !strings.Contains(redacted, "other=1") {
+		t.Errorf("unexpected redacted URL %s", redacted)
+	}
+
+	parsed, err = url.Parse("/mondo/webhook/session-id/secret-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redacted := redactedUrl(parsed); redacted != "/mondo/webhook/session-id/REDACTED" {
+		t.Errorf("unexpected redacted URL %s", redacted)
+	}
+}
+
+func TestReviewPicksTripOrDismisses(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+	sessionId := env.login(t)
+
+	trip := env.uber.AddTrip(fakeTrip{
+		Receipt: UberReceiptResponse{TotalCharged: "£12.34", CurrencyCode: "GBP"},
+		Request: UberRequestResponse{
+			Pickup:      &UberRequestLocation{Latitude: 51.5033, Longitude: -0.1196},
+			Destination: &UberRequestLocation{Latitude: 51.5194, Longitude: -0.1270},
+		},
+	})
+	// Neither amount matches, so both need review
+	var transactions []MondoTransaction
+	for _, amount := range []int32{-999, -888} {
+		transaction, err := env.mondo.CreateTransaction(MondoTransaction{Amount: amount, Description: "UBER BV"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		transactions = append(transactions, transaction)
+	}
+	var items []*reviewItem
+	eventually(t, "the reviews", func() bool {
+		items, _ = sessionReviews(sessionId)
+		return len(items) == 2
+	})
+	if page := env.post(t, "/templates", url.Values{"session-id": {sessionId}}); !strings.Contains(page, "Which trip was UBER BV") {
+		t.Errorf("expected the reviews on the success page, got %s", page)
+	}
+
+	reviewsUrl := env.server.URL + "/reviews"
+	form := url.Values{"session-id": {sessionId}, "transaction-id": {transactions[0].Id}, "request-id": {"not-a-candidate"}}
+	if status := env.status(t, reviewsUrl, form); status != http.StatusBadRequest {
+		t.Errorf("expected a trip that isn't a candidate to be rejected, got %d", status)
+	}
+	form = url.Values{"session-id": {"someone-else"}, "transaction-id": {transactions[0].Id}, "dismiss": {"dismiss"}}
+	if status := env.status(t, reviewsUrl, form); status != http.StatusNotFound {
+		t.Errorf("expected another session's review to be not found, got %d", status)
+	}
+
+	// A trip being attached can't be picked again or dismissed
+	if err := reviews.Pick(transactions[1].Id, trip.History.RequestId); err != nil {
+		t.Fatal(err)
+	}
+	form = url.Values{"session-id": {sessionId}, "transaction-id": {transactions[1].Id}, "dismiss": {"dismiss"}}
+	if status := env.status(t, reviewsUrl, form); status != http.StatusConflict {
+		t.Errorf("expected dismissing a picked review to conflict, got %d", status)
+	}
+	if err := reviews.Pick(transactions[1].Id, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var picked WebhookData
+	for _, item := range items {
+		if item.TransactionId == transactions[0].Id {
+			picked = item.Transaction
+		}
+	}
+	env.post(t, "/reviews", url.Values{"session-id": {sessionId}, "transaction-id": {transactions[0].Id}, "request-id": {trip.History.RequestId}})
+	env.post(t, "/reviews", url.Values{"session-id": {sessionId}, "transaction-id": {transactions[1].Id}, "dismiss": {"dismiss"}})
+	eventually(t, "the picked trip's attachment", func() bool {
+		attached, _ := env.mondo.Transaction(transactions[0].Id)
+		return attached.Metadata["uber_trip_id"] == trip.History.RequestId
+	})
+	// A second go, e.g. a retry, doesn't attach it again
+	s, err := sessions.Get(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the attachment to be recorded", func() bool {
+		entry, err := ledger.Get(transactionKey(transactions[0].Id))
+		return err == nil && entry.AttachmentId != ""
+	})
+	if err := attachReviewedTrip(context.Background(), s, picked, trip.History.RequestId); err != nil {
+		t.Fatal(err)
+	}
+	if attached, _ := env.mondo.Transaction(transactions[0].Id); len(attached.Attachments) != 1 {
+		t.Errorf("expected one attachment, got %+v", attached.Attachments)
+	}
+	eventually(t, "the reviews to be resolved", func() bool {
+		items, _ = sessionReviews(sessionId)
+		return len(items) == 0
+	})
+	if dismissed, _ := env.mondo.Transaction(transactions[1].Id); dismissed.Metadata["uber_trip_id"] != "" {
+		t.Errorf("expected the dismissed transaction to be left alone, got %v", dismissed.Metadata)
+	}
+}
+
+func TestLoginSupersedesEarlierSessions(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+
+	earlier := env.login(t)
+	later := env.login(t)
+	if _, err := sessions.Get(earlier); err != ErrNoSuchSession {
+		t.Errorf("expected the earlier session to be deleted, got %v", err)
+	}
+	s, err := sessions.Get(later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err := sessions.FindByUberUserId(s.uberUserId); err != nil || found.sessionId != later {
+		t.Errorf("expected the Uber user's webhooks to go to the later session, got %v", err)
+	}
+	if webhooks := env.mondo.Webhooks(); len(webhooks) != 1 || webhooks[0].Id != s.mondoWebhookId {
+		t.Errorf("expected only the later session's webhook, got %+v", webhooks)
+	}
+}
+
+func TestMondoWebhookRejectsUnknownSessionsLikeWrongSecrets(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+	sessionId := env.login(t)
+
+	for _, path := range []string{"/mondo/webhook/" + sessionId + "/wrong", "/mondo/webhook/no-such-session/wrong"} {
+		if status := env.status(t, env.server.URL+path, url.Values{}); status != http.StatusForbidden {
+			t.Errorf("expected %s to be forbidden, got %d", path, status)
+		}
+	}
+}
+
+func TestTemplatePreviewNeedsALogin(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+
+	previewUrl := env.server.URL + "/templates/preview"
+	form := url.Values{"title-template": {"{{.Emoji}}"}, "body-template": {""}}
+	if status := env.status(t, previewUrl, form); status != http.StatusNotFound {
+		t.Errorf("expected a preview without a session to be not found, got %d", status)
+	}
+	unfinished := stateSessionId(t, env.redirect(t, env.post(t, "/login", nil)))
+	form.Set("session-id", unfinished)
+	if status := env.status(t, previewUrl, form); status != http.StatusNotFound {
+		t.Errorf("expected a preview for an unfinished login to be not found, got %d", status)
+	}
+
+	form.Set("session-id", env.login(t))
+	if preview := env.post(t, "/templates/preview", form); !strings.Contains(preview, `"title"`) {
+		t.Errorf("unexpected preview %s", preview)
+	}
+}
+
+func TestBackfillProgressNeedsASession(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+	sessionId := env.login(t)
+
+	// Progress left behind for a session that's gone isn't reported
+	if err := backfills.Put(&backfillProgress{SessionId: "logged-out", Status: backfillFailed, LastError: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	progressUrl := env.server.URL + "/backfill/progress"
+	if status := env.status(t, progressUrl, url.Values{"session-id": {"logged-out"}}); status != http.StatusNotFound {
+		t.Errorf("expected progress without a session to be not found, got %d", status)
+	}
+
+	if err := backfills.Put(&backfillProgress{SessionId: sessionId, Status: backfillRunning}); err != nil {
+		t.Fatal(err)
+	}
+	if progress := env.post(t, "/backfill/progress", url.Values{"session-id": {sessionId}}); !strings.Contains(progress, backfillRunning) {
+		t.Errorf("unexpected progress %s", progress)
+	}
+}
+
+func TestUberWebhookRejectsHugeBodies(t *testing.T) {
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+
+	body := strings.NewReader(strings.Repeat("x", maxWebhookBody+1))
+	response, err := env.client.Post(env.server.URL+"/uber/webhook", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a body over the limit to be rejected, got %s", response.Status)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/nu7hatch/gouuid"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// MapProvider supplies the URL of an image showing a trip's route, for the
+// receipt feed item. The route has at least two coordinates.
+type MapProvider interface {
+	MapUrl(route coordinatePath) (string, error)
+}
+
+// tileMapProvider renders maps itself from local OpenStreetMap tiles, so no
+// third party API key ends up in the feed. MapUrl just records the map; it is
+// drawn when the URL is fetched.
+type tileMapProvider struct {
+	tiles tileSource
+	store MapStore
+	// url returns the public URL of the map with the given ID
+	url func(mapId string) (string, error)
+}
+
+func (p *tileMapProvider) MapUrl(route coordinatePath) (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	spec := &mapSpec{
+		Id:      id.String(),
+		Route:   route.Polyline(),
+		Created: time.Now(),
+	}
+	if err := p.store.Put(spec); err != nil {
+		return "", err
+	}
+	return p.url(spec.Id)
+}
+
+// Render returns the PNG for a map returned by MapUrl.
+func (p *tileMapProvider) Render(mapId string) ([]byte, error) {
+	spec, err := p.store.Get(mapId)
+	if err != nil {
+		return nil, err
+	}
+	route, err := decodePolyline(spec.Route)
+	if err != nil {
+		return nil, err
+	}
+	return renderMap(p.tiles, route)
+}
+
+// MapId returns the ID of a map from its URL, if the URL is one of ours.
+func (p *tileMapProvider) MapId(mapUrl string) (string, bool) {
+	parsed, err := url.Parse(mapUrl)
+	if err != nil {
+		return "", false
+	}
+	mapId := strings.TrimSuffix(path.Base(parsed.Path), ".png")
+	ours, err := p.url(mapId)
+	return mapId, err == nil && ours == mapUrl
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+)
+
+const (
+	tileSize = 256
+
+	// Rendered maps are square, with the route kept at least mapPadding
+	// pixels from the edge.
+	mapSize    = 512
+	mapPadding = 48
+	mapMaxZoom = 17
+
+	// Web Mercator stops short of the poles
+	maxLatitude = 85.05112878
+)
+
+var (
+	mapBackground = color.RGBA{0xe5, 0xe3, 0xdf, 0xff}
+	routeColor    = color.RGBA{0x2d, 0xba, 0xe4, 0xff}
+	markerColor   = color.RGBA{0x00, 0x00, 0x00, 0xff}
+	markerCentre  = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// worldPixel projects a coordinate to Web Mercator pixels at a zoom level,
+// with (0, 0) at the top left of the world.
+func worldPixel(c coordinate, zoom int) (float64, float64) {
+	scale := float64(tileSize) * math.Exp2(float64(zoom))
+	latitude := math.Max(-maxLatitude, math.Min(maxLatitude, c.Latitude))
+	sinLatitude := math.Sin(latitude * math.Pi / 180)
+	x := (c.Longitude + 180) / 360 * scale
+	y := (0.5 - math.Log((1+sinLatitude)/(1-sinLatitude))/(4*math.Pi)) * scale
+	return x, y
+}
+
+// pixelBounds returns the world pixel bounding box of a route at a zoom
+// level.
+func pixelBounds(route coordinatePath, zoom int) (minX, minY, maxX, maxY float64) {
+	minX, minY = math.Inf(1), math.Inf(1)
+	maxX, maxY = math.Inf(-1), math.Inf(-1)
+	for _, c := range route {
+		x, y := worldPixel(c, zoom)
+		minX, minY = math.Min(minX, x), math.Min(minY, y)
+		maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+	}
+	return
+}
+
+// fitZoom returns the closest zoom at which the whole route fits on the map.
+func fitZoom(route coordinatePath) int {
+	for zoom := mapMaxZoom; zoom > 0; zoom-- {
+		minX, minY, maxX, maxY := pixelBounds(route, zoom)
+		if maxX-minX <= mapSize-2*mapPadding && maxY-minY <= mapSize-2*mapPadding {
+			return zoom
+		}
+	}
+	return 0
+}
+
+// renderMap draws a trip's route and its start and end markers over map
+// tiles, and returns it as a PNG. Missing tiles are left blank.
+func renderMap(tiles tileSource, route coordinatePath) ([]byte, error) {
+	if len(route) < 2 {
+		return nil, fmt.Errorf("route has %d points, need at least 2", len(route))
+	}
+
+	zoom := fitZoom(route)
+	minX, minY, maxX, maxY := pixelBounds(route, zoom)
+	originX := math.Floor((minX+maxX)/2) - mapSize/2
+	originY := math.Floor((minY+maxY)/2) - mapSize/2
+
+	img := image.NewRGBA(image.Rect(0, 0, mapSize, mapSize))
+	draw.Draw(img, img.Bounds(), image.NewUniform(mapBackground), image.Point{}, draw.Src)
+
+	worldTiles := 1 << uint(zoom)
+	firstX, firstY := int(math.Floor(originX/tileSize)), int(math.Floor(originY/tileSize))
+	lastX, lastY := int(math.Floor((originX+mapSize-1)/tileSize)), int(math.Floor((originY+mapSize-1)/tileSize))
+	for ty := firstY; ty <= lastY; ty++ {
+		if ty < 0 || ty >= worldTiles {
+			continue
+		}
+		for tx := firstX; tx <= lastX; tx++ {
+			// Wrap around the antimeridian
+			wrappedX := ((tx % worldTiles) + worldTiles) % worldTiles
+			tile, err := tiles.Tile(zoom, wrappedX, ty)
+			if err == ErrNoSuchTile {
+				log.Printf("Missing map tile %d/%d/%d\n", zoom, wrappedX, ty)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			at := image.Pt(tx*tileSize-int(originX), ty*tileSize-int(originY))
+			draw.Draw(img, image.Rectangle{at, at.Add(image.Pt(tileSize, tileSize))}, tile, tile.Bounds().Min, draw.Over)
+		}
+	}
+
+	for i := 1; i < len(route); i++ {
+		x0, y0 := worldPixel(route[i-1], zoom)
+		x1, y1 := worldPixel(route[i], zoom)
+		drawLine(img, x0-originX, y0-originY, x1-originX, y1-originY, 2, routeColor)
+	}
+
+	startX, startY := worldPixel(route.Start(), zoom)
+	endX, endY := worldPixel(route.End(), zoom)
+	drawDisc(img, startX-originX, startY-originY, 9, markerColor)
+	drawDisc(img, startX-originX, startY-originY, 4, markerCentre)
+	drawSquare(img, endX-originX, endY-originY, 8, markerColor)
+	drawSquare(img, endX-originX, endY-originY, 3, markerCentre)
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// drawLine draws a line with round ends, radius pixels either side of the
+// centre.
+func drawLine(img *image.RGBA, x0, y0, x1, y1, radius float64, c color.Color) {
+	length := math.Hypot(x1-x0, y1-y0)
+	steps := int(math.Ceil(length))
+	for i := 0; i <= steps; i++ {
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		drawDisc(img, x0+(x1-x0)*t, y0+(y1-y0)*t, radius, c)
+	}
+}
+
+func drawDisc(img *image.RGBA, x, y, radius float64, c color.Color) {
+	for py := int(math.Floor(y - radius)); py <= int(math.Ceil(y+radius)); py++ {
+		for px := int(math.Floor(x - radius)); px <= int(math.Ceil(x+radius)); px++ {
+			if math.Hypot(float64(px)-x, float64(py)-y) <= radius {
+				img.Set(px, py, c)
+			}
+		}
+	}
+}
+
+func drawSquare(img *image.RGBA, x, y, half float64, c color.Color) {
+	rect := image.Rect(int(math.Round(x-half)), int(math.Round(y-half)), int(math.Round(x+half))+1, int(math.Round(y+half))+1)
+	draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+}
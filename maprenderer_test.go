@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var (
+	testTileColor = color.RGBA{0x10, 0x80, 0x10, 0xff}
+	testRoute     = coordinatePath{
+		{Latitude: 51.5033, Longitude: -0.1196},
+		{Latitude: 51.5113, Longitude: -0.1184},
+		{Latitude: 51.5194, Longitude: -0.1270},
+	}
+)
+
+func encodeTestTile(t *testing.T) []byte {
+	tile := image.NewRGBA(image.Rect(0, 0, tileSize, tileSize))
+	for y := 0; y < tileSize; y++ {
+		for x := 0; x < tileSize; x++ {
+			tile.Set(x, y, testTileColor)
+		}
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, tile); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// testTiles returns the tiles a map of testRoute needs.
+func testTiles() [][3]int {
+	zoom := fitZoom(testRoute)
+	x, y := worldPixel(testRoute[1], zoom)
+	var tiles [][3]int
+	for ty := int(y-mapSize)/tileSize - 1; ty <= int(y+mapSize)/tileSize+1; ty++ {
+		for tx := int(x-mapSize)/tileSize - 1; tx <= int(x+mapSize)/tileSize+1; tx++ {
+			tiles = append(tiles, [3]int{zoom, tx, ty})
+		}
+	}
+	return tiles
+}
+
+func decodeTestMap(t *testing.T, data []byte) image.Image {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != mapSize || img.Bounds().Dy() != mapSize {
+		t.Fatalf("expected %dx%d map, got %s", mapSize, mapSize, img.Bounds())
+	}
+	return img
+}
+
+func assertColor(t *testing.T, img image.Image, x, y int, expected color.RGBA) {
+	r, g, b, a := img.At(x, y).RGBA()
+	actual := color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+	if actual != expected {
+		t.Errorf("pixel %d,%d: expected %v, got %v", x, y, expected, actual)
+	}
+}
+
+func TestWorldPixel(t *testing.T) {
+	x, y := worldPixel(coordinate{}, 0)
+	if x != 128 || y != 128 {
+		t.Errorf("expected 0,0 at the centre of the world, got %f,%f", x, y)
+	}
+	x, y = worldPixel(coordinate{Latitude: 90, Longitude: 180}, 1)
+	if x != 512 || math.Abs(y) > 0.01 {
+		t.Errorf("expected top right of the world, got %f,%f", x, y)
+	}
+}
+
+func TestRenderMapFromTileDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uber-mondo-tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := encodeTestTile(t)
+	for _, tile := range testTiles() {
+		tileDir := filepath.Join(dir, strconv.Itoa(tile[0]), strconv.Itoa(tile[1]))
+		if err := os.MkdirAll(tileDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tileDir, strconv.Itoa(tile[2])+".png"), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rendered, err := renderMap(&tileDirectory{dir: dir}, testRoute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := decodeTestMap(t, rendered)
+
+	assertColor(t, img, 0, 0, testTileColor)
+	// The route bends through testRoute[1] rather than going straight
+	zoom := fitZoom(testRoute)
+	minX, minY, maxX, maxY := pixelBounds(testRoute, zoom)
+	x, y := worldPixel(testRoute[1], zoom)
+	assertColor(t, img, int(x-math.Floor((minX+maxX)/2)+mapSize/2), int(y-math.Floor((minY+maxY)/2)+mapSize/2), routeColor)
+}
+
+func TestRenderMapWithoutTiles(t *testing.T) {
+	rendered, err := renderMap(tileSources{}, testRoute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := decodeTestMap(t, rendered)
+	assertColor(t, img, 0, 0, mapBackground)
+}
+
+func TestMbtilesFlipsRows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uber-mondo-mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "test.mbtiles")
+
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("CREATE TABLE tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Row 2 from the bottom at zoom 2 is row 1 from the top
+	_, err = db.Exec("INSERT INTO tiles VALUES (2, 3, 2, ?)", encodeTestTile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	source, err := openMbtiles(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tile, err := source.Tile(2, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertColor(t, tile, 0, 0, testTileColor)
+
+	if _, err := source.Tile(2, 3, 2); err != ErrNoSuchTile {
+		t.Errorf("expected ErrNoSuchTile, got %v", err)
+	}
+}
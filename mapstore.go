@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var ErrNoSuchMap = errors.New("no such map")
+
+var mapsBucket = []byte("maps")
+
+// mapSpec is what's needed to draw a trip's map. Maps are rendered when they
+// are requested rather than stored as images.
+type mapSpec struct {
+	Id string `json:"id"`
+	// Route is an encoded polyline, see coordinatePath.Polyline
+	Route   string    `json:"route"`
+	Created time.Time `json:"created"`
+}
+
+type MapStore interface {
+	Get(mapId string) (*mapSpec, error)
+	Put(spec *mapSpec) error
+}
+
+type memoryMapStore struct {
+	mutex sync.Mutex
+	maps  map[string]*mapSpec
+}
+
+func newMemoryMapStore() *memoryMapStore {
+	return &memoryMapStore{maps: make(map[string]*mapSpec)}
+}
+
+func (m *memoryMapStore) Get(mapId string) (*mapSpec, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	spec, exists := m.maps[mapId]
+	if !exists {
+		return nil, ErrNoSuchMap
+	}
+	copy := *spec
+	return &copy, nil
+}
+
+func (m *memoryMapStore) Put(spec *mapSpec) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	copy := *spec
+	m.maps[spec.Id] = &copy
+	return nil
+}
+
+type boltMapStore struct {
+	db *bolt.DB
+}
+
+func newBoltMapStore(db *bolt.DB) (*boltMapStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(mapsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltMapStore{db: db}, nil
+}
+
+func (b *boltMapStore) Get(mapId string) (*mapSpec, error) {
+	spec := &mapSpec{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(mapsBucket).Get([]byte(mapId))
+		if data == nil {
+			return ErrNoSuchMap
+		}
+		return json.Unmarshal(data, spec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+func (b *boltMapStore) Put(spec *mapSpec) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(mapsBucket).Put([]byte(spec.Id), data)
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Uber charges the card when a trip ends, but the transaction can take a
+	// while to reach Mondo. Trips that ended further than this from the
+	// transaction time aren't considered.
+	matchWindow = 48 * time.Hour
+
+	// A match needs at least this score, and must beat the runner up by at
+	// least matchMargin, before a receipt is published for it.
+	confidentScore = 0.8
+	matchMargin    = 0.2
+
+	amountWeight = 0.7
+	timeWeight   = 0.3
+)
+
+// tripMatch is an Uber trip scored against a Mondo transaction.
+type tripMatch struct {
+	Trip    UberHistoryItem
+	Receipt *UberReceiptResponse
+	Score   float64
+}
+
+type matchResult struct {
+	Candidates []tripMatch // best first
+	Confident  bool
+	Reason     string
+}
+
+// Best returns the highest scoring candidate, or nil if there were none.
+func (m *matchResult) Best() *tripMatch {
+	if len(m.Candidates) == 0 {
+		return nil
+	}
+	return &m.Candidates[0]
+}
+
+// matchTransaction pages back through the user's Uber history looking for
+// the trip a Mondo transaction paid for. Every completed trip that ended
+// within matchWindow of the transaction is scored on amount, currency and
+// time.
+func matchTransaction(ctx context.Context, client *UberApiClient, token *OAuthToken, transaction WebhookData) (*matchResult, error) {
+	created, err := time.Parse(time.RFC3339, transaction.Created)
+	if err != nil {
+		return nil, fmt.Errorf("transaction %s created: %s", transaction.Id, err.Error())
+	}
+
+	result := &matchResult{}
+	trips := client.History(ctx, token, historyFilter{
+		Since:    created.Add(-matchWindow),
+		Until:    created.Add(matchWindow),
+		Statuses: completedTrips,
+	})
+	for trips.Next() {
+		trip := trips.Trip()
+		receipt, err := client.GetReceiptContext(ctx, token, trip.RequestId)
+		if IsNotFound(err) {
+			// Not every trip has a receipt, and one that doesn't can't match
+			log.Printf("Transaction %s trip %s has no receipt\n", transaction.Id, trip.RequestId)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		score := scoreTrip(transaction, created, trip, receipt)
+		log.Printf("Transaction %s trip %s score %.2f\n", transaction.Id, trip.RequestId, score)
+		if score > 0 {
+			result.Candidates = append(result.Candidates, tripMatch{Trip: trip, Receipt: receipt, Score: score})
+		}
+	}
+	if err := trips.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(result.Candidates, func(i, j int) bool {
+		return result.Candidates[i].Score > result.Candidates[j].Score
+	})
+
+	switch {
+	case len(result.Candidates) == 0:
+		result.Reason = "no trip matches"
+	case result.Candidates[0].Score < confidentScore:
+		result.Reason = fmt.Sprintf("best score %.2f below %.2f", result.Candidates[0].Score, confidentScore)
+	case len(result.Candidates) > 1 && result.Candidates[0].Score-result.Candidates[1].Score < matchMargin:
+		result.Reason = fmt.Sprintf("ambiguous: %d trips score within %.2f", len(result.Candidates), matchMargin)
+	default:
+		result.Confident = true
+	}
+	return result, nil
+}
+
+// scoreTrip rates how likely it is that a transaction paid for a trip, from 0
+// (not at all) to 1 (exact amount, charged the moment the trip ended).
+func scoreTrip(transaction WebhookData, created time.Time, trip UberHistoryItem, receipt *UberReceiptResponse) float64 {
+	if receipt.CurrencyCode != "" && !strings.EqualFold(receipt.CurrencyCode, transaction.Currency) {
+		return 0
+	}
+
+	amountScore := 0.0
+	charged, err := parseMinorUnits(receipt.TotalCharged)
+	if err == nil {
+		spent := int64(transaction.Amount)
+		if spent < 0 {
+			spent = -spent
+		}
+		difference := math.Abs(float64(charged - spent))
+		switch {
+		case difference == 0:
+			amountScore = 1
+		case spent > 0 && difference/float64(spent) <= 0.02:
+			// Rounding or a currency conversion fee
+			amountScore = 0.5
+		}
+	}
+
+	delay := created.Sub(time.Unix(trip.EndTime, 0))
+	timeScore := 1 - math.Abs(float64(delay))/float64(matchWindow)
+	if timeScore < 0 {
+		timeScore = 0
+	}
+
+	return amountWeight*amountScore + timeWeight*timeScore
+}
+
+// parseMinorUnits converts an Uber formatted amount such as "£5.92",
+// "$1,204.50" or "5,92 €" to minor units (592, 120450, 592). A separator
+// followed by one or two digits is taken to be the decimal point.
+func parseMinorUnits(amount string) (int64, error) {
+	var digits strings.Builder
+	decimals := -1 // digits after the last separator
+	for _, r := range amount {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+			if decimals >= 0 {
+				decimals++
+			}
+		case r == '.' || r == ',':
+			decimals = 0
+		}
+	}
+	if digits.Len() == 0 {
+		return 0, fmt.Errorf("no amount in %q", amount)
+	}
+
+	value, err := strconv.ParseInt(digits.String(), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	switch decimals {
+	case 1:
+		return value * 10, nil
+	case 2:
+		return value, nil
+	default:
+		return value * 100, nil
+	}
+}
+
+// findTrip looks up a trip by request ID in the part of the user's history
+// filter picks out, e.g. all of it for a recent trip.
+func findTrip(ctx context.Context, client *UberApiClient, token *OAuthToken, requestId string, filter historyFilter) (*UberHistoryItem, error) {
+	const maxTrips = 4 * historyPageSize
+	trips := client.History(ctx, token, filter)
+	for searched := 0; searched < maxTrips && trips.Next(); searched++ {
+		if trip := trips.Trip(); trip.RequestId == requestId {
+			return &trip, nil
+		}
+	}
+	if err := trips.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("trip %s not found in history", requestId)
+}
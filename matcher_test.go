@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var matchTestNow = time.Date(2015, 9, 20, 18, 0, 0, 0, time.UTC)
+
+type testTrip struct {
+	requestId string
+	status    string
+	ended     time.Time
+	total     string
+}
+
+// newHistoryServer serves the given trips (newest first) from /v1.2/history
+// honouring offset and limit, and their receipts.
+func newHistoryServer(trips []testTrip) *httptest.Server {
+	return httptest.NewServer(newHistoryHandler(trips))
+}
+
+func newHistoryHandler(trips []testTrip) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.2/history", func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.FormValue("offset"))
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		response := UberHistoryResponse{Offset: int64(offset), Limit: int64(limit), Count: int64(len(trips))}
+		for i := offset; i < offset+limit && i < len(trips); i++ {
+			response.History = append(response.History, UberHistoryItem{
+				RequestId: trips[i].requestId,
+				Status:    trips[i].status,
+				EndTime:   trips[i].ended.Unix(),
+			})
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+	mux.HandleFunc("/v1/requests/", func(w http.ResponseWriter, r *http.Request) {
+		requestId := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/requests/"), "/receipt")
+		for _, trip := range trips {
+			// Trips with no total have no receipt
+			if trip.requestId == requestId && trip.total != "" {
+				json.NewEncoder(w).Encode(UberReceiptResponse{RequestId: requestId, TotalCharged: trip.total, CurrencyCode: "GBP"})
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+	return mux
+}
+
+func matchTestTransaction(amount int32) WebhookData {
+	return WebhookData{
+		Id:          "tx_1",
+		Amount:      amount,
+		Currency:    "GBP",
+		Created:     matchTestNow.Format(time.RFC3339),
+		Description: "UBER BV",
+	}
+}
+
+func runMatch(t *testing.T, trips []testTrip, transaction WebhookData) *matchResult {
+	server := newHistoryServer(trips)
+	defer server.Close()
+	client := &UberApiClient{url: server.URL}
+
+	result, err := matchTransaction(context.Background(), client, &OAuthToken{AccessToken: "token"}, transaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestMatchTransactionPicksTripByAmount(t *testing.T) {
+	result := runMatch(t, []testTrip{
+		{"cancelled", "rider_canceled", matchTestNow.Add(-5 * time.Minute), "£5.00"},
+		{"later", "completed", matchTestNow.Add(-10 * time.Minute), "£7.10"},
+		{"wanted", "completed", matchTestNow.Add(-20 * time.Minute), "£12.34"},
+	}, matchTestTransaction(-1234))
+
+	if !result.Confident {
+		t.Fatalf("expected a confident match, got %s", result.Reason)
+	}
+	if result.Best().Trip.RequestId != "wanted" {
+		t.Errorf("expected trip wanted, got %s", result.Best().Trip.RequestId)
+	}
+}
+
+func TestMatchTransactionSkipsTripsWithoutReceipts(t *testing.T) {
+	result := runMatch(t, []testTrip{
+		{"no-receipt", "completed", matchTestNow.Add(-5 * time.Minute), ""},
+		{"wanted", "completed", matchTestNow.Add(-20 * time.Minute), "£12.34"},
+	}, matchTestTransaction(-1234))
+
+	if !result.Confident || result.Best().Trip.RequestId != "wanted" {
+		t.Errorf("expected a confident match on wanted, got %+v", result)
+	}
+}
+
+func TestMatchTransactionPagesThroughHistory(t *testing.T) {
+	var trips []testTrip
+	for i := 0; i < historyPageSize; i++ {
+		trips = append(trips, testTrip{"future" + strconv.Itoa(i), "completed", matchTestNow.Add(time.Duration(historyPageSize-i) * time.Hour), "£3.00"})
+	}
+	trips = append(trips, testTrip{"wanted", "completed", matchTestNow.Add(-time.Hour), "£12.34"})
+
+	result := runMatch(t, trips, matchTestTransaction(-1234))
+	if !result.Confident || result.Best().Trip.RequestId != "wanted" {
+		t.Errorf("expected confident match on second page, got %+v", result)
+	}
+}
+
+func TestMatchTransactionAmbiguous(t *testing.T) {
+	result := runMatch(t, []testTrip{
+		{"first", "completed", matchTestNow.Add(-10 * time.Minute), "£12.34"},
+		{"second", "completed", matchTestNow.Add(-30 * time.Minute), "£12.34"},
+	}, matchTestTransaction(-1234))
+
+	if result.Confident {
+		t.Errorf("expected an ambiguous match, got %s", result.Best().Trip.RequestId)
+	}
+	if len(result.Candidates) != 2 {
+		t.Errorf("expected 2 candidates, got %d", len(result.Candidates))
+	}
+}
+
+func TestMatchTransactionUnmatched(t *testing.T) {
+	result := runMatch(t, []testTrip{
+		{"other", "completed", matchTestNow.Add(-10 * time.Minute), "£8.00"},
+		{"old", "completed", matchTestNow.Add(-matchWindow - time.Hour), "£12.34"},
+	}, matchTestTransaction(-1234))
+
+	if result.Confident {
+		t.Errorf("expected no confident match, got %s", result.Best().Trip.RequestId)
+	}
+}
+
+func TestParseMinorUnits(t *testing.T) {
+	cases := map[string]int64{
+		"£5.92":     592,
+		"$1,204.50": 120450,
+		"5,92 €":    592,
+		"£5":        500,
+		"£5.5":      550,
+		"1,204":     120400,
+	}
+	for amount, expected := range cases {
+		actual, err := parseMinorUnits(amount)
+		if err != nil {
+			t.Errorf("%s: %s", amount, err.Error())
+		} else if actual != expected {
+			t.Errorf("%s: expected %d, got %d", amount, expected, actual)
+		}
+	}
+
+	if _, err := parseMinorUnits("free"); err == nil {
+		t.Errorf("expected error for amount without digits")
+	}
+}
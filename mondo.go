@@ -1,10 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -12,6 +12,7 @@ import (
 )
 
 const (
+	MondoAuthHost   = "https://auth.getmondo.co.uk"
 	Authorization   = "Authorization"
 	Bearer          = "Bearer "
 	ContentType     = "Content-Type"
@@ -24,6 +25,82 @@ type MondoApiClient struct {
 	url          string
 }
 
+type MondoTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ClientId     string `json:"client_id"`
+	ExpiresIn    uint32 `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	UserId       string `json:"user_id"`
+}
+
+type MondoAccountsResponse struct {
+	Accounts []MondoAccount `json:"accounts"`
+}
+
+type MondoAccount struct {
+	Id          string `json:"id"`
+	Description string `json:"description"`
+	Created     string `json:"created"`
+}
+
+type MondoTransactionsResponse struct {
+	Transactions []MondoTransaction `json:"transactions"`
+}
+
+// MondoTransaction is a transaction from /transactions, with its merchant
+// expanded. Amount is in minor units, negative for spending.
+type MondoTransaction struct {
+	Id            string            `json:"id"`
+	AccountId     string            `json:"account_id"`
+	Created       string            `json:"created"`
+	Description   string            `json:"description"`
+	Amount        int32             `json:"amount"`
+	Currency      string            `json:"currency"`
+	Merchant      *MondoMerchant    `json:"merchant"`
+	Metadata      map[string]string `json:"metadata"`
+	Attachments   []Attachment      `json:"attachments"`
+	DeclineReason string            `json:"decline_reason,omitempty"`
+	Settled       string            `json:"settled"`
+}
+
+type MondoMerchant struct {
+	Id       string `json:"id"`
+	GroupId  string `json:"group_id"`
+	Name     string `json:"name"`
+	Logo     string `json:"logo"`
+	Category string `json:"category"`
+}
+
+// WebhookData returns the transaction as a webhook would have delivered it.
+func (t *MondoTransaction) WebhookData() WebhookData {
+	return WebhookData{
+		Amount:      t.Amount,
+		Created:     t.Created,
+		Currency:    t.Currency,
+		Description: t.Description,
+		Id:          t.Id,
+	}
+}
+
+type AttachmentUploadResponse struct {
+	FileUrl   string `json:"file_url"`
+	UploadUrl string `json:"upload_url"`
+}
+
+type Attachment struct {
+	Id         string `json:"id"`
+	UserId     string `json:"user_id"`
+	ExternalId string `json:"external_id"`
+	FileUrl    string `json:"file_url"`
+	FileType   string `json:"file_type"`
+	Created    string `json:"created"`
+}
+
+type RegisterAttachmentResponse struct {
+	Attachment Attachment `json:"attachment"`
+}
+
 type RegisterWebhookRequest struct {
 	AccountId string `json:"account_id"`
 	Url       string `json:"url"`
@@ -52,10 +129,159 @@ type WebhookData struct {
 	Id          string `json:"id"`
 }
 
+// httpClient is shared by the API clients. main replaces it with one using
+// apiTransport.
 var httpClient = &http.Client{}
 
-func (c *MondoApiClient) RegisterWebHook(accessToken, accountId, webhookUrl string) (*RegisterWebhookResponse, error) {
-	log.Printf("Registering webhook for accountId=%s accessToken=%s url=%s\n", accountId, accessToken, webhookUrl)
+// As with UberApiClient, XxxContext variants take a context and the plain
+// methods use context.Background().
+func (c *MondoApiClient) GetOAuthToken(authorizationCode, redirectUri string) (*MondoTokenResponse, error) {
+	return c.GetOAuthTokenContext(context.Background(), authorizationCode, redirectUri)
+}
+
+func (c *MondoApiClient) GetOAuthTokenContext(ctx context.Context, authorizationCode, redirectUri string) (*MondoTokenResponse, error) {
+	return c.requestOAuthToken(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {c.clientId},
+		"client_secret": {c.clientSecret},
+		"redirect_uri":  {redirectUri},
+		"code":          {authorizationCode},
+	})
+}
+
+func (c *MondoApiClient) RefreshOAuthToken(refreshToken string) (*MondoTokenResponse, error) {
+	return c.RefreshOAuthTokenContext(context.Background(), refreshToken)
+}
+
+func (c *MondoApiClient) RefreshOAuthTokenContext(ctx context.Context, refreshToken string) (*MondoTokenResponse, error) {
+	return c.requestOAuthToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {c.clientId},
+		"client_secret": {c.clientSecret},
+		"refresh_token": {refreshToken},
+	})
+}
+
+func (c *MondoApiClient) requestOAuthToken(ctx context.Context, formValues url.Values) (*MondoTokenResponse, error) {
+	tokenUrl := fmt.Sprintf("%s/oauth2/token", c.url)
+	log.Printf("Requesting %s\n", tokenUrl)
+
+	request, err := http.NewRequestWithContext(ctx, "POST", tokenUrl, strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, newAPIError(mondoProvider, response)
+	}
+
+	tokenResponse := &MondoTokenResponse{}
+	err = json.NewDecoder(response.Body).Decode(tokenResponse)
+	return tokenResponse, err
+}
+
+// refresh exchanges the token's refresh token for a new access token.
+func (c *MondoApiClient) refresh(ctx context.Context, token *OAuthToken) error {
+	log.Printf("Refreshing Mondo access token\n")
+	tokenResponse, err := c.RefreshOAuthTokenContext(ctx, token.RefreshToken)
+	if err != nil {
+		return err
+	}
+	return token.update(tokenResponse.AccessToken, tokenResponse.RefreshToken, tokenResponse.ExpiresIn)
+}
+
+func (c *MondoApiClient) do(request *http.Request, token *OAuthToken) (*http.Response, error) {
+	return doAuthorized(request, token, c.refresh)
+}
+
+func (c *MondoApiClient) ListAccounts(token *OAuthToken) (*MondoAccountsResponse, error) {
+	return c.ListAccountsContext(context.Background(), token)
+}
+
+func (c *MondoApiClient) ListAccountsContext(ctx context.Context, token *OAuthToken) (*MondoAccountsResponse, error) {
+	accountsUrl := fmt.Sprintf("%s/accounts", c.url)
+	request, err := http.NewRequestWithContext(ctx, "GET", accountsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.do(request, token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, newAPIError(mondoProvider, response)
+	}
+
+	accountsResponse := &MondoAccountsResponse{}
+	err = json.NewDecoder(response.Body).Decode(accountsResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return accountsResponse, nil
+}
+
+// ListTransactions returns up to limit of an account's transactions, oldest
+// first, with their merchants. since is an RFC 3339 time or, to page through
+// the results, the ID of the last transaction already seen; before is an
+// RFC 3339 time. Either may be empty.
+func (c *MondoApiClient) ListTransactions(token *OAuthToken, accountId, since, before string, limit int) (*MondoTransactionsResponse, error) {
+	return c.ListTransactionsContext(context.Background(), token, accountId, since, before, limit)
+}
+
+func (c *MondoApiClient) ListTransactionsContext(ctx context.Context, token *OAuthToken, accountId, since, before string, limit int) (*MondoTransactionsResponse, error) {
+	query := url.Values{
+		"account_id": {accountId},
+		"expand[]":   {"merchant"},
+		"limit":      {fmt.Sprintf("%d", limit)},
+	}
+	if since != "" {
+		query.Set("since", since)
+	}
+	if before != "" {
+		query.Set("before", before)
+	}
+	transactionsUrl := fmt.Sprintf("%s/transactions?%s", c.url, query.Encode())
+	request, err := http.NewRequestWithContext(ctx, "GET", transactionsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.do(request, token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, newAPIError(mondoProvider, response)
+	}
+
+	transactionsResponse := &MondoTransactionsResponse{}
+	err = json.NewDecoder(response.Body).Decode(transactionsResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return transactionsResponse, nil
+}
+
+func (c *MondoApiClient) RegisterWebHook(token *OAuthToken, accountId, webhookUrl string) (*RegisterWebhookResponse, error) {
+	return c.RegisterWebHookContext(context.Background(), token, accountId, webhookUrl)
+}
+
+func (c *MondoApiClient) RegisterWebHookContext(ctx context.Context, token *OAuthToken, accountId, webhookUrl string) (*RegisterWebhookResponse, error) {
+	log.Printf("Registering webhook for accountId=%s\n", accountId)
 
 	webhooksUrl := fmt.Sprintf("%s/webhooks", c.url)
 	formValues := url.Values{
@@ -63,26 +289,21 @@ func (c *MondoApiClient) RegisterWebHook(accessToken, accountId, webhookUrl stri
 		"url":        {webhookUrl},
 	}
 
-	request, err := http.NewRequest("POST", webhooksUrl, strings.NewReader(formValues.Encode()))
+	request, err := http.NewRequestWithContext(ctx, "POST", webhooksUrl, strings.NewReader(formValues.Encode()))
 	if err != nil {
 		return nil, err
 	}
 
-	request.Header.Add(Authorization, Bearer+accessToken)
 	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	response, err := httpClient.Do(request)
+	response, err := c.do(request, token)
 	if err != nil {
 		return nil, err
 	}
 
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return nil, err
-		}
-		return nil, errors.New(string(body))
+		return nil, newAPIError(mondoProvider, response)
 	}
 
 	webhookResponse := &RegisterWebhookResponse{}
@@ -94,37 +315,39 @@ func (c *MondoApiClient) RegisterWebHook(accessToken, accountId, webhookUrl stri
 	return webhookResponse, nil
 }
 
-func (c *MondoApiClient) UnregisterWebHook(accessToken, webhookId string) error {
-	log.Printf("Unregistering webhook accessToken=%s webhookId=%s\n", accessToken, webhookId)
+func (c *MondoApiClient) UnregisterWebHook(token *OAuthToken, webhookId string) error {
+	return c.UnregisterWebHookContext(context.Background(), token, webhookId)
+}
+
+func (c *MondoApiClient) UnregisterWebHookContext(ctx context.Context, token *OAuthToken, webhookId string) error {
+	log.Printf("Unregistering webhook webhookId=%s\n", webhookId)
 
 	webhooksUrl := fmt.Sprintf("%s/webhooks/%s", c.url, webhookId)
 
-	request, err := http.NewRequest("DELETE", webhooksUrl, nil)
+	request, err := http.NewRequestWithContext(ctx, "DELETE", webhooksUrl, nil)
 	if err != nil {
 		return err
 	}
 
-	request.Header.Add(Authorization, Bearer+accessToken)
-
-	response, err := httpClient.Do(request)
+	response, err := c.do(request, token)
 	if err != nil {
 		return err
 	}
 
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return err
-		}
-		return errors.New(string(body))
+		return newAPIError(mondoProvider, response)
 	}
 
 	return nil
 }
 
-func (c *MondoApiClient) CreateFeedItem(accessToken, accountId, itemType, title, imageUrl, body string) error {
-	log.Printf("Creating feed item for accountId=%s accessToken=%s type=%s title=%s imageUrl=%s body=%s\n", accountId, accessToken, itemType, title, imageUrl, body)
+func (c *MondoApiClient) CreateFeedItem(token *OAuthToken, accountId, itemType, title, imageUrl, body string) error {
+	return c.CreateFeedItemContext(context.Background(), token, accountId, itemType, title, imageUrl, body)
+}
+
+func (c *MondoApiClient) CreateFeedItemContext(ctx context.Context, token *OAuthToken, accountId, itemType, title, imageUrl, body string) error {
+	log.Printf("Creating feed item for accountId=%s type=%s title=%s imageUrl=%s body=%s\n", accountId, itemType, title, imageUrl, body)
 
 	feedUrl := fmt.Sprintf("%s/feed", c.url)
 	formValues := url.Values{
@@ -135,27 +358,199 @@ func (c *MondoApiClient) CreateFeedItem(accessToken, accountId, itemType, title,
 		"body":       {body},
 	}
 
-	request, err := http.NewRequest("POST", feedUrl, strings.NewReader(formValues.Encode()))
+	request, err := http.NewRequestWithContext(ctx, "POST", feedUrl, strings.NewReader(formValues.Encode()))
 	if err != nil {
 		return err
 	}
 
-	request.Header.Add(Authorization, Bearer+accessToken)
 	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	response, err := httpClient.Do(request)
+	response, err := c.do(request, token)
 	if err != nil {
 		return err
 	}
 
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return err
-		}
-		return errors.New(string(body))
+		return newAPIError(mondoProvider, response)
 	}
 
 	return err
 }
+
+// RequestAttachmentUpload asks Mondo for a URL to upload an attachment to.
+// The file is then PUT to UploadUrl and registered against a transaction
+// using FileUrl.
+func (c *MondoApiClient) RequestAttachmentUpload(token *OAuthToken, fileName, fileType string, contentLength int) (*AttachmentUploadResponse, error) {
+	return c.RequestAttachmentUploadContext(context.Background(), token, fileName, fileType, contentLength)
+}
+
+func (c *MondoApiClient) RequestAttachmentUploadContext(ctx context.Context, token *OAuthToken, fileName, fileType string, contentLength int) (*AttachmentUploadResponse, error) {
+	log.Printf("Requesting attachment upload fileName=%s fileType=%s\n", fileName, fileType)
+
+	uploadUrl := fmt.Sprintf("%s/attachment/upload", c.url)
+	formValues := url.Values{
+		"file_name":      {fileName},
+		"file_type":      {fileType},
+		"content_length": {fmt.Sprintf("%d", contentLength)},
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", uploadUrl, strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := c.do(request, token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, newAPIError(mondoProvider, response)
+	}
+
+	uploadResponse := &AttachmentUploadResponse{}
+	err = json.NewDecoder(response.Body).Decode(uploadResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return uploadResponse, nil
+}
+
+// UploadAttachment PUTs the file to the pre-signed URL returned by
+// RequestAttachmentUpload. The URL carries its own credentials.
+func (c *MondoApiClient) UploadAttachment(uploadUrl, fileType string, data []byte) error {
+	return c.UploadAttachmentContext(context.Background(), uploadUrl, fileType, data)
+}
+
+func (c *MondoApiClient) UploadAttachmentContext(ctx context.Context, uploadUrl, fileType string, data []byte) error {
+	request, err := http.NewRequestWithContext(ctx, "PUT", uploadUrl, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Add("Content-Type", fileType)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return newAPIError(mondoProvider, response)
+	}
+
+	return nil
+}
+
+func (c *MondoApiClient) RegisterAttachment(token *OAuthToken, transactionId, fileUrl, fileType string) (*RegisterAttachmentResponse, error) {
+	return c.RegisterAttachmentContext(context.Background(), token, transactionId, fileUrl, fileType)
+}
+
+func (c *MondoApiClient) RegisterAttachmentContext(ctx context.Context, token *OAuthToken, transactionId, fileUrl, fileType string) (*RegisterAttachmentResponse, error) {
+	log.Printf("Registering attachment for transactionId=%s fileUrl=%s\n", transactionId, fileUrl)
+
+	registerUrl := fmt.Sprintf("%s/attachment/register", c.url)
+	formValues := url.Values{
+		"external_id": {transactionId},
+		"file_url":    {fileUrl},
+		"file_type":   {fileType},
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", registerUrl, strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := c.do(request, token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, newAPIError(mondoProvider, response)
+	}
+
+	registerResponse := &RegisterAttachmentResponse{}
+	err = json.NewDecoder(response.Body).Decode(registerResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return registerResponse, nil
+}
+
+func (c *MondoApiClient) DeregisterAttachment(token *OAuthToken, attachmentId string) error {
+	return c.DeregisterAttachmentContext(context.Background(), token, attachmentId)
+}
+
+func (c *MondoApiClient) DeregisterAttachmentContext(ctx context.Context, token *OAuthToken, attachmentId string) error {
+	log.Printf("Deregistering attachment id=%s\n", attachmentId)
+
+	deregisterUrl := fmt.Sprintf("%s/attachment/deregister", c.url)
+	formValues := url.Values{
+		"id": {attachmentId},
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", deregisterUrl, strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := c.do(request, token)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return newAPIError(mondoProvider, response)
+	}
+
+	return nil
+}
+
+// AnnotateTransaction sets metadata keys on a transaction. An empty value
+// deletes the key.
+func (c *MondoApiClient) AnnotateTransaction(token *OAuthToken, transactionId string, metadata map[string]string) error {
+	return c.AnnotateTransactionContext(context.Background(), token, transactionId, metadata)
+}
+
+func (c *MondoApiClient) AnnotateTransactionContext(ctx context.Context, token *OAuthToken, transactionId string, metadata map[string]string) error {
+	log.Printf("Annotating transactionId=%s metadata=%v\n", transactionId, metadata)
+
+	transactionUrl := fmt.Sprintf("%s/transactions/%s", c.url, transactionId)
+	formValues := url.Values{}
+	for key, value := range metadata {
+		formValues.Set(fmt.Sprintf("metadata[%s]", key), value)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "PATCH", transactionUrl, strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := c.do(request, token)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return newAPIError(mondoProvider, response)
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestMondoApiClientAttachesFile(t *testing.T) {
+	var uploaded []byte
+	var registered, annotated url.Values
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/attachment/upload", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(AttachmentUploadResponse{
+			FileUrl:   "https://files.example.com/map.png",
+			UploadUrl: server.URL + "/s3/map.png",
+		})
+	})
+	mux.HandleFunc("/s3/map.png", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.Header.Get(Authorization) != "" {
+			t.Errorf("expected unauthenticated PUT, got %s %q", r.Method, r.Header.Get(Authorization))
+		}
+		uploaded, _ = ioutil.ReadAll(r.Body)
+	})
+	mux.HandleFunc("/attachment/register", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		registered = r.PostForm
+		json.NewEncoder(w).Encode(RegisterAttachmentResponse{Attachment: Attachment{Id: "attach_1"}})
+	})
+	mux.HandleFunc("/transactions/tx_1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PATCH" {
+			t.Errorf("expected PATCH, got %s", r.Method)
+		}
+		r.ParseForm()
+		annotated = r.PostForm
+	})
+
+	client := &MondoApiClient{url: server.URL}
+	token := &OAuthToken{AccessToken: "token"}
+
+	upload, err := client.RequestAttachmentUpload(token, "map.png", "image/png", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UploadAttachment(upload.UploadUrl, "image/png", []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.RegisterAttachment(token, "tx_1", upload.FileUrl, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.AnnotateTransaction(token, "tx_1", map[string]string{"uber_trip_id": "trip_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(uploaded) != "png" {
+		t.Errorf("expected file to be uploaded, got %q", uploaded)
+	}
+	if registered.Get("external_id") != "tx_1" || registered.Get("file_url") != upload.FileUrl {
+		t.Errorf("unexpected register request %v", registered)
+	}
+	if response.Attachment.Id != "attach_1" {
+		t.Errorf("expected attachment attach_1, got %s", response.Attachment.Id)
+	}
+	if annotated.Get("metadata[uber_trip_id]") != "trip_1" {
+		t.Errorf("unexpected metadata %v", annotated)
+	}
+}
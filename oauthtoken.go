@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Refresh tokens this long before they actually expire, so a request doesn't
+// race the expiry.
+const tokenRefreshMargin = 5 * time.Minute
+
+// OAuthToken is an access token along with what's needed to refresh it. API
+// clients refresh it in place and then call Refreshed, so whoever owns the
+// token can save the new values.
+//
+// If Serialize is set, refreshes go through it so the owner can stop
+// concurrent users of the token spending the same refresh token. It calls
+// refresh, unless it finds the token was refreshed by someone else meanwhile
+// and updates it to their values instead.
+type OAuthToken struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+	Refreshed    func(token *OAuthToken) error
+	Serialize    func(token *OAuthToken, refresh func() error) error
+}
+
+// expiresSoon reports whether the token should be refreshed before it's used.
+// Tokens with no known expiry are assumed to be valid.
+func (t *OAuthToken) expiresSoon() bool {
+	return !t.Expiry.IsZero() && time.Now().Add(tokenRefreshMargin).After(t.Expiry)
+}
+
+func (t *OAuthToken) canRefresh() bool {
+	return t.RefreshToken != ""
+}
+
+// update replaces the token with freshly issued values and notifies the
+// owner. Providers don't always issue a new refresh token, in which case the
+// old one is kept.
+func (t *OAuthToken) update(accessToken, refreshToken string, expiresIn uint32) error {
+	t.AccessToken = accessToken
+	if refreshToken != "" {
+		t.RefreshToken = refreshToken
+	}
+	t.Expiry = expiryTime(expiresIn)
+	if t.Refreshed != nil {
+		return t.Refreshed(t)
+	}
+	return nil
+}
+
+// refreshWith refreshes the token with refresh, through Serialize if set.
+func (t *OAuthToken) refreshWith(ctx context.Context, refresh func(context.Context, *OAuthToken) error) error {
+	if t.Serialize == nil {
+		return refresh(ctx, t)
+	}
+	return t.Serialize(t, func() error { return refresh(ctx, t) })
+}
+
+// refreshLocks serialises token refreshes by key, e.g. per session and
+// provider.
+type refreshLocks struct {
+	mutex sync.Mutex
+	locks map[string]*refreshLock
+}
+
+type refreshLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock waits for key's lock and returns a function releasing it.
+func (r *refreshLocks) lock(key string) func() {
+	r.mutex.Lock()
+	if r.locks == nil {
+		r.locks = make(map[string]*refreshLock)
+	}
+	l := r.locks[key]
+	if l == nil {
+		l = &refreshLock{}
+		r.locks[key] = l
+	}
+	l.users++
+	r.mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if l.users--; l.users == 0 {
+			delete(r.locks, key)
+		}
+	}
+}
+
+// expiryTime converts an expires_in value in seconds to an absolute time.
+func expiryTime(expiresIn uint32) time.Time {
+	if expiresIn == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second)
+}
+
+// doAuthorized sends request with the token as a bearer token. The token is
+// refreshed first if it's about to expire, or afterwards if the provider
+// responds 401, in which case the request is retried once.
+func doAuthorized(request *http.Request, token *OAuthToken, refresh func(context.Context, *OAuthToken) error) (*http.Response, error) {
+	if token.expiresSoon() && token.canRefresh() {
+		if err := token.refreshWith(request.Context(), refresh); err != nil {
+			return nil, err
+		}
+	}
+
+	request.Header.Set(Authorization, Bearer+token.AccessToken)
+	response, err := httpClient.Do(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized || !token.canRefresh() {
+		return response, err
+	}
+	response.Body.Close()
+
+	if err := token.refreshWith(request.Context(), refresh); err != nil {
+		return nil, err
+	}
+	if request.GetBody != nil {
+		request.Body, err = request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	request.Header.Set(Authorization, Bearer+token.AccessToken)
+	return httpClient.Do(request)
+}
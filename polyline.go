@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// coordinatePath is a route through a series of coordinates, e.g. a trip's
+// pickup, waypoints and dropoff.
+type coordinatePath []coordinate
+
+// Polyline encodes the path in Google's encoded polyline format, which
+// Google Static Maps accepts as path=enc:...
+// https://developers.google.com/maps/documentation/utilities/polylinealgorithm
+func (p coordinatePath) Polyline() string {
+	var encoded strings.Builder
+	var lastLatitude, lastLongitude int64
+	for _, c := range p {
+		latitude := int64(math.Round(c.Latitude * 1e5))
+		longitude := int64(math.Round(c.Longitude * 1e5))
+		encodePolylineValue(&encoded, latitude-lastLatitude)
+		encodePolylineValue(&encoded, longitude-lastLongitude)
+		lastLatitude, lastLongitude = latitude, longitude
+	}
+	return encoded.String()
+}
+
+func encodePolylineValue(encoded *strings.Builder, value int64) {
+	shifted := value << 1
+	if value < 0 {
+		shifted = ^shifted
+	}
+	for shifted >= 0x20 {
+		encoded.WriteByte(byte((shifted&0x1f)|0x20) + 63)
+		shifted >>= 5
+	}
+	encoded.WriteByte(byte(shifted) + 63)
+}
+
+// decodePolyline reverses coordinatePath.Polyline.
+func decodePolyline(encoded string) (coordinatePath, error) {
+	var path coordinatePath
+	var latitude, longitude int64
+	for i := 0; i < len(encoded); {
+		var deltas [2]int64
+		for d := range deltas {
+			var value int64
+			var shift uint
+			for {
+				if i >= len(encoded) {
+					return nil, fmt.Errorf("polyline %q is truncated", encoded)
+				}
+				b := int64(encoded[i]) - 63
+				i++
+				if b < 0 || b > 0x3f {
+					return nil, fmt.Errorf("polyline %q has invalid character", encoded)
+				}
+				value |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+			}
+			if value&1 != 0 {
+				value = ^value
+			}
+			deltas[d] = value >> 1
+		}
+		latitude += deltas[0]
+		longitude += deltas[1]
+		path = append(path, coordinate{Latitude: float64(latitude) / 1e5, Longitude: float64(longitude) / 1e5})
+	}
+	return path, nil
+}
+
+// Start returns the first coordinate in the path.
+func (p coordinatePath) Start() coordinate {
+	return p[0]
+}
+
+// End returns the last coordinate in the path.
+func (p coordinatePath) End() coordinate {
+	return p[len(p)-1]
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// The example from Google's polyline algorithm documentation
+var googlePolylineExample = coordinatePath{
+	{Latitude: 38.5, Longitude: -120.2},
+	{Latitude: 40.7, Longitude: -120.95},
+	{Latitude: 43.252, Longitude: -126.453},
+}
+
+func TestPolylineEncodesGoogleExample(t *testing.T) {
+	expected := "_p~iF~ps|U_ulLnnqC_mqNvxq`@"
+	if actual := googlePolylineExample.Polyline(); actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
+
+func TestDecodePolyline(t *testing.T) {
+	path, err := decodePolyline(googlePolylineExample.Polyline())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path) != len(googlePolylineExample) {
+		t.Fatalf("expected %d points, got %d", len(googlePolylineExample), len(path))
+	}
+	for i, c := range path {
+		expected := googlePolylineExample[i]
+		if math.Abs(c.Latitude-expected.Latitude) > 1e-9 || math.Abs(c.Longitude-expected.Longitude) > 1e-9 {
+			t.Errorf("point %d: expected %v, got %v", i, expected, c)
+		}
+	}
+
+	if _, err := decodePolyline("_p~iF~ps|"); err == nil {
+		t.Errorf("expected error for truncated polyline")
+	}
+}
+
+func TestTripRoute(t *testing.T) {
+	trip := UberHistoryItem{StartCity: UberHistoryCity{Latitude: 51.5, Longitude: -0.12}}
+	request := &UberRequestResponse{
+		Location:    UberRequestLocation{Latitude: 51.6, Longitude: -0.2},
+		Pickup:      &UberRequestLocation{Latitude: 51.51, Longitude: -0.13},
+		Destination: &UberRequestLocation{Latitude: 51.53, Longitude: -0.15},
+		Waypoints: []UberWaypoint{
+			{Latitude: 51.51, Longitude: -0.13, Type: "pickup"},
+			{Latitude: 51.52, Longitude: -0.14, Type: "dropoff"},
+			{Latitude: 51.53, Longitude: -0.15, Type: "dropoff"},
+		},
+	}
+
+	route := tripRoute(trip, request)
+	expected := coordinatePath{{51.51, -0.13}, {51.52, -0.14}, {51.53, -0.15}}
+	if len(route) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, route)
+	}
+	for i := range route {
+		if route[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, route)
+		}
+	}
+
+	route = tripRoute(trip, &UberRequestResponse{Location: request.Location})
+	if len(route) != 2 || route.Start().Latitude != 51.5 || route.End().Latitude != 51.6 {
+		t.Errorf("expected city centre to last location, got %v", route)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Buckets unused for this long are forgotten
+const idleBucketAge = time.Hour
+
+// rateLimiter is a set of token buckets, one per key, each refilling at rate
+// tokens a second up to burst tokens.
+type rateLimiter struct {
+	rate  float64
+	burst int
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens      float64
+	updated     time.Time
+	pausedUntil time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// Wait blocks until key has a token to spend, or the context is done.
+func (l *rateLimiter) Wait(ctx context.Context, key string) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	for {
+		wait := l.take(key, time.Now())
+		if wait == 0 {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Pause stops key being used for a while, e.g. after the provider said to
+// back off.
+func (l *rateLimiter) Pause(key string, duration time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket := l.bucket(key, time.Now())
+	if until := time.Now().Add(duration); until.After(bucket.pausedUntil) {
+		bucket.pausedUntil = until
+	}
+}
+
+// take spends a token if there is one, and otherwise returns how long until
+// there will be.
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket := l.bucket(key, now)
+	if now.Before(bucket.pausedUntil) {
+		return bucket.pausedUntil.Sub(now)
+	}
+
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.rate
+	if bucket.tokens > float64(l.burst) {
+		bucket.tokens = float64(l.burst)
+	}
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// bucket returns key's bucket, creating a full one if need be. The mutex must
+// be held.
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	bucket, exists := l.buckets[key]
+	if exists {
+		return bucket
+	}
+
+	for otherKey, other := range l.buckets {
+		if now.Sub(other.updated) > idleBucketAge && now.After(other.pausedUntil) {
+			delete(l.buckets, otherKey)
+		}
+	}
+	bucket = &tokenBucket{tokens: float64(l.burst), updated: now}
+	l.buckets[key] = bucket
+	return bucket
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var currencySymbols = map[string]string{
+	"GBP": "£",
+	"EUR": "€",
+	"USD": "$",
+}
+
+// formatAmount formats a bare receipt amount such as "2.20" or "-2.43" in
+// the receipt's currency, e.g. "£2.20" or "-£2.43".
+func formatAmount(amount, currencyCode string) string {
+	symbol, known := currencySymbols[strings.ToUpper(currencyCode)]
+	if !known {
+		return strings.TrimSpace(amount + " " + currencyCode)
+	}
+	if strings.HasPrefix(amount, "-") {
+		return "-" + symbol + strings.TrimPrefix(amount, "-")
+	}
+	return symbol + amount
+}
+
+// formatTripDuration turns a receipt duration of "HH:MM:SS" into e.g.
+// "11 min" or "1 h 5 min". Anything else is returned as is.
+func formatTripDuration(duration string) string {
+	parts := strings.Split(duration, ":")
+	if len(parts) != 3 {
+		return duration
+	}
+	var values [3]int
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return duration
+		}
+		values[i] = value
+	}
+
+	hours, minutes := values[0], values[1]
+	if values[2] >= 30 {
+		minutes++
+	}
+	if minutes == 60 {
+		hours, minutes = hours+1, 0
+	}
+	if hours > 0 {
+		return fmt.Sprintf("%d h %d min", hours, minutes)
+	}
+	return fmt.Sprintf("%d min", minutes)
+}
+
+var surgeMultiplierPattern = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*[x×]|[x×]\s*(\d+(?:\.\d+)?)`)
+
+// SurgeMultiplier returns the surge multiplier, parsed from the surge charge's
+// name (e.g. "Surge x1.5"), or 1 if there was no surge.
+func (r *UberReceiptResponse) SurgeMultiplier() float64 {
+	if r.SurgeCharge == nil {
+		return 1
+	}
+	match := surgeMultiplierPattern.FindStringSubmatch(r.SurgeCharge.Name)
+	if match == nil {
+		return 1
+	}
+	value := match[1]
+	if value == "" {
+		value = match[2]
+	}
+	multiplier, err := strconv.ParseFloat(value, 64)
+	if err != nil || multiplier < 1 {
+		return 1
+	}
+	return multiplier
+}
+
+// receiptBody renders the feed item body for a trip: a summary line, then the
+// fare breakdown.
+//
+//	£12.78 · 1.49 miles · 12 min · 1.5x surge · London
+//	Base Fare £2.20
+//	...
+func receiptBody(trip UberHistoryItem, receipt *UberReceiptResponse) string {
+	summary := []string{receipt.TotalCharged}
+	if receipt.Distance != "" {
+		summary = append(summary, strings.TrimSpace(receipt.Distance+" "+receipt.DistanceLabel))
+	}
+	if receipt.Duration != "" {
+		summary = append(summary, formatTripDuration(receipt.Duration))
+	}
+	if surge := receipt.SurgeMultiplier(); surge > 1 {
+		summary = append(summary, strconv.FormatFloat(surge, 'f', -1, 64)+"x surge")
+	}
+	if trip.StartCity.DisplayName != "" {
+		summary = append(summary, trip.StartCity.DisplayName)
+	}
+
+	lines := []string{strings.Join(summary, " · ")}
+	for _, charge := range receipt.Charges {
+		lines = append(lines, charge.Name+" "+formatAmount(charge.Amount, receipt.CurrencyCode))
+	}
+	if receipt.SurgeCharge != nil {
+		lines = append(lines, receipt.SurgeCharge.Name+" "+formatAmount(receipt.SurgeCharge.Amount, receipt.CurrencyCode))
+	}
+	for _, adjustment := range receipt.ChargeAdjustments {
+		lines = append(lines, adjustment.Name+" "+formatAmount(adjustment.Amount, receipt.CurrencyCode))
+	}
+	if receipt.Subtotal != "" && receipt.Subtotal != receipt.TotalCharged {
+		lines = append(lines, "Subtotal "+receipt.Subtotal)
+	}
+	return strings.Join(lines, "\n")
+}
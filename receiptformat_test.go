@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// From Uber's v1 receipt documentation, in pounds
+const testReceiptJson = `{
+	"request_id": "b5512127-a134-4bf4-b1ba-fe9f48f56d9d",
+	"charges": [
+		{"name": "Base Fare", "amount": "2.20", "type": "base_fare"},
+		{"name": "Distance", "amount": "2.75", "type": "distance"},
+		{"name": "Time", "amount": "3.57", "type": "time"}
+	],
+	"surge_charge": {"name": "Surge x1.5", "amount": "4.26", "type": "surge"},
+	"charge_adjustments": [
+		{"name": "Promotion", "amount": "-2.43", "type": "promotion"},
+		{"name": "Booking Fee", "amount": "1.00", "type": "booking_fee"},
+		{"name": "Rounding Down", "amount": "0.78", "type": "rounding_down"}
+	],
+	"normal_fare": "£8.52",
+	"subtotal": "£12.78",
+	"total_charged": "£5.92",
+	"total_owed": null,
+	"total_fare": "£5.92",
+	"currency_code": "GBP",
+	"duration": "00:11:35",
+	"distance": "1.49",
+	"distance_label": "miles"
+}`
+
+func decodeTestReceipt(t *testing.T) *UberReceiptResponse {
+	receipt := &UberReceiptResponse{}
+	if err := json.Unmarshal([]byte(testReceiptJson), receipt); err != nil {
+		t.Fatal(err)
+	}
+	return receipt
+}
+
+func TestUberReceiptDecodes(t *testing.T) {
+	receipt := decodeTestReceipt(t)
+	if receipt.DistanceLabel != "miles" || receipt.Duration != "00:11:35" || receipt.Subtotal != "£12.78" {
+		t.Errorf("unexpected receipt %+v", receipt)
+	}
+	if len(receipt.Charges) != 3 || len(receipt.ChargeAdjustments) != 3 || receipt.TotalOwed != nil {
+		t.Errorf("unexpected charges %+v", receipt)
+	}
+	if receipt.SurgeMultiplier() != 1.5 {
+		t.Errorf("expected 1.5x surge, got %f", receipt.SurgeMultiplier())
+	}
+}
+
+func TestReceiptBody(t *testing.T) {
+	trip := UberHistoryItem{StartCity: UberHistoryCity{DisplayName: "London"}}
+	expected := "£5.92 · 1.49 miles · 12 min · 1.5x surge · London\n" +
+		"Base Fare £2.20\n" +
+		"Distance £2.75\n" +
+		"Time £3.57\n" +
+		"Surge x1.5 £4.26\n" +
+		"Promotion -£2.43\n" +
+		"Booking Fee £1.00\n" +
+		"Rounding Down £0.78\n" +
+		"Subtotal £12.78"
+	if body := receiptBody(trip, decodeTestReceipt(t)); body != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, body)
+	}
+
+	bare := receiptBody(trip, &UberReceiptResponse{TotalCharged: "£5.92"})
+	if bare != "£5.92 · London" {
+		t.Errorf("expected just the total and city, got %q", bare)
+	}
+}
+
+func TestFormatTripDuration(t *testing.T) {
+	cases := map[string]string{
+		"00:11:35": "12 min",
+		"00:11:05": "11 min",
+		"01:04:50": "1 h 5 min",
+		"00:59:45": "1 h 0 min",
+		"11 min":   "11 min",
+	}
+	for duration, expected := range cases {
+		if actual := formatTripDuration(duration); actual != expected {
+			t.Errorf("%s: expected %s, got %s", duration, expected, actual)
+		}
+	}
+}
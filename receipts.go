@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type feedItem struct {
+	Title    string `json:"title"`
+	ImageUrl string `json:"image_url"`
+	Body     string `json:"body"`
+}
+
+// runJob runs a queued receipt job. Returning an error schedules a retry;
+// most often that's because Uber hasn't finished the receipt yet.
+func runJob(ctx context.Context, j *job) error {
+	session, err := sessions.Get(j.SessionId)
+	if err == ErrNoSuchSession {
+		log.Printf("Dropping %s job %s: session %s has logged out\n", j.Type, j.Id, j.SessionId)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch j.Type {
+	case transactionJob:
+		entry, err := processTransaction(ctx, session, *j.Transaction)
+		if err != nil {
+			return err
+		}
+		return ledger.Complete(transactionKey(j.Transaction.Id), entry)
+
+	case receiptReadyJob:
+		if _, err := ledger.Get(tripKey(j.RequestId)); err == nil {
+			log.Printf("Trip %s already published\n", j.RequestId)
+			return nil
+		}
+		uberToken := session.uberToken()
+		trip, err := findTrip(ctx, uberApiClient, uberToken, j.RequestId, historyFilter{})
+		if err != nil {
+			return err
+		}
+		receipt, err := uberApiClient.GetReceiptContext(ctx, uberToken, j.RequestId)
+		if err != nil {
+			return err
+		}
+		_, err = publishTrip(ctx, session, *trip, receipt, nil)
+		return err
+
+	case backfillJob:
+		return runBackfillJob(ctx, session, j)
+
+	case reviewedJob:
+		return attachReviewedTrip(ctx, session, *j.Transaction, j.RequestId)
+	}
+
+	log.Printf("Dropping job %s of unknown type %s\n", j.Id, j.Type)
+	return nil
+}
+
+// jobDeadLettered releases a failed transaction from the ledger, so that if
+// Mondo delivers it again it gets another chance, lets the user pick a trip
+// again for a review that failed, and marks a failed backfill as such so the
+// user can start another.
+func jobDeadLettered(j *job) {
+	switch j.Type {
+	case transactionJob:
+		if err := ledger.Release(transactionKey(j.Transaction.Id)); err != nil {
+			log.Printf("Job %s ledger release error: %s\n", j.Id, err.Error())
+		}
+
+	case reviewedJob:
+		// Let the user pick again
+		if err := reviews.Pick(j.Transaction.Id, ""); err != nil && err != ErrNoSuchReview {
+			log.Printf("Job %s review unpick error: %s\n", j.Id, err.Error())
+		}
+
+	case backfillJob:
+		progress, err := backfills.Get(j.SessionId)
+		if err != nil || progress.JobId != j.Id {
+			return
+		}
+		progress.Status = backfillFailed
+		progress.LastError = j.LastError
+		progress.Updated = time.Now()
+		if err := backfills.Put(progress); err != nil {
+			log.Printf("Job %s backfill update error: %s\n", j.Id, err.Error())
+		}
+	}
+}
+
+// processTransaction matches a Mondo transaction to an Uber trip, publishes
+// its receipt and attaches it to the transaction, or records the transaction
+// for review if there's no confident match.
+func processTransaction(ctx context.Context, session *session, transaction WebhookData) (*ledgerEntry, error) {
+	match, err := matchTransaction(ctx, uberApiClient, session.uberToken(), transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if !match.Confident {
+		log.Printf("Transaction %s needs review: %s\n", transaction.Id, match.Reason)
+		err = reviews.Add(newReviewItem(session.sessionId, transaction, match))
+		if err != nil {
+			return nil, err
+		}
+		return &ledgerEntry{
+			Status:        ledgerReview,
+			TransactionId: transaction.Id,
+			SessionId:     session.sessionId,
+		}, nil
+	}
+
+	log.Printf("Transaction %s matched trip %s\n", transaction.Id, match.Best().Trip.RequestId)
+	return publishAndAttach(ctx, session, transaction, match.Best().Trip, match.Best().Receipt)
+}
+
+// publishAndAttach publishes a trip's receipt, unless it has been already,
+// and attaches it to the transaction that paid for the trip.
+func publishAndAttach(ctx context.Context, session *session, transaction WebhookData, trip UberHistoryItem, receipt *UberReceiptResponse) (*ledgerEntry, error) {
+	entry, err := publishTrip(ctx, session, trip, receipt, &transaction)
+	if err != nil {
+		return nil, err
+	}
+	if entry.FeedItem == nil {
+		// The Uber receipt webhook is publishing it right now
+		return nil, fmt.Errorf("trip %s is still being published", trip.RequestId)
+	}
+
+	attachmentId, err := attachReceipt(ctx, session, transaction.Id, trip, receipt, entry.FeedItem.ImageUrl)
+	if err != nil {
+		return nil, err
+	}
+	entry.TransactionId = transaction.Id
+	entry.AttachmentId = attachmentId
+	return entry, nil
+}
+
+// attachReviewedTrip attaches the trip a user picked to a transaction that
+// needed review, and then resolves the review.
+func attachReviewedTrip(ctx context.Context, session *session, transaction WebhookData, requestId string) error {
+	// A retry after the attachment was made mustn't attach it again
+	if entry, err := ledger.Get(transactionKey(transaction.Id)); err == nil && entry.AttachmentId != "" {
+		log.Printf("Transaction %s already has attachment %s\n", transaction.Id, entry.AttachmentId)
+		return reviews.Delete(transaction.Id)
+	}
+
+	created, err := time.Parse(time.RFC3339, transaction.Created)
+	if err != nil {
+		return fmt.Errorf("transaction %s created: %s", transaction.Id, err.Error())
+	}
+	uberToken := session.uberToken()
+	// The candidates came from this window, see matchTransaction
+	trip, err := findTrip(ctx, uberApiClient, uberToken, requestId, historyFilter{
+		Since: created.Add(-matchWindow),
+		Until: created.Add(matchWindow),
+	})
+	if err != nil {
+		return err
+	}
+	receipt, err := uberApiClient.GetReceiptContext(ctx, uberToken, requestId)
+	if err != nil {
+		return err
+	}
+
+	entry, err := publishAndAttach(ctx, session, transaction, *trip, receipt)
+	if err != nil {
+		return err
+	}
+	if err := ledger.Complete(transactionKey(transaction.Id), entry); err != nil {
+		return err
+	}
+	log.Printf("Transaction %s reviewed, attached trip %s\n", transaction.Id, requestId)
+	return reviews.Delete(transaction.Id)
+}
+
+// attachReceipt attaches the receipt's route map to a Mondo transaction, and
+// records the trip ID, distance, duration and total on it as metadata. It returns the
+// attachment ID.
+func attachReceipt(ctx context.Context, session *session, transactionId string, trip UberHistoryItem, receipt *UberReceiptResponse, imageUrl string) (string, error) {
+	image, err := mapImage(ctx, imageUrl)
+	if err != nil {
+		return "", err
+	}
+	fileType := http.DetectContentType(image)
+
+	mondoToken := session.mondoToken()
+	upload, err := mondoApiClient.RequestAttachmentUploadContext(ctx, mondoToken, fmt.Sprintf("uber-%s.png", trip.RequestId), fileType, len(image))
+	if err != nil {
+		return "", err
+	}
+	if err := mondoApiClient.UploadAttachmentContext(ctx, upload.UploadUrl, fileType, image); err != nil {
+		return "", err
+	}
+	registered, err := mondoApiClient.RegisterAttachmentContext(ctx, mondoToken, transactionId, upload.FileUrl, fileType)
+	if err != nil {
+		return "", err
+	}
+
+	err = mondoApiClient.AnnotateTransactionContext(ctx, mondoToken, transactionId, map[string]string{
+		"uber_trip_id":       trip.RequestId,
+		"uber_distance":      fmt.Sprintf("%s %s", receipt.Distance, receipt.DistanceLabel),
+		"uber_duration":      receipt.Duration,
+		"uber_total_charged": receipt.TotalCharged,
+	})
+	if err != nil {
+		// Don't leave an attachment behind for the retry to duplicate
+		if deregisterErr := mondoApiClient.DeregisterAttachmentContext(ctx, mondoToken, registered.Attachment.Id); deregisterErr != nil {
+			log.Printf("Attachment %s deregister error: %s\n", registered.Attachment.Id, deregisterErr.Error())
+		}
+		return "", err
+	}
+
+	log.Printf("Attached trip %s to transaction %s\n", trip.RequestId, transactionId)
+	return registered.Attachment.Id, nil
+}
+
+// mapImage returns the map behind a feed item's image proxy URL. Maps from
+// local tiles are drawn here, and others come from the proxy's cache or
+// upstream, rather than fetching our own public URL.
+func mapImage(ctx context.Context, imageUrl string) ([]byte, error) {
+	target, err := images.Target(imageUrl)
+	if err != nil {
+		return nil, err
+	}
+	if tileMaps != nil {
+		if mapId, ok := tileMaps.MapId(target); ok {
+			return tileMaps.Render(mapId)
+		}
+	}
+	return images.Fetch(ctx, target)
+}
+
+// publishTrip publishes a trip's receipt unless it has been already, e.g. by
+// the Uber receipt webhook beating the Mondo transaction. transaction is the
+// matched Mondo transaction, or nil if it hasn't arrived yet.
+func publishTrip(ctx context.Context, session *session, trip UberHistoryItem, receipt *UberReceiptResponse, transaction *WebhookData) (*ledgerEntry, error) {
+	key := tripKey(trip.RequestId)
+	claimed, err := ledger.Claim(key)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		log.Printf("Trip %s already published\n", trip.RequestId)
+		return ledger.Get(key)
+	}
+
+	item, err := publishReceipt(ctx, session, trip, receipt, transaction)
+	if err != nil {
+		if releaseErr := ledger.Release(key); releaseErr != nil {
+			log.Printf("Trip %s release error: %s\n", trip.RequestId, releaseErr.Error())
+		}
+		return nil, err
+	}
+
+	entry := &ledgerEntry{
+		Status:    ledgerPublished,
+		RequestId: trip.RequestId,
+		SessionId: session.sessionId,
+		FeedItem:  item,
+	}
+	return entry, ledger.Complete(key, entry)
+}
+
+// publishReceipt posts a feed item with the trip's receipt and route map to
+// the session's Mondo account, using the session's feed item templates.
+func publishReceipt(ctx context.Context, session *session, trip UberHistoryItem, receipt *UberReceiptResponse, transaction *WebhookData) (*feedItem, error) {
+	imageUrl, err := tripImageUrl(ctx, session, trip)
+	if err != nil {
+		return nil, err
+	}
+
+	title, body := session.feedItemText(newFeedTemplateData(trip, receipt, transaction))
+	item := &feedItem{
+		Title:    title,
+		ImageUrl: imageUrl,
+		Body:     body,
+	}
+
+	err = mondoApiClient.CreateFeedItemContext(
+		ctx,
+		session.mondoToken(),
+		session.mondoAccountId,
+		"image",
+		item.Title,
+		item.ImageUrl,
+		item.Body)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// tripImageUrl returns the image proxy URL of a trip's route map.
+func tripImageUrl(ctx context.Context, session *session, trip UberHistoryItem) (string, error) {
+	uberRequestResponse, err := uberApiClient.GetRequestContext(ctx, session.uberToken(), trip.RequestId)
+	if err != nil {
+		return "", err
+	}
+
+	mapUrl, err := maps.MapUrl(tripRoute(trip, uberRequestResponse))
+	if err != nil {
+		return "", err
+	}
+
+	// Mondo fetches the image every time the feed item is viewed, so give it
+	// our cached copy rather than the map URL.
+	return images.SignedUrl(mapUrl)
+}
+
+// tripRoute returns the route a trip took: the pickup, any shared ride
+// waypoints, then the dropoff. Older trips may lack the pickup or
+// destination, in which case the city centre and last reported location are
+// used instead.
+func tripRoute(trip UberHistoryItem, request *UberRequestResponse) coordinatePath {
+	route := coordinatePath{{
+		Latitude:  trip.StartCity.Latitude,
+		Longitude: trip.StartCity.Longitude,
+	}}
+	if request.Pickup != nil {
+		route[0] = coordinate{Latitude: request.Pickup.Latitude, Longitude: request.Pickup.Longitude}
+	}
+
+	for _, waypoint := range request.Waypoints {
+		point := coordinate{Latitude: waypoint.Latitude, Longitude: waypoint.Longitude}
+		if point != route[len(route)-1] {
+			route = append(route, point)
+		}
+	}
+
+	end := coordinate{Latitude: request.Location.Latitude, Longitude: request.Location.Longitude}
+	if request.Destination != nil {
+		end = coordinate{Latitude: request.Destination.Latitude, Longitude: request.Destination.Longitude}
+	}
+	if end != route[len(route)-1] || len(route) == 1 {
+		route = append(route, end)
+	}
+	return route
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var reviewsBucket = []byte("reviews")
+
+var ErrNoSuchReview = errors.New("no such review")
+var ErrReviewPicked = errors.New("a trip has already been picked for this transaction")
+
+// reviewItem is a Mondo transaction that looked like an Uber payment but
+// couldn't be confidently matched to a trip, kept so someone can look at it
+// rather than the user getting the wrong receipt.
+type reviewItem struct {
+	TransactionId string            `json:"transaction_id"`
+	SessionId     string            `json:"session_id"`
+	Transaction   WebhookData       `json:"transaction"`
+	Reason        string            `json:"reason"`
+	Candidates    []reviewCandidate `json:"candidates"`
+	Created       time.Time         `json:"created"`
+	// Picked is the trip the user picked, while it's being attached
+	Picked string `json:"picked,omitempty"`
+}
+
+type reviewCandidate struct {
+	RequestId    string  `json:"request_id"`
+	TotalCharged string  `json:"total_charged"`
+	EndTime      int64   `json:"end_time"`
+	Score        float64 `json:"score"`
+}
+
+func newReviewItem(sessionId string, transaction WebhookData, result *matchResult) *reviewItem {
+	item := &reviewItem{
+		TransactionId: transaction.Id,
+		SessionId:     sessionId,
+		Transaction:   transaction,
+		Reason:        result.Reason,
+		Created:       time.Now(),
+	}
+	for _, candidate := range result.Candidates {
+		item.Candidates = append(item.Candidates, reviewCandidate{
+			RequestId:    candidate.Trip.RequestId,
+			TotalCharged: candidate.Receipt.TotalCharged,
+			EndTime:      candidate.Trip.EndTime,
+			Score:        candidate.Score,
+		})
+	}
+	return item
+}
+
+// Amount formats the transaction's amount for people, e.g. "12.34 GBP".
+func (i *reviewItem) Amount() string {
+	amount := int64(i.Transaction.Amount)
+	if amount < 0 {
+		amount = -amount
+	}
+	return fmt.Sprintf("%d.%02d %s", amount/100, amount%100, i.Transaction.Currency)
+}
+
+// Ended formats when the candidate trip ended, in UTC.
+func (c reviewCandidate) Ended() string {
+	return time.Unix(c.EndTime, 0).UTC().Format("2 Jan 2006 15:04")
+}
+
+// ReviewStore records transactions that need a human to match them.
+type ReviewStore interface {
+	Add(item *reviewItem) error
+	List() ([]*reviewItem, error)
+	Delete(transactionId string) error
+	// Pick atomically records the trip the user picked for a transaction,
+	// returning ErrReviewPicked if one already was. An empty requestId
+	// clears the pick, e.g. so the user can try again after it failed.
+	Pick(transactionId, requestId string) error
+}
+
+// pick changes item as Pick would.
+func (i *reviewItem) pick(requestId string) error {
+	if requestId != "" && i.Picked != "" {
+		return ErrReviewPicked
+	}
+	i.Picked = requestId
+	return nil
+}
+
+type memoryReviewStore struct {
+	mutex sync.RWMutex
+	items map[string]*reviewItem
+}
+
+func newMemoryReviewStore() *memoryReviewStore {
+	return &memoryReviewStore{items: make(map[string]*reviewItem)}
+}
+
+func (m *memoryReviewStore) Add(item *reviewItem) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	copy := *item
+	m.items[item.TransactionId] = &copy
+	return nil
+}
+
+func (m *memoryReviewStore) List() ([]*reviewItem, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	items := make([]*reviewItem, 0, len(m.items))
+	for _, item := range m.items {
+		copy := *item
+		items = append(items, &copy)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Created.Before(items[j].Created) })
+	return items, nil
+}
+
+func (m *memoryReviewStore) Delete(transactionId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.items, transactionId)
+	return nil
+}
+
+func (m *memoryReviewStore) Pick(transactionId, requestId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	item, exists := m.items[transactionId]
+	if !exists {
+		return ErrNoSuchReview
+	}
+	return item.pick(requestId)
+}
+
+type boltReviewStore struct {
+	db *bolt.DB
+}
+
+func newBoltReviewStore(db *bolt.DB) (*boltReviewStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(reviewsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltReviewStore{db: db}, nil
+}
+
+func (b *boltReviewStore) Add(item *reviewItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(reviewsBucket).Put([]byte(item.TransactionId), data)
+	})
+}
+
+func (b *boltReviewStore) List() ([]*reviewItem, error) {
+	var items []*reviewItem
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(reviewsBucket).ForEach(func(key, data []byte) error {
+			item := &reviewItem{}
+			if err := json.Unmarshal(data, item); err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Created.Before(items[j].Created) })
+	return items, nil
+}
+
+func (b *boltReviewStore) Delete(transactionId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(reviewsBucket).Delete([]byte(transactionId))
+	})
+}
+
+func (b *boltReviewStore) Pick(transactionId, requestId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(reviewsBucket)
+		data := bucket.Get([]byte(transactionId))
+		if data == nil {
+			return ErrNoSuchReview
+		}
+		item := &reviewItem{}
+		if err := json.Unmarshal(data, item); err != nil {
+			return err
+		}
+		if err := item.pick(requestId); err != nil {
+			return err
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(transactionId), data)
+	})
+}
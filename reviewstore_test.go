@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testReviewStore(t *testing.T, store ReviewStore) {
+	items, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("expected no items, got %+v", items)
+	}
+
+	older := &reviewItem{
+		TransactionId: "tx_1",
+		SessionId:     "abc",
+		Transaction:   WebhookData{Id: "tx_1", Amount: -1234, Currency: "GBP"},
+		Reason:        "no trip matches",
+		Created:       time.Now().Add(-time.Hour),
+	}
+	newer := &reviewItem{
+		TransactionId: "tx_2",
+		SessionId:     "abc",
+		Candidates:    []reviewCandidate{{RequestId: "trip_1", TotalCharged: "£5.00", Score: 0.5}},
+		Created:       time.Now(),
+	}
+	for _, item := range []*reviewItem{newer, older} {
+		if err := store.Add(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].TransactionId != "tx_1" || items[1].TransactionId != "tx_2" {
+		t.Fatalf("expected oldest first, got %+v", items)
+	}
+	if items[0].Reason != "no trip matches" || len(items[1].Candidates) != 1 || items[1].Candidates[0].RequestId != "trip_1" {
+		t.Errorf("unexpected items %+v", items)
+	}
+
+	if err := store.Pick("tx_2", "trip_1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Pick("tx_2", "trip_1"); err != ErrReviewPicked {
+		t.Errorf("expected ErrReviewPicked picking twice, got %v", err)
+	}
+	if items, _ := store.List(); items[1].Picked != "trip_1" {
+		t.Errorf("expected tx_2 to be picked, got %+v", items[1])
+	}
+	if err := store.Pick("tx_2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Pick("tx_2", "trip_1"); err != nil {
+		t.Errorf("expected a cleared pick to be pickable again, got %v", err)
+	}
+	if err := store.Pick("missing", "trip_1"); err != ErrNoSuchReview {
+		t.Errorf("expected ErrNoSuchReview, got %v", err)
+	}
+
+	if err := store.Delete("tx_1"); err != nil {
+		t.Fatal(err)
+	}
+	items, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].TransactionId != "tx_2" {
+		t.Errorf("expected only tx_2 after delete, got %+v", items)
+	}
+}
+
+func TestMemoryReviewStore(t *testing.T) {
+	testReviewStore(t, newMemoryReviewStore())
+}
+
+func TestBoltReviewStore(t *testing.T) {
+	db := newTestBoltDb(t)
+	defer closeTestBoltDb(db)
+
+	store, err := newBoltReviewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReviewStore(t, store)
+}
+
+func TestReviewItemFormatting(t *testing.T) {
+	item := &reviewItem{Transaction: WebhookData{Amount: -1205, Currency: "GBP"}}
+	if amount := item.Amount(); amount != "12.05 GBP" {
+		t.Errorf("unexpected amount %s", amount)
+	}
+	candidate := reviewCandidate{EndTime: time.Date(2015, 9, 20, 18, 5, 0, 0, time.UTC).Unix()}
+	if ended := candidate.Ended(); ended != "20 Sep 2015 18:05" {
+		t.Errorf("unexpected end time %s", ended)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var ErrNoSuchSession = errors.New("no such session")
+
+var sessionsBucket = []byte("sessions")
+
+// SessionStore persists linked Mondo/Uber sessions. Get returns a copy, so
+// callers must save a session after changing it. Put replaces the whole
+// session, so to change an existing one use Update, which won't undo a
+// concurrent change to other fields.
+type SessionStore interface {
+	Get(sessionId string) (*session, error)
+	FindByUberUserId(uberUserId string) (*session, error)
+	// ListByUberUserId returns every session linked to the Uber user, e.g.
+	// so a new login can supersede the earlier ones.
+	ListByUberUserId(uberUserId string) ([]*session, error)
+	Put(s *session) error
+	// Update changes a session atomically: change is called with the latest
+	// copy, which is saved unless it returns an error.
+	Update(sessionId string, change func(s *session) error) error
+	Delete(sessionId string) error
+	// DeleteExpiredLogins deletes sessions whose login was never finished
+	// and has expired by now, returning how many there were.
+	DeleteExpiredLogins(now time.Time) (int, error)
+}
+
+// sessionRecord is the serialised form of a session.
+type sessionRecord struct {
+	SessionId          string    `json:"session_id"`
+	OAuthState         string    `json:"oauth_state,omitempty"`
+	LoginExpiry        time.Time `json:"login_expiry"`
+	MondoAccessToken   string    `json:"mondo_access_token"`
+	MondoRefreshToken  string    `json:"mondo_refresh_token,omitempty"`
+	MondoTokenExpiry   time.Time `json:"mondo_token_expiry"`
+	MondoAccountId     string    `json:"mondo_account_id"`
+	MondoWebhookId     string    `json:"mondo_webhook_id"`
+	MondoWebhookSecret string    `json:"mondo_webhook_secret,omitempty"`
+	UberUserId         string    `json:"uber_user_id,omitempty"`
+	UberAccessToken    string    `json:"uber_access_token"`
+	UberRefreshToken   string    `json:"uber_refresh_token,omitempty"`
+	UberTokenExpiry    time.Time `json:"uber_token_expiry"`
+	FeedTitleTemplate  string    `json:"feed_title_template,omitempty"`
+	FeedBodyTemplate   string    `json:"feed_body_template,omitempty"`
+}
+
+// newSessionRecord serialises s, encrypting its tokens with c.
+func newSessionRecord(s *session, c *tokenCipher) (*sessionRecord, error) {
+	r := &sessionRecord{
+		SessionId:          s.sessionId,
+		OAuthState:         s.oauthState,
+		LoginExpiry:        s.loginExpiry,
+		MondoAccessToken:   s.mondoAccessToken,
+		MondoRefreshToken:  s.mondoRefreshToken,
+		MondoTokenExpiry:   s.mondoTokenExpiry,
+		MondoAccountId:     s.mondoAccountId,
+		MondoWebhookId:     s.mondoWebhookId,
+		MondoWebhookSecret: s.mondoWebhookSecret,
+		UberUserId:         s.uberUserId,
+		UberAccessToken:    s.uberAccessToken,
+		UberRefreshToken:   s.uberRefreshToken,
+		UberTokenExpiry:    s.uberTokenExpiry,
+		FeedTitleTemplate:  s.feedTitleTemplate,
+		FeedBodyTemplate:   s.feedBodyTemplate,
+	}
+	for _, secret := range r.secrets() {
+		encrypted, err := c.Encrypt(*secret)
+		if err != nil {
+			return nil, err
+		}
+		*secret = encrypted
+	}
+	return r, nil
+}
+
+func (r *sessionRecord) session(c *tokenCipher) (*session, error) {
+	for _, secret := range r.secrets() {
+		decrypted, err := c.Decrypt(*secret)
+		if err != nil {
+			return nil, err
+		}
+		*secret = decrypted
+	}
+	return &session{
+		sessionId:          r.SessionId,
+		oauthState:         r.OAuthState,
+		loginExpiry:        r.LoginExpiry,
+		mondoAccessToken:   r.MondoAccessToken,
+		mondoRefreshToken:  r.MondoRefreshToken,
+		mondoTokenExpiry:   r.MondoTokenExpiry,
+		mondoAccountId:     r.MondoAccountId,
+		mondoWebhookId:     r.MondoWebhookId,
+		mondoWebhookSecret: r.MondoWebhookSecret,
+		uberUserId:         r.UberUserId,
+		uberAccessToken:    r.UberAccessToken,
+		uberRefreshToken:   r.UberRefreshToken,
+		uberTokenExpiry:    r.UberTokenExpiry,
+		feedTitleTemplate:  r.FeedTitleTemplate,
+		feedBodyTemplate:   r.FeedBodyTemplate,
+	}, nil
+}
+
+// loginExpired reports whether the session's login was never finished, by
+// registering the Mondo webhook, and has expired by now.
+func (s *session) loginExpired(now time.Time) bool {
+	return s.mondoWebhookId == "" && !now.Before(s.loginExpiry)
+}
+
+// secrets returns the fields that are encrypted at rest.
+func (r *sessionRecord) secrets() []*string {
+	return []*string{&r.MondoAccessToken, &r.MondoRefreshToken, &r.MondoWebhookSecret, &r.UberAccessToken, &r.UberRefreshToken}
+}
+
+func (r *sessionRecord) needsRotation(c *tokenCipher) bool {
+	for _, secret := range r.secrets() {
+		if c.NeedsRotation(*secret) {
+			return true
+		}
+	}
+	return false
+}
+
+type memorySessionStore struct {
+	mutex    sync.RWMutex
+	sessions map[string]*session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]*session)}
+}
+
+func (m *memorySessionStore) Get(sessionId string) (*session, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	s, exists := m.sessions[sessionId]
+	if !exists {
+		return nil, ErrNoSuchSession
+	}
+	copy := *s
+	return &copy, nil
+}
+
+func (m *memorySessionStore) FindByUberUserId(uberUserId string) (*session, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, s := range m.sessions {
+		if uberUserId != "" && s.uberUserId == uberUserId {
+			copy := *s
+			return &copy, nil
+		}
+	}
+	return nil, ErrNoSuchSession
+}
+
+func (m *memorySessionStore) ListByUberUserId(uberUserId string) ([]*session, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var found []*session
+	for _, s := range m.sessions {
+		if uberUserId != "" && s.uberUserId == uberUserId {
+			copy := *s
+			found = append(found, &copy)
+		}
+	}
+	return found, nil
+}
+
+func (m *memorySessionStore) Put(s *session) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	copy := *s
+	m.sessions[s.sessionId] = &copy
+	return nil
+}
+
+func (m *memorySessionStore) Update(sessionId string, change func(s *session) error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s, exists := m.sessions[sessionId]
+	if !exists {
+		return ErrNoSuchSession
+	}
+	copy := *s
+	if err := change(&copy); err != nil {
+		return err
+	}
+	copy.sessionId = sessionId
+	m.sessions[sessionId] = &copy
+	return nil
+}
+
+func (m *memorySessionStore) Delete(sessionId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.sessions, sessionId)
+	return nil
+}
+
+func (m *memorySessionStore) DeleteExpiredLogins(now time.Time) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	deleted := 0
+	for sessionId, s := range m.sessions {
+		if s.loginExpired(now) {
+			delete(m.sessions, sessionId)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// boltSessionStore keeps sessions in a BoltDB file with their tokens
+// encrypted by cipher.
+type boltSessionStore struct {
+	db     *bolt.DB
+	cipher *tokenCipher
+}
+
+func newBoltSessionStore(db *bolt.DB, cipher *tokenCipher) (*boltSessionStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &boltSessionStore{db: db, cipher: cipher}, nil
+}
+
+func (b *boltSessionStore) Get(sessionId string) (*session, error) {
+	record := &sessionRecord{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(sessionsBucket).Get([]byte(sessionId))
+		if data == nil {
+			return ErrNoSuchSession
+		}
+		return json.Unmarshal(data, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record.session(b.cipher)
+}
+
+func (b *boltSessionStore) FindByUberUserId(uberUserId string) (*session, error) {
+	var found *sessionRecord
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(key, data []byte) error {
+			record := &sessionRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				return err
+			}
+			if found == nil && uberUserId != "" && record.UberUserId == uberUserId {
+				found = record
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrNoSuchSession
+	}
+	return found.session(b.cipher)
+}
+
+func (b *boltSessionStore) ListByUberUserId(uberUserId string) ([]*session, error) {
+	var records []*sessionRecord
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(key, data []byte) error {
+			record := &sessionRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				return err
+			}
+			if uberUserId != "" && record.UberUserId == uberUserId {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	found := make([]*session, 0, len(records))
+	for _, record := range records {
+		s, err := record.session(b.cipher)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, s)
+	}
+	return found, nil
+}
+
+func (b *boltSessionStore) Put(s *session) error {
+	record, err := newSessionRecord(s, b.cipher)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(s.sessionId), data)
+	})
+}
+
+func (b *boltSessionStore) Update(sessionId string, change func(s *session) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		data := bucket.Get([]byte(sessionId))
+		if data == nil {
+			return ErrNoSuchSession
+		}
+		record := &sessionRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return err
+		}
+		s, err := record.session(b.cipher)
+		if err != nil {
+			return err
+		}
+		if err := change(s); err != nil {
+			return err
+		}
+		s.sessionId = sessionId
+		record, err = newSessionRecord(s, b.cipher)
+		if err != nil {
+			return err
+		}
+		data, err = json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(sessionId), data)
+	})
+}
+
+func (b *boltSessionStore) Delete(sessionId string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(sessionId))
+	})
+}
+
+func (b *boltSessionStore) DeleteExpiredLogins(now time.Time) (int, error) {
+	deleted := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		var expired [][]byte
+		err := bucket.ForEach(func(key, data []byte) error {
+			record := &sessionRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				return err
+			}
+			// Only unencrypted fields are needed to tell
+			s := &session{mondoWebhookId: record.MondoWebhookId, loginExpiry: record.LoginExpiry}
+			if s.loginExpired(now) {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Bolt doesn't allow modifying a bucket while iterating over it.
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	return deleted, err
+}
+
+// RotateKeys re-encrypts every stored token that is still in plaintext or
+// sealed with a key other than the primary one. It returns the number of
+// sessions rewritten.
+func (b *boltSessionStore) RotateKeys() (int, error) {
+	rotated := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		updates := make(map[string][]byte)
+		err := bucket.ForEach(func(key, data []byte) error {
+			record := &sessionRecord{}
+			if err := json.Unmarshal(data, record); err != nil {
+				return err
+			}
+			if !record.needsRotation(b.cipher) {
+				return nil
+			}
+			s, err := record.session(b.cipher)
+			if err != nil {
+				return err
+			}
+			record, err = newSessionRecord(s, b.cipher)
+			if err != nil {
+				return err
+			}
+			updated, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			updates[string(key)] = updated
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Bolt doesn't allow modifying a bucket while iterating over it.
+		for key, data := range updates {
+			if err := bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		rotated = len(updates)
+		return nil
+	})
+	return rotated, err
+}
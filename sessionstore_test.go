@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestBoltDb(t *testing.T) *bolt.DB {
+	dir, err := ioutil.TempDir("", "uber-mondo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func closeTestBoltDb(db *bolt.DB) {
+	db.Close()
+	os.RemoveAll(filepath.Dir(db.Path()))
+}
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	_, err := store.Get("missing")
+	if err != ErrNoSuchSession {
+		t.Fatalf("expected ErrNoSuchSession, got %v", err)
+	}
+
+	s := &session{
+		sessionId:        "abc",
+		mondoAccessToken: "mondo-token",
+		mondoAccountId:   "acc_1",
+		mondoWebhookId:   "webhook_1",
+		uberUserId:       "uber-user",
+		uberAccessToken:  "uber-token",
+		feedBodyTemplate: "{{.Receipt.TotalCharged}}",
+	}
+	if err := store.Put(s); err != nil {
+		t.Fatal(err)
+	}
+
+	s.uberAccessToken = "changed"
+	loaded, err := store.Get("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.uberAccessToken != "uber-token" || loaded.mondoAccountId != "acc_1" || loaded.mondoWebhookId != "webhook_1" || loaded.feedBodyTemplate != s.feedBodyTemplate {
+		t.Errorf("unexpected session %+v", loaded)
+	}
+
+	found, err := store.FindByUberUserId("uber-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.sessionId != "abc" || found.uberAccessToken != "uber-token" {
+		t.Errorf("unexpected session %+v", found)
+	}
+	if _, err := store.FindByUberUserId("someone-else"); err != ErrNoSuchSession {
+		t.Errorf("expected ErrNoSuchSession for unknown Uber user, got %v", err)
+	}
+	if err := store.Put(&session{sessionId: "def", uberUserId: "uber-user"}); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := store.ListByUberUserId("uber-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].sessionId == listed[1].sessionId {
+		t.Errorf("expected both of the Uber user's sessions, got %+v", listed)
+	}
+	if listed, _ := store.ListByUberUserId(""); len(listed) != 0 {
+		t.Errorf("expected no sessions without an Uber user, got %+v", listed)
+	}
+	if err := store.Delete("def"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update("abc", func(s *session) error {
+		s.mondoWebhookId = "webhook_2"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("failed")
+	err = store.Update("abc", func(s *session) error {
+		s.mondoWebhookId = "lost"
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected the change's error, got %v", err)
+	}
+	loaded, err = store.Get("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.mondoWebhookId != "webhook_2" || loaded.uberAccessToken != "uber-token" {
+		t.Errorf("unexpected session after update %+v", loaded)
+	}
+	if err := store.Update("missing", func(*session) error { return nil }); err != ErrNoSuchSession {
+		t.Errorf("expected ErrNoSuchSession updating a missing session, got %v", err)
+	}
+
+	// Concurrent updates don't overwrite each other
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.Update("abc", func(s *session) error {
+				s.feedTitleTemplate += "x"
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	loaded, err = store.Get("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.feedTitleTemplate) != 20 {
+		t.Errorf("expected 20 updates, got %q", loaded.feedTitleTemplate)
+	}
+
+	// Only unfinished logins expire
+	abandoned := &session{sessionId: "abandoned", loginExpiry: time.Now().Add(-time.Minute)}
+	inProgress := &session{sessionId: "in-progress", loginExpiry: time.Now().Add(time.Minute)}
+	for _, s := range []*session{abandoned, inProgress} {
+		if err := store.Put(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, err := store.DeleteExpiredLogins(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 expired login deleted, got %d", deleted)
+	}
+	for sessionId, expected := range map[string]error{"abandoned": ErrNoSuchSession, "in-progress": nil, "abc": nil} {
+		if _, err := store.Get(sessionId); err != expected {
+			t.Errorf("expected %v getting %s, got %v", expected, sessionId, err)
+		}
+	}
+
+	if err := store.Delete("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("abc"); err != ErrNoSuchSession {
+		t.Errorf("expected ErrNoSuchSession after delete, got %v", err)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, newMemorySessionStore())
+}
+
+func TestBoltSessionStore(t *testing.T) {
+	db := newTestBoltDb(t)
+	defer closeTestBoltDb(db)
+
+	store, err := newBoltSessionStore(db, newTestTokenCipher(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSessionStore(t, store)
+}
+
+func TestBoltSessionStoreEncryptsTokens(t *testing.T) {
+	db := newTestBoltDb(t)
+	defer closeTestBoltDb(db)
+
+	store, err := newBoltSessionStore(db, newTestTokenCipher(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(&session{sessionId: "abc", mondoAccessToken: "mondo-token", uberAccessToken: "uber-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		data := string(tx.Bucket(sessionsBucket).Get([]byte("abc")))
+		if strings.Contains(data, "mondo-token") || strings.Contains(data, "uber-token") {
+			t.Errorf("tokens stored in plaintext: %s", data)
+		}
+		return nil
+	})
+}
+
+func TestBoltSessionStoreRotateKeys(t *testing.T) {
+	db := newTestBoltDb(t)
+	defer closeTestBoltDb(db)
+
+	oldCipher := newTestTokenCipher(t, 1)
+	store, err := newBoltSessionStore(db, oldCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(&session{sessionId: "abc", mondoAccessToken: "mondo-token", uberAccessToken: "uber-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New primary key, old key kept for decryption.
+	newCipher, err := newTokenCipher([][]byte{testKey(2), testKey(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.cipher = newCipher
+	rotated, err := store.RotateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 1 {
+		t.Errorf("expected 1 session rotated, got %d", rotated)
+	}
+
+	// The old key is no longer needed.
+	store.cipher = newTestTokenCipher(t, 2)
+	loaded, err := store.Get("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.mondoAccessToken != "mondo-token" || loaded.uberAccessToken != "uber-token" {
+		t.Errorf("unexpected session %+v", loaded)
+	}
+
+	rotated, err = store.RotateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 0 {
+		t.Errorf("expected nothing left to rotate, got %d", rotated)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// supervisedServer is a server run by runServers. serve starts it, e.g.
+// ListenAndServeTLS, and returns when it stops.
+type supervisedServer struct {
+	name   string
+	server *http.Server
+	serve  func() error
+}
+
+// runServers serves until ctx is done or one of the servers fails. Then it
+// shuts them all down gracefully: they stop accepting connections and wait
+// for in-flight requests, and then drain waits for the work those requests
+// queued. Both share the timeout, after which remaining connections are
+// closed. It returns the server's error if one failed, or nil after a clean
+// shutdown.
+func runServers(ctx context.Context, servers []*supervisedServer, drain func(ctx context.Context) error, timeout time.Duration) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *supervisedServer) {
+			log.Printf("Listening on %s (%s)\n", s.server.Addr, s.name)
+			err := s.serve()
+			if err == http.ErrServerClosed {
+				errs <- nil
+				return
+			}
+			if err == nil {
+				err = fmt.Errorf("%s server stopped unexpectedly", s.name)
+			}
+			errs <- fmt.Errorf("%s server: %w", s.name, err)
+		}(s)
+	}
+
+	var failure error
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down, waiting up to %s\n", timeout)
+	case failure = <-errs:
+		log.Printf("Shutting down after %v, waiting up to %s\n", failure, timeout)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *supervisedServer) {
+			defer wg.Done()
+			if err := s.server.Shutdown(shutdownCtx); err != nil {
+				log.Printf("%s server shutdown error: %s\n", s.name, err.Error())
+				s.server.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if err := drain(shutdownCtx); err != nil {
+		log.Printf("Drain error: %s\n", err.Error())
+	}
+	return failure
+}
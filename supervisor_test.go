@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSupervisedTestServer serves handler on a free local port.
+func newSupervisedTestServer(t *testing.T, name string, handler http.Handler) (*supervisedServer, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Addr: listener.Addr().String(), Handler: handler}
+	return &supervisedServer{name: name, server: server, serve: func() error { return server.Serve(listener) }}, "http://" + server.Addr
+}
+
+func TestRunServersDrainsOnShutdown(t *testing.T) {
+	started := make(chan struct{})
+	slow, slowUrl := newSupervisedTestServer(t, "slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	idle, _ := newSupervisedTestServer(t, "idle", http.NotFoundHandler())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	drained := false
+	result := make(chan error, 1)
+	go func() {
+		result <- runServers(ctx, []*supervisedServer{slow, idle}, func(ctx context.Context) error {
+			drained = true
+			return nil
+		}, 5*time.Second)
+	}()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		response, err := http.Post(slowUrl, "text/plain", nil)
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- response
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never started")
+	}
+	cancel()
+
+	// The in-flight request finishes before the servers stop
+	if response := <-responses; response == nil || response.StatusCode != 200 {
+		t.Errorf("expected in-flight request to complete, got %+v", response)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("expected clean shutdown, got %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("servers never stopped")
+	}
+	if !drained {
+		t.Errorf("expected jobs to be drained")
+	}
+	if _, err := http.Get(slowUrl); err == nil {
+		t.Errorf("expected server to stop accepting connections")
+	}
+}
+
+func TestRunServersStopsAllWhenOneFails(t *testing.T) {
+	ok, okUrl := newSupervisedTestServer(t, "ok", http.NotFoundHandler())
+	failing := &supervisedServer{name: "failing", server: &http.Server{}, serve: func() error {
+		return errors.New("address in use")
+	}}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runServers(context.Background(), []*supervisedServer{ok, failing}, func(ctx context.Context) error { return nil }, time.Second)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "failing server: address in use") {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runServers never returned")
+	}
+	if _, err := http.Get(okUrl); err == nil {
+		t.Errorf("expected the other server to be shut down")
+	}
+}
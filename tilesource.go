@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var ErrNoSuchTile = errors.New("no such tile")
+
+// tileSource supplies 256px map tiles in the usual slippy map (XYZ)
+// numbering, where y counts down from the top of the world.
+type tileSource interface {
+	Tile(zoom, x, y int) (image.Image, error)
+}
+
+// tileDirectory reads tiles laid out as {dir}/{zoom}/{x}/{y}.png, as
+// written by most OpenStreetMap tile renderers and downloaders.
+type tileDirectory struct {
+	dir string
+}
+
+func (d *tileDirectory) Tile(zoom, x, y int) (image.Image, error) {
+	file, err := os.Open(filepath.Join(d.dir, strconv.Itoa(zoom), strconv.Itoa(x), strconv.Itoa(y)+".png"))
+	if os.IsNotExist(err) {
+		return nil, ErrNoSuchTile
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tile, _, err := image.Decode(file)
+	return tile, err
+}
+
+// mbtiles reads tiles from an MBTiles (SQLite) file. MBTiles numbers rows
+// from the bottom of the world (TMS), so y is flipped.
+type mbtiles struct {
+	db *sql.DB
+}
+
+func openMbtiles(file string) (*mbtiles, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+file+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &mbtiles{db: db}, nil
+}
+
+func (m *mbtiles) Tile(zoom, x, y int) (image.Image, error) {
+	row := (1 << uint(zoom)) - 1 - y
+	var data []byte
+	err := m.db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", zoom, x, row).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchTile
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tile, _, err := image.Decode(bytes.NewReader(data))
+	return tile, err
+}
+
+// tileSources tries each source in turn, e.g. a directory of local tiles
+// before a larger MBTiles file.
+type tileSources []tileSource
+
+func (s tileSources) Tile(zoom, x, y int) (image.Image, error) {
+	for _, source := range s {
+		tile, err := source.Tile(zoom, x, y)
+		if err != ErrNoSuchTile {
+			return tile, err
+		}
+	}
+	return nil, ErrNoSuchTile
+}
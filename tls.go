@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Serve plain HTTP, e.g. behind a TLS terminating proxy
+	tlsOff = "off"
+	// Serve -certFile and -keyFile, reloading them when they change
+	tlsStatic = "static"
+	// Get certificates from an ACME CA such as Let's Encrypt
+	tlsAcme = "acme"
+)
+
+// How often certReloader looks at the files for changes
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a certificate from files, picking up new ones when the
+// files change so renewals don't need a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// newCertReloader loads a certificate, failing if it can't.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the files if they've changed since they were last loaded.
+// The mutex must be held, or c not yet shared.
+func (c *certReloader) reload() error {
+	c.checked = time.Now()
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		// Perhaps only one has been replaced so far; try again next time
+		return err
+	}
+	if c.cert != nil {
+		log.Printf("Reloaded certificate %s\n", c.certFile)
+	}
+	c.cert, c.certMod, c.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate is for tls.Config. If reloading fails the old certificate
+// is kept.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		if err := c.reload(); err != nil {
+			log.Printf("Certificate reload error: %s\n", err.Error())
+		}
+	}
+	return c.cert, nil
+}
+
+// acmeHosts returns the domains to get ACME certificates for: -acmeDomains,
+// or else the host of -httpsUrl.
+func acmeHosts() []string {
+	var hosts []string
+	for _, domain := range strings.Split(*acmeDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			hosts = append(hosts, domain)
+		}
+	}
+	if len(hosts) == 0 {
+		if parsed, err := url.Parse(*httpsUrl); err == nil && parsed.Hostname() != "" {
+			hosts = append(hosts, parsed.Hostname())
+		}
+	}
+	return hosts
+}
+
+// newAcmeManager returns an autocert manager for -acmeDirectory, trusting
+// -acmeDirectoryCa as well as the system CAs when talking to it.
+func newAcmeManager() (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: *acmeDirectory}
+	if *acmeDirectoryCa != "" {
+		pem, err := ioutil.ReadFile(*acmeDirectoryCa)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *acmeDirectoryCa)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(*acmeCacheDir),
+		HostPolicy: autocert.HostWhitelist(acmeHosts()...),
+		Email:      *acmeEmail,
+		Client:     client,
+	}, nil
+}
+
+// configureTls sets up the HTTPS server for -tls. With ACME the HTTP server
+// also answers the CA's HTTP-01 challenges.
+func configureTls(httpServer, httpsServer *supervisedServer) error {
+	switch *tlsMode {
+	case tlsOff:
+		log.Printf("TLS is off, serving plain HTTP on %s\n", httpsServer.server.Addr)
+
+	case tlsStatic:
+		reloader, err := newCertReloader(*certFile, *keyFile)
+		if err != nil {
+			return err
+		}
+		httpsServer.server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		httpsServer.serve = func() error { return httpsServer.server.ListenAndServeTLS("", "") }
+
+	case tlsAcme:
+		manager, err := newAcmeManager()
+		if err != nil {
+			return err
+		}
+		log.Printf("Getting certificates for %s from %s\n", strings.Join(acmeHosts(), ", "), *acmeDirectory)
+		httpsServer.server.TLSConfig = manager.TLSConfig()
+		httpsServer.serve = func() error { return httpsServer.server.ListenAndServeTLS("", "") }
+		httpServer.server.Handler = manager.HTTPHandler(httpServer.server.Handler)
+
+	default:
+		return fmt.Errorf("unknown -tls %q", *tlsMode)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for commonName, with the
+// files' modification time set to modified.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string, modified time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servedCommonName(t *testing.T, reloader *certReloader) string {
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloaderPicksUpNewCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uber-mondo-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modified := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "old", modified)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedCommonName(t, reloader); name != "old" {
+		t.Errorf("expected old certificate, got %s", name)
+	}
+
+	// A half-written renewal keeps the old certificate
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloader.checked = time.Time{}
+	if name := servedCommonName(t, reloader); name != "old" {
+		t.Errorf("expected old certificate after a bad reload, got %s", name)
+	}
+
+	writeTestCert(t, certFile, keyFile, "new", modified.Add(time.Minute))
+	if name := servedCommonName(t, reloader); name != "old" {
+		t.Errorf("expected files not to be checked again so soon, got %s", name)
+	}
+	reloader.checked = time.Time{}
+	if name := servedCommonName(t, reloader); name != "new" {
+		t.Errorf("expected new certificate, got %s", name)
+	}
+}
+
+func TestNewCertReloaderFailsWithoutCertificate(t *testing.T) {
+	if _, err := newCertReloader("no-such-cert.pem", "no-such-key.pem"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestAcmeHosts(t *testing.T) {
+	oldDomains, oldHttpsUrl := *acmeDomains, *httpsUrl
+	defer func() { *acmeDomains, *httpsUrl = oldDomains, oldHttpsUrl }()
+
+	*acmeDomains, *httpsUrl = "", "https://uber-mondo.example.com:8443/"
+	if hosts := acmeHosts(); !reflect.DeepEqual(hosts, []string{"uber-mondo.example.com"}) {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+	*acmeDomains = "a.example.com, b.example.com,"
+	if hosts := acmeHosts(); !reflect.DeepEqual(hosts, []string{"a.example.com", "b.example.com"}) {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const encryptedTokenPrefix = "enc1"
+
+// tokenCipher encrypts OAuth tokens before they are persisted. Each value is
+// sealed with its own random AES-256-GCM data key, and that data key is in
+// turn sealed with a master key (envelope encryption). Master keys are
+// identified by a fingerprint stored alongside the ciphertext, so values
+// sealed with an older key can still be opened after a rotation.
+type tokenCipher struct {
+	primaryKeyId string
+	keys         map[string][]byte
+}
+
+// newTokenCipher takes one or more 32 byte master keys. The first one is used
+// for encryption; the rest are only used to decrypt existing values.
+func newTokenCipher(masterKeys [][]byte) (*tokenCipher, error) {
+	if len(masterKeys) == 0 {
+		return nil, errors.New("no token encryption keys")
+	}
+
+	c := &tokenCipher{keys: make(map[string][]byte)}
+	for i, key := range masterKeys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("token encryption key %d is %d bytes, expected 32", i+1, len(key))
+		}
+		keyId := keyFingerprint(key)
+		if i == 0 {
+			c.primaryKeyId = keyId
+		}
+		c.keys[keyId] = key
+	}
+	return c, nil
+}
+
+// loadTokenCipher builds a tokenCipher from a base64 key given on the command
+// line and/or a key file containing one base64 key per line. Blank lines and
+// lines starting with # are ignored. The flag key, if any, is the primary key;
+// otherwise the first key in the file is.
+func loadTokenCipher(flagKey, keyFile string) (*tokenCipher, error) {
+	var keys [][]byte
+	if flagKey != "" {
+		key, err := base64.StdEncoding.DecodeString(flagKey)
+		if err != nil {
+			return nil, fmt.Errorf("token key: %s", err.Error())
+		}
+		keys = append(keys, key)
+	}
+
+	if keyFile != "" {
+		file, err := os.Open(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			key, err := base64.StdEncoding.DecodeString(text)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %s", keyFile, line, err.Error())
+			}
+			keys = append(keys, key)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return newTokenCipher(keys)
+}
+
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// Encrypt returns "enc1:<key id>:<sealed data key>:<sealed token>". Empty
+// strings are left as they are so unset tokens stay unset.
+func (c *tokenCipher) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	sealedKey, err := sealGCM(c.keys[c.primaryKeyId], dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealedToken, err := sealGCM(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		encryptedTokenPrefix,
+		c.primaryKeyId,
+		base64.RawURLEncoding.EncodeToString(sealedKey),
+		base64.RawURLEncoding.EncodeToString(sealedToken),
+	}, ":"), nil
+}
+
+// Decrypt reverses Encrypt. Values without the enc1 prefix are assumed to
+// have been written before encryption was enabled and are returned as-is.
+func (c *tokenCipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedTokenPrefix+":") {
+		return value, nil
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 {
+		return "", errors.New("malformed encrypted token")
+	}
+
+	masterKey, exists := c.keys[parts[1]]
+	if !exists {
+		return "", fmt.Errorf("token encrypted with unknown key %s", parts[1])
+	}
+
+	sealedKey, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	sealedToken, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := openGCM(masterKey, sealedKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openGCM(dataKey, sealedToken)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// NeedsRotation reports whether value is plaintext or was sealed with a key
+// other than the primary key.
+func (c *tokenCipher) NeedsRotation(value string) bool {
+	if value == "" {
+		return false
+	}
+	return !strings.HasPrefix(value, encryptedTokenPrefix+":"+c.primaryKeyId+":")
+}
+
+// sealGCM encrypts plaintext with AES-GCM, prefixing the random nonce.
+func sealGCM(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openGCM(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
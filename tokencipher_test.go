@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func newTestTokenCipher(t *testing.T, b byte) *tokenCipher {
+	c, err := newTokenCipher([][]byte{testKey(b)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTokenCipherRoundTrip(t *testing.T) {
+	c := newTestTokenCipher(t, 1)
+
+	encrypted, err := c.Encrypt("secret-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encrypted, "secret-token") {
+		t.Errorf("token not encrypted: %s", encrypted)
+	}
+
+	again, _ := c.Encrypt("secret-token")
+	if again == encrypted {
+		t.Errorf("expected a fresh data key and nonce per value")
+	}
+
+	decrypted, err := c.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "secret-token" {
+		t.Errorf("expected secret-token, got %s", decrypted)
+	}
+}
+
+func TestTokenCipherEmptyAndPlaintext(t *testing.T) {
+	c := newTestTokenCipher(t, 1)
+
+	encrypted, _ := c.Encrypt("")
+	if encrypted != "" {
+		t.Errorf("expected empty token to stay empty, got %s", encrypted)
+	}
+
+	plaintext, err := c.Decrypt("legacy-token")
+	if err != nil || plaintext != "legacy-token" {
+		t.Errorf("expected legacy plaintext to pass through, got %s %v", plaintext, err)
+	}
+	if !c.NeedsRotation("legacy-token") {
+		t.Errorf("expected plaintext to need rotation")
+	}
+}
+
+func TestTokenCipherUnknownKey(t *testing.T) {
+	encrypted, _ := newTestTokenCipher(t, 1).Encrypt("secret-token")
+
+	_, err := newTestTokenCipher(t, 2).Decrypt(encrypted)
+	if err == nil {
+		t.Errorf("expected error decrypting with the wrong key")
+	}
+}
+
+func TestNewTokenCipherRejectsShortKey(t *testing.T) {
+	_, err := newTokenCipher([][]byte{[]byte("too short")})
+	if err == nil {
+		t.Errorf("expected error for short key")
+	}
+}
@@ -1,23 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 const (
-	UberAuthHost = "https://login.uber.com"
+	UberAuthHost      = "https://login.uber.com"
+	UberSignature     = "X-Uber-Signature"
+	ReceiptReadyEvent = "requests.receipt_ready"
 )
 
 type UberApiClient struct {
 	clientSecret string
 	clientId     string
 	url          string
+	authUrl      string
 }
 
 type UberTokenResponse struct {
@@ -28,6 +34,27 @@ type UberTokenResponse struct {
 	Scope        string `json:"scope"`
 }
 
+type UberMeResponse struct {
+	Uuid      string `json:"uuid"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+}
+
+type UberWebhookEvent struct {
+	EventId      string          `json:"event_id"`
+	EventTime    int64           `json:"event_time"`
+	EventType    string          `json:"event_type"`
+	Meta         UberWebhookMeta `json:"meta"`
+	ResourceHref string          `json:"resource_href"`
+}
+
+type UberWebhookMeta struct {
+	UserId     string `json:"user_id"`
+	ResourceId string `json:"resource_id"`
+	Status     string `json:"status"`
+}
+
 type UberHistoryResponse struct {
 	Offset  int64             `json:"offset"`
 	Limit   int64             `json:"limit"`
@@ -52,16 +79,41 @@ type UberHistoryCity struct {
 	Longitude   float64 `json:"longitude"`
 }
 
+// UberReceiptResponse is a trip's receipt from /v1/requests/{id}/receipt.
+// Totals are formatted with the currency symbol, e.g. "£5.92"; charge amounts
+// are bare numbers, e.g. "2.20".
 type UberReceiptResponse struct {
-	RequestId     string `json:"request_id"`
-	TotalCharged  string `json:"total_charged"`
+	RequestId         string              `json:"request_id"`
+	Charges           []UberReceiptCharge `json:"charges"`
+	SurgeCharge       *UberReceiptCharge  `json:"surge_charge"`
+	ChargeAdjustments []UberReceiptCharge `json:"charge_adjustments"`
+	NormalFare        string              `json:"normal_fare"`
+	Subtotal          string              `json:"subtotal"`
+	TotalCharged      string              `json:"total_charged"`
+	TotalOwed         *float64            `json:"total_owed"`
+	TotalFare         string              `json:"total_fare"`
+	CurrencyCode      string              `json:"currency_code"`
+	// Duration is formatted as "HH:MM:SS"
+	Duration      string `json:"duration"`
 	Distance      string `json:"distance"`
-	DistanceLabel string `json:"miles"`
+	DistanceLabel string `json:"distance_label"`
+}
+
+// UberReceiptCharge is a line on a receipt: part of the fare, a surge, or an
+// adjustment such as a promotion or rounding.
+type UberReceiptCharge struct {
+	Name   string `json:"name"`
+	Amount string `json:"amount"`
+	Type   string `json:"type"`
 }
 
 type UberRequestResponse struct {
-	Status   string              `json:"status"`
-	Location UberRequestLocation `json:"location"`
+	RequestId   string               `json:"request_id"`
+	Status      string               `json:"status"`
+	Location    UberRequestLocation  `json:"location"`
+	Pickup      *UberRequestLocation `json:"pickup"`
+	Destination *UberRequestLocation `json:"destination"`
+	Waypoints   []UberWaypoint       `json:"waypoints"`
 }
 
 type UberRequestLocation struct {
@@ -69,19 +121,55 @@ type UberRequestLocation struct {
 	Longitude float64 `json:"longitude"`
 }
 
+// UberWaypoint is a pickup or dropoff on a shared ride, in the order the
+// driver made them.
+type UberWaypoint struct {
+	RiderId   string  `json:"rider_id"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Type      string  `json:"type"`
+}
+
+// Each API call has an XxxContext variant taking a context, so callers can
+// give up on a slow upstream. The plain ones use context.Background().
 func (c *UberApiClient) GetOAuthToken(authorizationCode, redirectUri string) (*UberTokenResponse, error) {
-	uberTokenUrl := fmt.Sprintf("%s/oauth/token", UberAuthHost)
-	formValues := url.Values{
+	return c.GetOAuthTokenContext(context.Background(), authorizationCode, redirectUri)
+}
+
+func (c *UberApiClient) GetOAuthTokenContext(ctx context.Context, authorizationCode, redirectUri string) (*UberTokenResponse, error) {
+	return c.requestOAuthToken(ctx, url.Values{
 		"client_secret": {c.clientSecret},
 		"client_id":     {c.clientId},
 		"grant_type":    {"authorization_code"},
 		"redirect_uri":  {redirectUri},
 		"code":          {authorizationCode},
-	}
+	})
+}
+
+func (c *UberApiClient) RefreshOAuthToken(refreshToken string) (*UberTokenResponse, error) {
+	return c.RefreshOAuthTokenContext(context.Background(), refreshToken)
+}
+
+func (c *UberApiClient) RefreshOAuthTokenContext(ctx context.Context, refreshToken string) (*UberTokenResponse, error) {
+	return c.requestOAuthToken(ctx, url.Values{
+		"client_secret": {c.clientSecret},
+		"client_id":     {c.clientId},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+func (c *UberApiClient) requestOAuthToken(ctx context.Context, formValues url.Values) (*UberTokenResponse, error) {
+	uberTokenUrl := fmt.Sprintf("%s/oauth/token", c.authUrl)
 
 	log.Printf("%s requesting %s\n", SetAuthCode, uberTokenUrl)
-	httpResponse, err := http.PostForm(uberTokenUrl, formValues)
+	request, err := http.NewRequestWithContext(ctx, "POST", uberTokenUrl, strings.NewReader(formValues.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
+	httpResponse, err := httpClient.Do(request)
 	if err != nil {
 		log.Printf("/login uber authorize error: %s", err.Error())
 		return nil, err
@@ -89,17 +177,7 @@ func (c *UberApiClient) GetOAuthToken(authorizationCode, redirectUri string) (*U
 
 	defer httpResponse.Body.Close()
 	if httpResponse.StatusCode != 200 {
-		if err != nil {
-			log.Printf("%s Uber OAuth token response error: %s", Login, err.Error())
-			return nil, err
-		}
-
-		body, err := ioutil.ReadAll(httpResponse.Body)
-		if err != nil {
-			return nil, err
-		}
-
-		return nil, errors.New(string(body))
+		return nil, newAPIError(uberProvider, httpResponse)
 	}
 
 	uberTokenResponse := &UberTokenResponse{}
@@ -107,28 +185,90 @@ func (c *UberApiClient) GetOAuthToken(authorizationCode, redirectUri string) (*U
 	return uberTokenResponse, err
 }
 
-func (c *UberApiClient) GetHistory(accessToken string) (*UberHistoryResponse, error) {
-	// Hide cancelled & giving transactions for demo...
-	uberHistoryUrl := fmt.Sprintf("%s/v1.2/history?offset=3", c.url)
-	request, err := http.NewRequest("GET", uberHistoryUrl, nil)
+// refresh exchanges the token's refresh token for a new access token.
+func (c *UberApiClient) refresh(ctx context.Context, token *OAuthToken) error {
+	log.Printf("Refreshing Uber access token\n")
+	uberTokenResponse, err := c.RefreshOAuthTokenContext(ctx, token.RefreshToken)
+	if err != nil {
+		return err
+	}
+	return token.update(uberTokenResponse.AccessToken, uberTokenResponse.RefreshToken, uberTokenResponse.ExpiresIn)
+}
+
+func (c *UberApiClient) do(request *http.Request, token *OAuthToken) (*http.Response, error) {
+	return doAuthorized(request, token, c.refresh)
+}
+
+// VerifyWebhookSignature checks a webhook body against its X-Uber-Signature
+// header, the hex HMAC-SHA256 of the body keyed with our client secret.
+func (c *UberApiClient) VerifyWebhookSignature(body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	actual, _ := hex.DecodeString(c.SignWebhook(body))
+	return hmac.Equal(actual, expected)
+}
+
+// SignWebhook returns the X-Uber-Signature Uber would send with a webhook
+// body.
+func (c *UberApiClient) SignWebhook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(c.clientSecret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *UberApiClient) GetMe(token *OAuthToken) (*UberMeResponse, error) {
+	return c.GetMeContext(context.Background(), token)
+}
+
+func (c *UberApiClient) GetMeContext(ctx context.Context, token *OAuthToken) (*UberMeResponse, error) {
+	uberMeUrl := fmt.Sprintf("%s/v1/me", c.url)
+	request, err := http.NewRequestWithContext(ctx, "GET", uberMeUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	request.Header.Add(Authorization, Bearer+accessToken)
+	response, err := c.do(request, token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, newAPIError(uberProvider, response)
+	}
 
-	response, err := httpClient.Do(request)
+	uberMeResponse := &UberMeResponse{}
+	err = json.NewDecoder(response.Body).Decode(uberMeResponse)
 	if err != nil {
 		return nil, err
 	}
 
+	return uberMeResponse, nil
+}
+
+// GetHistory returns one page of the user's trips. Use History to walk all of
+// them.
+func (c *UberApiClient) GetHistory(token *OAuthToken, offset, limit int) (*UberHistoryResponse, error) {
+	return c.GetHistoryContext(context.Background(), token, offset, limit)
+}
+
+func (c *UberApiClient) GetHistoryContext(ctx context.Context, token *OAuthToken, offset, limit int) (*UberHistoryResponse, error) {
+	uberHistoryUrl := fmt.Sprintf("%s/v1.2/history?offset=%d&limit=%d", c.url, offset, limit)
+	request, err := http.NewRequestWithContext(ctx, "GET", uberHistoryUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.do(request, token)
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return nil, err
-		}
-		return nil, errors.New(string(body))
+		return nil, newAPIError(uberProvider, response)
 	}
 
 	uberHistoryResponse := &UberHistoryResponse{}
@@ -140,27 +280,25 @@ func (c *UberApiClient) GetHistory(accessToken string) (*UberHistoryResponse, er
 	return uberHistoryResponse, nil
 }
 
-func (c *UberApiClient) GetReceipt(accessToken, requestId string) (*UberReceiptResponse, error) {
+func (c *UberApiClient) GetReceipt(token *OAuthToken, requestId string) (*UberReceiptResponse, error) {
+	return c.GetReceiptContext(context.Background(), token, requestId)
+}
+
+func (c *UberApiClient) GetReceiptContext(ctx context.Context, token *OAuthToken, requestId string) (*UberReceiptResponse, error) {
 	uberHistoryUrl := fmt.Sprintf("%s/v1/requests/%s/receipt", c.url, requestId)
-	request, err := http.NewRequest("GET", uberHistoryUrl, nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", uberHistoryUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	request.Header.Add(Authorization, Bearer+accessToken)
-
-	response, err := httpClient.Do(request)
+	response, err := c.do(request, token)
 	if err != nil {
 		return nil, err
 	}
 
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return nil, err
-		}
-		return nil, errors.New(string(body))
+		return nil, newAPIError(uberProvider, response)
 	}
 
 	uberReceiptResponse := &UberReceiptResponse{}
@@ -172,27 +310,25 @@ func (c *UberApiClient) GetReceipt(accessToken, requestId string) (*UberReceiptR
 	return uberReceiptResponse, nil
 }
 
-func (c *UberApiClient) GetRequest(accessToken, requestId string) (*UberRequestResponse, error) {
-	uberHistoryUrl := fmt.Sprintf("%s/v1/requests/%s", c.url, requestId)
-	request, err := http.NewRequest("GET", uberHistoryUrl, nil)
+func (c *UberApiClient) GetRequest(token *OAuthToken, requestId string) (*UberRequestResponse, error) {
+	return c.GetRequestContext(context.Background(), token, requestId)
+}
+
+func (c *UberApiClient) GetRequestContext(ctx context.Context, token *OAuthToken, requestId string) (*UberRequestResponse, error) {
+	uberHistoryUrl := fmt.Sprintf("%s/v1.2/requests/%s", c.url, requestId)
+	request, err := http.NewRequestWithContext(ctx, "GET", uberHistoryUrl, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	request.Header.Add(Authorization, Bearer+accessToken)
-
-	response, err := httpClient.Do(request)
+	response, err := c.do(request, token)
 	if err != nil {
 		return nil, err
 	}
 
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return nil, err
-		}
-		return nil, errors.New(string(body))
+		return nil, newAPIError(uberProvider, response)
 	}
 
 	uberRequestResponse := &UberRequestResponse{}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newRefreshingUberServer serves /oauth/token and /v1.2/history, accepting
+// only the access token most recently issued by a refresh.
+func newRefreshingUberServer(t *testing.T, validToken string) (*httptest.Server, *int) {
+	refreshes := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh-1" {
+			t.Errorf("unexpected token request %v", r.Form)
+		}
+		refreshes++
+		json.NewEncoder(w).Encode(UberTokenResponse{
+			AccessToken:  validToken,
+			RefreshToken: "refresh-2",
+			ExpiresIn:    3600,
+		})
+	})
+	mux.HandleFunc("/v1.2/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(Authorization) != Bearer+validToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(UberHistoryResponse{Count: 1})
+	})
+	return httptest.NewServer(mux), &refreshes
+}
+
+func TestUberApiClientRefreshesExpiringToken(t *testing.T) {
+	server, refreshes := newRefreshingUberServer(t, "access-2")
+	defer server.Close()
+	client := &UberApiClient{url: server.URL, authUrl: server.URL}
+
+	var saved *OAuthToken
+	token := &OAuthToken{
+		AccessToken:  "access-1",
+		RefreshToken: "refresh-1",
+		Expiry:       time.Now().Add(time.Minute),
+		Refreshed: func(token *OAuthToken) error {
+			saved = token
+			return nil
+		},
+	}
+
+	_, err := client.GetHistory(token, 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *refreshes != 1 {
+		t.Errorf("expected 1 refresh, got %d", *refreshes)
+	}
+	if saved == nil || saved.AccessToken != "access-2" || saved.RefreshToken != "refresh-2" {
+		t.Errorf("refreshed token not saved: %+v", saved)
+	}
+	if !token.Expiry.After(time.Now().Add(time.Hour - time.Minute)) {
+		t.Errorf("expiry not updated: %s", token.Expiry)
+	}
+}
+
+func TestUberApiClientRefreshesOnUnauthorized(t *testing.T) {
+	server, refreshes := newRefreshingUberServer(t, "access-2")
+	defer server.Close()
+	client := &UberApiClient{url: server.URL, authUrl: server.URL}
+
+	// No expiry known, so the client only finds out from the 401.
+	token := &OAuthToken{AccessToken: "access-1", RefreshToken: "refresh-1"}
+
+	_, err := client.GetHistory(token, 0, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *refreshes != 1 || token.AccessToken != "access-2" {
+		t.Errorf("expected one refresh to access-2, got %d refreshes and %s", *refreshes, token.AccessToken)
+	}
+}
+
+func TestSessionTokenRefreshedOnceByConcurrentJobs(t *testing.T) {
+	oldSessions := sessions
+	defer func() { sessions = oldSessions }()
+	sessions = newMemorySessionStore()
+
+	// Refresh tokens rotate, so spending one twice fails
+	var mutex sync.Mutex
+	refreshes := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.FormValue("refresh_token") != "refresh-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		refreshes++
+		json.NewEncoder(w).Encode(UberTokenResponse{AccessToken: "access-2", RefreshToken: "refresh-2", ExpiresIn: 3600})
+	})
+	mux.HandleFunc("/v1.2/history", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(UberHistoryResponse{Count: 1})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := &UberApiClient{url: server.URL, authUrl: server.URL}
+
+	err := sessions.Put(&session{
+		sessionId:        "abc",
+		uberAccessToken:  "access-1",
+		uberRefreshToken: "refresh-1",
+		uberTokenExpiry:  time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		s, err := sessions.Get("abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetHistory(s.uberToken(), 0, 50); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// A change made meanwhile isn't undone by saving the refreshed token
+	err = sessions.Update("abc", func(s *session) error {
+		s.feedTitleTemplate = "changed"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if refreshes != 1 {
+		t.Errorf("expected 1 refresh, got %d", refreshes)
+	}
+	s, err := sessions.Get("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.uberAccessToken != "access-2" || s.uberRefreshToken != "refresh-2" || s.feedTitleTemplate != "changed" {
+		t.Errorf("unexpected session %+v", s)
+	}
+}
+
+func TestUberApiClientVerifyWebhookSignature(t *testing.T) {
+	client := &UberApiClient{clientSecret: "secret"}
+	body := []byte(`{"event_type":"requests.receipt_ready"}`)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	if !client.VerifyWebhookSignature(body, signature) {
+		t.Errorf("expected valid signature to verify")
+	}
+	if client.VerifyWebhookSignature([]byte(`{"event_type":"other"}`), signature) {
+		t.Errorf("expected signature for a different body to fail")
+	}
+	if client.VerifyWebhookSignature(body, "") || client.VerifyWebhookSignature(body, "not hex") {
+		t.Errorf("expected missing or malformed signature to fail")
+	}
+}
+
+func TestUberApiClientGivesUpWhenContextCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	client := &UberApiClient{url: server.URL}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := client.GetHistoryContext(ctx, &OAuthToken{AccessToken: "token"}, 0, 50)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
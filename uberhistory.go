@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// The most trips /v1.2/history returns at once
+	historyPageSize = 50
+
+	// No trip takes longer than this, so history, which is newest first by
+	// request time, is at most this far out of order by end time.
+	maxTripLength = 12 * time.Hour
+)
+
+// historyFilter picks trips out of a user's Uber history. Zero fields match
+// everything.
+type historyFilter struct {
+	// Since and Until select trips that ended in [Since, Until). Trips that
+	// never started, e.g. cancelled ones, go by when they were requested.
+	Since time.Time
+	Until time.Time
+	// Statuses are the trip statuses wanted, e.g. completedTrips
+	Statuses []string
+}
+
+var completedTrips = []string{"completed"}
+
+// tripTime is when a trip ended, or was requested if it never started.
+func tripTime(trip UberHistoryItem) time.Time {
+	if trip.EndTime == 0 {
+		return time.Unix(trip.RequestTime, 0)
+	}
+	return time.Unix(trip.EndTime, 0)
+}
+
+func (f historyFilter) matches(trip UberHistoryItem) bool {
+	ended := tripTime(trip)
+	if !f.Since.IsZero() && ended.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !ended.Before(f.Until) {
+		return false
+	}
+	if len(f.Statuses) == 0 {
+		return true
+	}
+	for _, status := range f.Statuses {
+		if trip.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// historyIterator walks a user's Uber history a page at a time. Use it like
+// bufio.Scanner:
+//
+//	trips := client.History(ctx, token, historyFilter{Statuses: completedTrips})
+//	for trips.Next() {
+//		trip := trips.Trip()
+//		...
+//	}
+//	if err := trips.Err(); err != nil {
+//		...
+//	}
+type historyIterator struct {
+	ctx    context.Context
+	client *UberApiClient
+	token  *OAuthToken
+	filter historyFilter
+
+	page    []UberHistoryItem
+	index   int
+	offset  int
+	count   int64
+	fetched bool
+	done    bool
+	// seen skips trips we've had already, which happens if the user takes
+	// another trip while we're paging and everything moves along one
+	seen map[string]bool
+	trip UberHistoryItem
+	err  error
+}
+
+// History returns an iterator over the user's trips that match filter,
+// newest first.
+func (c *UberApiClient) History(ctx context.Context, token *OAuthToken, filter historyFilter) *historyIterator {
+	return &historyIterator{
+		ctx:    ctx,
+		client: c,
+		token:  token,
+		filter: filter,
+		seen:   make(map[string]bool),
+	}
+}
+
+// Next advances to the next matching trip, fetching another page if need be.
+// It returns false at the end of the history or the time window, or on error.
+func (it *historyIterator) Next() bool {
+	for !it.done {
+		if it.index == len(it.page) {
+			it.fetch()
+			continue
+		}
+
+		trip := it.page[it.index]
+		it.index++
+		if !it.filter.Since.IsZero() && tripTime(trip).Before(it.filter.Since.Add(-maxTripLength)) {
+			// Everything after this is older still
+			it.done = true
+			break
+		}
+		if it.seen[trip.RequestId] || !it.filter.matches(trip) {
+			continue
+		}
+		it.seen[trip.RequestId] = true
+		it.trip = trip
+		return true
+	}
+	return false
+}
+
+func (it *historyIterator) fetch() {
+	if it.fetched && int64(it.offset) >= it.count {
+		it.done = true
+		return
+	}
+
+	page, err := it.client.GetHistoryContext(it.ctx, it.token, it.offset, historyPageSize)
+	if err != nil {
+		it.err = err
+		it.done = true
+		return
+	}
+	it.page, it.index = page.History, 0
+	it.offset += len(page.History)
+	it.count = page.Count
+	it.fetched = true
+	if len(page.History) == 0 {
+		it.done = true
+	}
+}
+
+// Trip returns the trip Next advanced to.
+func (it *historyIterator) Trip() UberHistoryItem {
+	return it.trip
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *historyIterator) Err() error {
+	return it.err
+}
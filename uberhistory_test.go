@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// hourlyTestTrips returns n completed trips, an hour apart, newest first.
+func hourlyTestTrips(n int) []testTrip {
+	var trips []testTrip
+	for i := 0; i < n; i++ {
+		trips = append(trips, testTrip{fmt.Sprintf("trip%d", i), "completed", matchTestNow.Add(-time.Duration(i) * time.Hour), "£3.00"})
+	}
+	return trips
+}
+
+// countHistoryPages serves the trips as newHistoryServer does, counting the
+// history pages fetched.
+func countHistoryPages(trips []testTrip, pages *int) *httptest.Server {
+	handler := newHistoryHandler(trips)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1.2/history" {
+			*pages++
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func collectHistory(t *testing.T, serverUrl string, filter historyFilter) []string {
+	client := &UberApiClient{url: serverUrl}
+	var requestIds []string
+	trips := client.History(context.Background(), &OAuthToken{AccessToken: "token"}, filter)
+	for trips.Next() {
+		requestIds = append(requestIds, trips.Trip().RequestId)
+	}
+	if err := trips.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return requestIds
+}
+
+func TestHistoryIteratorPagesUntilCount(t *testing.T) {
+	trips := hourlyTestTrips(2*historyPageSize + 1)
+	pages := 0
+	server := countHistoryPages(trips, &pages)
+	defer server.Close()
+
+	requestIds := collectHistory(t, server.URL, historyFilter{})
+	if len(requestIds) != len(trips) {
+		t.Errorf("expected %d trips, got %d", len(trips), len(requestIds))
+	}
+	if pages != 3 {
+		t.Errorf("expected 3 pages, got %d", pages)
+	}
+}
+
+func TestHistoryIteratorFilters(t *testing.T) {
+	trips := []testTrip{
+		{"future", "completed", matchTestNow.Add(time.Hour), "£1.00"},
+		{"cancelled", "rider_canceled", matchTestNow.Add(-time.Hour), "£5.00"},
+		{"wanted", "completed", matchTestNow.Add(-2 * time.Hour), "£7.10"},
+		{"early", "completed", matchTestNow.Add(-25 * time.Hour), "£12.34"},
+	}
+	for i := 0; i < 2*historyPageSize; i++ {
+		trips = append(trips, testTrip{fmt.Sprintf("old%d", i), "completed", matchTestNow.Add(-48 * time.Hour), "£3.00"})
+	}
+	pages := 0
+	server := countHistoryPages(trips, &pages)
+	defer server.Close()
+
+	requestIds := collectHistory(t, server.URL, historyFilter{
+		Since:    matchTestNow.Add(-24 * time.Hour),
+		Until:    matchTestNow,
+		Statuses: completedTrips,
+	})
+	if len(requestIds) != 1 || requestIds[0] != "wanted" {
+		t.Errorf("expected only trip wanted, got %v", requestIds)
+	}
+	if pages != 1 {
+		t.Errorf("expected to stop after the window, but fetched %d pages", pages)
+	}
+}
+
+func TestHistoryIteratorSkipsShiftedTrips(t *testing.T) {
+	trips := hourlyTestTrips(historyPageSize + 1)
+	before := newHistoryHandler(trips)
+	// A new trip between pages pushes the end of the first page onto the
+	// second
+	after := newHistoryHandler(append([]testTrip{{"new", "completed", matchTestNow, "£2.00"}}, trips...))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("offset") == "0" {
+			before.ServeHTTP(w, r)
+		} else {
+			after.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	requestIds := collectHistory(t, server.URL, historyFilter{})
+	if len(requestIds) != len(trips) {
+		t.Errorf("expected %d distinct trips, got %d: %v", len(trips), len(requestIds), requestIds)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipAllowlist is a set of networks webhooks are accepted from. An empty list
+// allows everyone.
+type ipAllowlist []*net.IPNet
+
+// parseIpAllowlist parses a comma separated list of IPs and CIDR ranges.
+func parseIpAllowlist(list string) (ipAllowlist, error) {
+	var allowlist ipAllowlist
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		allowlist = append(allowlist, network)
+	}
+	return allowlist, nil
+}
+
+// allows reports whether a request's remote address is in the allowlist.
+func (a ipAllowlist) allows(remoteAddr string) bool {
+	if len(a) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyMondoWebhook checks that a webhook came from an allowed address and
+// carries the secret we embedded in the URL when registering it. session is
+// nil if the URL's session doesn't exist.
+func verifyMondoWebhook(r *http.Request, session *session, secret string) error {
+	if !mondoWebhookAllowlist.allows(r.RemoteAddr) {
+		return fmt.Errorf("address %s not allowed", r.RemoteAddr)
+	}
+	if session == nil || session.mondoWebhookSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(session.mondoWebhookSecret)) != 1 {
+		return errors.New("invalid webhook secret")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIpAllowlist(t *testing.T) {
+	allowlist, err := parseIpAllowlist("10.0.0.0/8, 192.168.1.5,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := []string{"10.1.2.3:1234", "192.168.1.5:80", "[::1]:443"}
+	for _, addr := range allowed {
+		if !allowlist.allows(addr) {
+			t.Errorf("expected %s to be allowed", addr)
+		}
+	}
+
+	denied := []string{"192.168.1.6:80", "11.0.0.1:1234", "garbage"}
+	for _, addr := range denied {
+		if allowlist.allows(addr) {
+			t.Errorf("expected %s to be denied", addr)
+		}
+	}
+
+	if !ipAllowlist(nil).allows("1.2.3.4:5") {
+		t.Errorf("expected empty allowlist to allow everyone")
+	}
+
+	if _, err := parseIpAllowlist("not-an-ip"); err == nil {
+		t.Errorf("expected error for invalid entry")
+	}
+}
+
+func TestVerifyMondoWebhook(t *testing.T) {
+	mondoWebhookAllowlist = nil
+	s := &session{mondoWebhookSecret: "secret"}
+	r := httptest.NewRequest("POST", "/mondo/webhook/abc/secret", nil)
+
+	if err := verifyMondoWebhook(r, s, "secret"); err != nil {
+		t.Errorf("expected matching secret to verify: %s", err.Error())
+	}
+	if err := verifyMondoWebhook(r, s, "wrong"); err == nil {
+		t.Errorf("expected wrong secret to fail")
+	}
+	if err := verifyMondoWebhook(r, &session{}, ""); err == nil {
+		t.Errorf("expected session without a secret to fail")
+	}
+	if err := verifyMondoWebhook(r, nil, "secret"); err == nil {
+		t.Errorf("expected unknown session to fail")
+	}
+
+	mondoWebhookAllowlist, _ = parseIpAllowlist("10.0.0.0/8")
+	defer func() { mondoWebhookAllowlist = nil }()
+	if err := verifyMondoWebhook(r, s, "secret"); err == nil {
+		t.Errorf("expected request from %s to be rejected", r.RemoteAddr)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The webhook log records each webhook we receive, then each job it queues
+// and the API calls that job makes, one JSON object per line. Replaying a log
+// sends the webhooks through the handlers again, so a mismatch seen in
+// production can be reproduced against a copy of the database, and recording
+// the replay gives a log to compare against the original.
+
+const (
+	webhookRecord  = "webhook"
+	jobRecord      = "job"
+	upstreamRecord = "upstream"
+)
+
+// The largest webhook or API response body recorded; longer ones are cut
+// short
+const maxRecordedBody = 64 * 1024
+
+// The longest line readWebhookLog reads. JSON escapes a byte as at most six,
+// and the rest of a record is small.
+const maxRecordedLine = 6*maxRecordedBody + 64*1024
+
+// webhookLogRecord is a line of the webhook log. Which fields are set depends
+// on Kind.
+type webhookLogRecord struct {
+	Kind string    `json:"kind"`
+	Time time.Time `json:"time"`
+
+	// A webhook we received. Route is the name of the route it came in on.
+	// The Mondo webhook secret is not recorded, only the session.
+	Route      string            `json:"route,omitempty"`
+	SessionId  string            `json:"session_id,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Header     map[string]string `json:"header,omitempty"`
+	Body       string            `json:"body,omitempty"`
+
+	// A job run, and the upstream API calls made while running it
+	JobId         string `json:"job_id,omitempty"`
+	JobType       string `json:"job_type,omitempty"`
+	TransactionId string `json:"transaction_id,omitempty"`
+	RequestId     string `json:"request_id,omitempty"`
+	Method        string `json:"method,omitempty"`
+	Url           string `json:"url,omitempty"`
+
+	// Status is our response to a webhook, or the API's to us. Response is
+	// the API's response body, if it's JSON and not an OAuth token.
+	Status   int    `json:"status,omitempty"`
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Truncated is set if Body or Response was cut short at maxRecordedBody
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Headers worth recording; the rest are the sender's HTTP client's business
+var recordedHeaders = []string{ContentType, UberSignature}
+
+// webhookRecorder appends records to a webhook log file.
+type webhookRecorder struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// webhookLog is nil unless -webhookLog is set.
+var webhookLog *webhookRecorder
+
+func openWebhookLog(file string) (*webhookRecorder, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookRecorder{file: f}, nil
+}
+
+func (w *webhookRecorder) Close() error {
+	return w.file.Close()
+}
+
+func (w *webhookRecorder) write(record *webhookLogRecord) {
+	record.Time = time.Now().UTC()
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Webhook log error: %s\n", err.Error())
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, err := w.file.Write(append(data, '\n')); err != nil {
+		log.Printf("Webhook log error: %s\n", err.Error())
+	}
+}
+
+// statusRecorder remembers the status a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// recordWebhook wraps a webhook handler to log the webhooks it receives, and
+// how it responded, while -webhookLog is set. Webhooks the handler refused as
+// unauthenticated or unknown aren't logged, so they can't fill the disk.
+func recordWebhook(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if webhookLog == nil {
+			h(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("%s read error: %s", route, err.Error())
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(recorder, r)
+		switch recorder.status {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return
+		}
+
+		record := &webhookLogRecord{
+			Kind:       webhookRecord,
+			Route:      route,
+			SessionId:  mux.Vars(r)["sessionId"],
+			RemoteAddr: r.RemoteAddr,
+			Header:     make(map[string]string),
+			Status:     recorder.status,
+		}
+		if len(body) > maxRecordedBody {
+			body, record.Truncated = body[:maxRecordedBody], true
+		}
+		record.Body = string(body)
+		for _, name := range recordedHeaders {
+			if value := r.Header.Get(name); value != "" {
+				record.Header[name] = value
+			}
+		}
+		webhookLog.write(record)
+	}
+}
+
+type recordedJobKey struct{}
+
+// recordJobs wraps a job queue's run function to log each job run, and lets
+// Transport tell which job its API calls are for.
+func (w *webhookRecorder) recordJobs(run func(ctx context.Context, j *job) error) func(ctx context.Context, j *job) error {
+	return func(ctx context.Context, j *job) error {
+		err := run(context.WithValue(ctx, recordedJobKey{}, j), j)
+		record := jobLogRecord(j)
+		record.Kind = jobRecord
+		if err != nil {
+			record.Error = err.Error()
+		}
+		w.write(record)
+		return err
+	}
+}
+
+func jobLogRecord(j *job) *webhookLogRecord {
+	record := &webhookLogRecord{JobId: j.Id, JobType: j.Type, SessionId: j.SessionId, RequestId: j.RequestId}
+	if j.Transaction != nil {
+		record.TransactionId = j.Transaction.Id
+	}
+	return record
+}
+
+// Transport wraps an API client's transport to log the calls jobs make
+// through it. Other calls, e.g. during login, aren't logged.
+func (w *webhookRecorder) Transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		j, ok := request.Context().Value(recordedJobKey{}).(*job)
+		if !ok {
+			return base.RoundTrip(request)
+		}
+
+		record := jobLogRecord(j)
+		record.Kind = upstreamRecord
+		record.Method = request.Method
+		// Query strings can hold API keys and signatures
+		recordedUrl := *request.URL
+		recordedUrl.User, recordedUrl.RawQuery = nil, ""
+		record.Url = recordedUrl.String()
+		response, err := base.RoundTrip(request)
+		if err != nil {
+			record.Error = err.Error()
+			w.write(record)
+			return response, err
+		}
+
+		record.Status = response.StatusCode
+		if strings.Contains(response.Header.Get(ContentType), "json") && !strings.Contains(request.URL.Path, "/oauth") {
+			// Only what's recorded is read ahead, the rest is left for the
+			// client to read from the response as usual
+			body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxRecordedBody+1))
+			response.Body = readCloser{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+			if err != nil {
+				record.Error = err.Error()
+			}
+			if len(body) > maxRecordedBody {
+				body, record.Truncated = body[:maxRecordedBody], true
+			}
+			record.Response = string(body)
+		}
+		w.write(record)
+		return response, nil
+	})
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// readWebhookLog returns the webhooks recorded in a webhook log, in order.
+func readWebhookLog(file string) ([]*webhookLogRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var webhooks []*webhookLogRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordedLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := &webhookLogRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, line, err.Error())
+		}
+		if record.Kind == webhookRecord {
+			webhooks = append(webhooks, record)
+		}
+	}
+	return webhooks, scanner.Err()
+}
+
+// replayWebhook sends a recorded webhook through its handler again,
+// returning the status it responds with. If sessionId is set the webhook is
+// redirected to that session. Uber webhooks are signed again with our client
+// secret, so they can be replayed against the fake APIs.
+func replayWebhook(record *webhookLogRecord, sessionId string) (int, error) {
+	if record.Truncated {
+		return 0, errors.New("body was too long to record in full")
+	}
+	body := []byte(record.Body)
+	var path string
+	switch record.Route {
+	case MondoWebhook:
+		if sessionId == "" {
+			sessionId = record.SessionId
+		}
+		session, err := sessions.Get(sessionId)
+		if err != nil {
+			return 0, fmt.Errorf("session %s: %s", sessionId, err.Error())
+		}
+		webhookPath, err := router.Get(MondoWebhook).URLPath("sessionId", sessionId, "secret", session.mondoWebhookSecret)
+		if err != nil {
+			return 0, err
+		}
+		path = webhookPath.String()
+
+	case UberWebhook, ReceiptReady:
+		if sessionId != "" {
+			session, err := sessions.Get(sessionId)
+			if err != nil {
+				return 0, fmt.Errorf("session %s: %s", sessionId, err.Error())
+			}
+			event := &UberWebhookEvent{}
+			if err := json.Unmarshal(body, event); err != nil {
+				return 0, err
+			}
+			event.Meta.UserId = session.uberUserId
+			if body, err = json.Marshal(event); err != nil {
+				return 0, err
+			}
+		}
+		webhookPath, err := router.Get(record.Route).URLPath()
+		if err != nil {
+			return 0, err
+		}
+		path = webhookPath.String()
+
+	default:
+		return 0, fmt.Errorf("can't replay webhook to %q", record.Route)
+	}
+
+	request := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	request.RemoteAddr = record.RemoteAddr
+	for name, value := range record.Header {
+		request.Header.Set(name, value)
+	}
+	if record.Route != MondoWebhook {
+		request.Header.Set(UberSignature, uberApiClient.SignWebhook(body))
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response.Code, nil
+}
+
+// replayCommand replays a webhook log, e.g.
+//
+//	hackathon-uber-mondo [flags] replay -session <id> webhooks.jsonl
+//
+// then runs the jobs queued until there are none left. Replay into a copy of
+// the database: transactions already in the ledger are skipped as duplicates,
+// so reset it first to process them again.
+func replayCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	sessionId := flags.String("session", "", "session to send every webhook to, instead of the one it was for")
+	wait := flags.Duration("wait", 5*time.Minute, "how long to wait for the queued jobs to finish")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.PrintDefaults()
+		return errors.New("a webhook log to replay is required")
+	}
+
+	webhooks, err := readWebhookLog(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for i, record := range webhooks {
+		if record.Truncated {
+			fmt.Printf("%d/%d %s from %s: skipped, too long to record in full\n", i+1, len(webhooks), record.Route, record.Time.Format(time.RFC3339))
+			continue
+		}
+		status, err := replayWebhook(record, *sessionId)
+		if err != nil {
+			return fmt.Errorf("webhook %d: %s", i+1, err.Error())
+		}
+		fmt.Printf("%d/%d %s from %s: %d (was %d)\n", i+1, len(webhooks), record.Route, record.Time.Format(time.RFC3339), status, record.Status)
+	}
+
+	deadline := time.Now().Add(*wait)
+	for {
+		queued, err := jobStore.Due(time.Now().Add(*wait))
+		if err != nil {
+			return err
+		}
+		if len(queued) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d jobs still queued", len(queued))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebhookLogRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uber-mondo-webhooklog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "webhooks.jsonl")
+
+	oldHttpClient := httpClient
+	webhookLog, err = openWebhookLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		webhookLog.Close()
+		webhookLog, httpClient = nil, oldHttpClient
+	}()
+	httpClient = &http.Client{Transport: webhookLog.Transport(http.DefaultTransport)}
+
+	env, cleanup := newE2EEnv(t)
+	defer cleanup()
+	env.login(t)
+	trip, err := env.uber.CompleteTrip(fakeTrip{Receipt: UberReceiptResponse{TotalCharged: "£8.50", CurrencyCode: "GBP"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the feed item", func() bool { return len(env.mondo.FeedItems()) == 1 })
+	transaction, err := env.mondo.CreateTransaction(MondoTransaction{Amount: -850, Description: "UBER BV"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachments := func() int {
+		attached, _ := env.mondo.Transaction(transaction.Id)
+		return len(attached.Attachments)
+	}
+	eventually(t, "the receipt attachment", func() bool { return attachments() == 1 })
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]int{}
+	feedPosted := false
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		record := &webhookLogRecord{}
+		if err := json.Unmarshal([]byte(line), record); err != nil {
+			t.Fatal(err)
+		}
+		kinds[record.Kind]++
+		if record.Kind == upstreamRecord && strings.HasSuffix(record.Url, "/feed") {
+			feedPosted = record.JobType == receiptReadyJob && record.RequestId == trip.History.RequestId && record.Status == 200
+		}
+		if strings.Contains(record.Response, "access-") {
+			t.Errorf("recorded an access token: %s", line)
+		}
+	}
+	if kinds[webhookRecord] != 2 || kinds[jobRecord] != 2 || kinds[upstreamRecord] == 0 {
+		t.Errorf("unexpected records %v", kinds)
+	}
+	if !feedPosted {
+		t.Errorf("expected the feed item API call to be recorded")
+	}
+
+	webhooks, err := readWebhookLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 2 || webhooks[0].Route != UberWebhook || webhooks[1].Route != MondoWebhook || webhooks[1].SessionId == "" {
+		t.Fatalf("unexpected webhooks %+v", webhooks)
+	}
+
+	// Forget the trip and transaction were done, and they're done again
+	ledger = newMemoryLedger()
+	for _, record := range webhooks {
+		status, err := replayWebhook(record, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 200 {
+			t.Errorf("replaying %s got %d", record.Route, status)
+		}
+		if record.Route == UberWebhook {
+			eventually(t, "the replayed feed item", func() bool { return len(env.mondo.FeedItems()) == 2 })
+		}
+	}
+	eventually(t, "the replayed attachment", func() bool { return attachments() == 2 })
+}
+
+func TestReplayWebhookRejectsUnknownRoute(t *testing.T) {
+	if _, err := replayWebhook(&webhookLogRecord{Kind: webhookRecord, Route: Login}, ""); err == nil {
+		t.Errorf("expected an error replaying to %s", Login)
+	}
+}
+
+func TestWebhookLogTruncatesBodiesAndRedactsQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uber-mondo-webhooklog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "webhooks.jsonl")
+	recorder, err := openWebhookLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+	oldWebhookLog := webhookLog
+	webhookLog = recorder
+	defer func() { webhookLog = oldWebhookLog }()
+
+	// Control characters are escaped to six bytes each
+	huge := strings.Repeat("\x01", 2*maxRecordedBody)
+	handler := recordWebhook(UberWebhook, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) != len(huge) {
+			t.Errorf("expected the handler to get the whole body, got %d bytes", len(body))
+		}
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/uber/webhook", strings.NewReader(huge)))
+
+	// Neither bodies over the limit nor refused webhooks are recorded
+	tooBig := httptest.NewRecorder()
+	handler(tooBig, httptest.NewRequest("POST", "/uber/webhook", strings.NewReader(strings.Repeat("x", maxWebhookBody+1))))
+	if tooBig.Code != http.StatusBadRequest {
+		t.Errorf("expected a body over the limit to be rejected, got %d", tooBig.Code)
+	}
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		refused := recordWebhook(MondoWebhook, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "refused", status)
+		})
+		refused(httptest.NewRecorder(), httptest.NewRequest("POST", "/mondo/webhook/abc/wrong", strings.NewReader("{}")))
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/huge" {
+			w.Header().Set(ContentType, ApplicationJson)
+			w.Write([]byte(huge))
+		}
+	}))
+	defer upstream.Close()
+	client := &http.Client{Transport: recorder.Transport(http.DefaultTransport)}
+	ctx := context.WithValue(context.Background(), recordedJobKey{}, &job{Id: "job_1"})
+	request, err := http.NewRequestWithContext(ctx, "GET", upstream.URL+"/map.png?key=secret-key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	request, err = http.NewRequestWithContext(ctx, "GET", upstream.URL+"/huge", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if len(body) != len(huge) {
+		t.Errorf("expected the client to get the whole response, got %d bytes", len(body))
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-key") {
+		t.Errorf("recorded an API key: %s", data)
+	}
+	webhooks, err := readWebhookLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 1 || !webhooks[0].Truncated || len(webhooks[0].Body) != maxRecordedBody {
+		t.Fatalf("expected one truncated webhook, got %d", len(webhooks))
+	}
+	if _, err := replayWebhook(webhooks[0], ""); err == nil {
+		t.Errorf("expected a truncated webhook not to be replayed")
+	}
+	upstreamTruncated := false
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		record := &webhookLogRecord{}
+		if err := json.Unmarshal([]byte(line), record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Kind == upstreamRecord && strings.HasSuffix(record.Url, "/huge") {
+			upstreamTruncated = record.Truncated && len(record.Response) == maxRecordedBody
+		}
+	}
+	if !upstreamTruncated {
+		t.Errorf("expected the huge response to be recorded truncated")
+	}
+}